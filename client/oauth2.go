@@ -0,0 +1,57 @@
+package client
+
+import (
+	"github.com/opentarock/service-api/go/proto_oauth2"
+	"github.com/opentarock/service-user-management/nnservice"
+)
+
+// Oauth2Client is a client for the OAuth2 service.
+type Oauth2Client struct {
+	client *nnservice.Client
+}
+
+func NewOauth2Client(client *nnservice.Client) *Oauth2Client {
+	// Validating a token does not change anything so it can be retried.
+	client.SetIdempotent(proto_oauth2.ValidateMessage)
+	return &Oauth2Client{
+		client: client,
+	}
+}
+
+func (c *Oauth2Client) AccessToken(
+	request *proto_oauth2.AccessTokenAuthentication) (*proto_oauth2.AccessTokenResponse, error) {
+
+	response := &proto_oauth2.AccessTokenResponse{}
+	err := c.client.Call(proto_oauth2.AccessTokenAuthenticationMessage, request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *Oauth2Client) Validate(
+	request *proto_oauth2.ValidateTokenRequest) (*proto_oauth2.ValidateTokenResponse, error) {
+
+	response := &proto_oauth2.ValidateTokenResponse{}
+	err := c.client.Call(proto_oauth2.ValidateMessage, request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Check returns an error if the service does not support all the messages
+// used by the client.
+func (c *Oauth2Client) Check() error {
+	return checkMessages(c.client,
+		clientMessage{
+			proto_oauth2.AccessTokenAuthenticationMessage,
+			&proto_oauth2.AccessTokenAuthentication{},
+			&proto_oauth2.AccessTokenResponse{},
+		},
+		clientMessage{
+			proto_oauth2.ValidateMessage,
+			&proto_oauth2.ValidateTokenRequest{},
+			&proto_oauth2.ValidateTokenResponse{},
+		})
+}
@@ -0,0 +1,32 @@
+package client
+
+import (
+	"fmt"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/opentarock/service-user-management/nnservice"
+)
+
+// clientMessage is a message type used by a client together with its request
+// and reply messages.
+type clientMessage struct {
+	messageId int
+	request   proto.Message
+	response  proto.Message
+}
+
+// checkMessages asks the service which messages it handles and returns an
+// error if any of the messages is not supported.
+func checkMessages(client *nnservice.Client, messages ...clientMessage) error {
+	reflection, err := client.Reflect()
+	if err != nil {
+		return fmt.Errorf("Error retrieving supported messages: %s", err)
+	}
+	for _, m := range messages {
+		if !reflection.Supports(m.messageId, m.request, m.response) {
+			return fmt.Errorf("Service %s does not support message type %d (%s)",
+				reflection.GetService(), m.messageId, nnservice.MessageTypeName(m.request))
+		}
+	}
+	return nil
+}
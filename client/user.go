@@ -0,0 +1,166 @@
+package client
+
+import (
+	"github.com/opentarock/service-api/go/proto_password"
+	"github.com/opentarock/service-api/go/proto_session"
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-api/go/proto_verification"
+	"github.com/opentarock/service-user-management/nnservice"
+)
+
+// UserClient is a client for the user service.
+type UserClient struct {
+	client *nnservice.Client
+}
+
+func NewUserClient(client *nnservice.Client) *UserClient {
+	// Validating a session does not change anything so it can be retried.
+	client.SetIdempotent(proto_session.ValidateSessionMessage)
+	return &UserClient{
+		client: client,
+	}
+}
+
+func (c *UserClient) RegisterUser(request *proto_user.RegisterUser) (*proto_user.RegisterResponse, error) {
+	response := &proto_user.RegisterResponse{}
+	err := c.client.Call(proto_user.RegisterUserMessage, request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *UserClient) AuthenticateUser(request *proto_user.AuthenticateUser) (*proto_user.AuthenticateResult, error) {
+	response := &proto_user.AuthenticateResult{}
+	err := c.client.Call(proto_user.AuthenticateUserMessage, request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *UserClient) ValidateSession(
+	request *proto_session.ValidateSession) (*proto_session.SessionResponse, error) {
+
+	response := &proto_session.SessionResponse{}
+	err := c.client.Call(proto_session.ValidateSessionMessage, request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *UserClient) TouchSession(
+	request *proto_session.TouchSession) (*proto_session.SessionResponse, error) {
+
+	response := &proto_session.SessionResponse{}
+	err := c.client.Call(proto_session.TouchSessionMessage, request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *UserClient) Logout(request *proto_session.Logout) (*proto_session.LogoutResponse, error) {
+	response := &proto_session.LogoutResponse{}
+	err := c.client.Call(proto_session.LogoutMessage, request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *UserClient) VerifyEmail(
+	request *proto_verification.VerifyEmail) (*proto_verification.VerifyEmailResponse, error) {
+
+	response := &proto_verification.VerifyEmailResponse{}
+	err := c.client.Call(proto_verification.VerifyEmailMessage, request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *UserClient) ResendVerification(
+	request *proto_verification.ResendVerification) (*proto_verification.ResendVerificationResponse, error) {
+
+	response := &proto_verification.ResendVerificationResponse{}
+	err := c.client.Call(proto_verification.ResendVerificationMessage, request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *UserClient) RequestPasswordReset(
+	request *proto_password.RequestPasswordReset) (*proto_password.RequestPasswordResetResponse, error) {
+
+	response := &proto_password.RequestPasswordResetResponse{}
+	err := c.client.Call(proto_password.RequestPasswordResetMessage, request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *UserClient) ResetPassword(
+	request *proto_password.ResetPassword) (*proto_password.ResetPasswordResponse, error) {
+
+	response := &proto_password.ResetPasswordResponse{}
+	err := c.client.Call(proto_password.ResetPasswordMessage, request, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Check returns an error if the service does not support all the messages
+// used by the client.
+func (c *UserClient) Check() error {
+	return checkMessages(c.client,
+		clientMessage{
+			proto_user.RegisterUserMessage,
+			&proto_user.RegisterUser{},
+			&proto_user.RegisterResponse{},
+		},
+		clientMessage{
+			proto_user.AuthenticateUserMessage,
+			&proto_user.AuthenticateUser{},
+			&proto_user.AuthenticateResult{},
+		},
+		clientMessage{
+			proto_session.ValidateSessionMessage,
+			&proto_session.ValidateSession{},
+			&proto_session.SessionResponse{},
+		},
+		clientMessage{
+			proto_session.TouchSessionMessage,
+			&proto_session.TouchSession{},
+			&proto_session.SessionResponse{},
+		},
+		clientMessage{
+			proto_session.LogoutMessage,
+			&proto_session.Logout{},
+			&proto_session.LogoutResponse{},
+		},
+		clientMessage{
+			proto_verification.VerifyEmailMessage,
+			&proto_verification.VerifyEmail{},
+			&proto_verification.VerifyEmailResponse{},
+		},
+		clientMessage{
+			proto_verification.ResendVerificationMessage,
+			&proto_verification.ResendVerification{},
+			&proto_verification.ResendVerificationResponse{},
+		},
+		clientMessage{
+			proto_password.RequestPasswordResetMessage,
+			&proto_password.RequestPasswordReset{},
+			&proto_password.RequestPasswordResetResponse{},
+		},
+		clientMessage{
+			proto_password.ResetPasswordMessage,
+			&proto_password.ResetPassword{},
+			&proto_password.ResetPasswordResponse{},
+		})
+}
@@ -0,0 +1,61 @@
+// Command email-duplicates reports users whose email addresses are the same
+// when normalized, e.g. differ only in case or surrounding whitespace. Such
+// users must be merged or removed before their normalized addresses can be
+// stored. It exits with status 1 if duplicates are found. With -backfill it
+// then stores the normalized addresses of the users that differ from the
+// stored ones, which is needed for internationalized domains after the
+// normalized email column is added and whenever the normalization changes.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	_ "github.com/lib/pq"
+
+	"github.com/opentarock/service-user-management/repository"
+)
+
+var (
+	dataSource = flag.String("db", "user=postgres dbname=users sslmode=disable",
+		"Connection string of the users database")
+	backfill = flag.Bool("backfill", false,
+		"Store the normalized email addresses if there are no duplicates")
+)
+
+func main() {
+	flag.Parse()
+	db, err := sql.Open("postgres", *dataSource)
+	if err != nil {
+		log.Fatalf("Error connecting to database: %s", err)
+	}
+	defer db.Close()
+
+	duplicates, err := repository.FindDuplicateEmails(db)
+	if err != nil {
+		log.Fatalf("Error finding duplicate email addresses: %s", err)
+	}
+	if len(duplicates) == 0 {
+		fmt.Println("No duplicate email addresses found.")
+		if *backfill {
+			updated, err := repository.BackfillNormalizedEmails(db)
+			if err != nil {
+				log.Fatalf("Error storing normalized email addresses: %s", err)
+			}
+			fmt.Printf("Normalized email addresses of %d users stored.\n", updated)
+		}
+		return
+	}
+	for _, duplicate := range duplicates {
+		fmt.Printf("%s:\n", duplicate.EmailNormalized)
+		for _, user := range duplicate.Users {
+			fmt.Printf("\tid=%d email=%s\n", user.Id, user.Email)
+		}
+	}
+	fmt.Printf("%d duplicate email addresses found.\n", len(duplicates))
+	db.Close()
+	os.Exit(1)
+}
@@ -0,0 +1,76 @@
+// Command redirect-uris manages the redirect URIs registered for a client,
+// which are accepted by the registration of the user service.
+//
+//	redirect-uris -client <client id> list
+//	redirect-uris -client <client id> add <uri>
+//	redirect-uris -client <client id> remove <uri>
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+
+	_ "github.com/lib/pq"
+
+	"github.com/opentarock/service-user-management/repository"
+)
+
+var (
+	dataSource = flag.String("db", "user=postgres dbname=users sslmode=disable",
+		"Connection string of the users database")
+	clientId = flag.String("client", "", "Id of the client")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s -client <client id> list | add <uri> | remove <uri>\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if *clientId == "" || flag.NArg() == 0 {
+		usage()
+	}
+	db, err := sql.Open("postgres", *dataSource)
+	if err != nil {
+		log.Fatalf("Error connecting to database: %s", err)
+	}
+	defer db.Close()
+	redirectUris := repository.NewRedirectUriRepositoryPostgres(db)
+	defer redirectUris.Close()
+
+	switch command := flag.Arg(0); {
+	case command == "list" && flag.NArg() == 1:
+		uris, err := redirectUris.FindByClientId(*clientId)
+		if err != nil {
+			log.Fatalf("Error retrieving redirect uris: %s", err)
+		}
+		for _, uri := range uris {
+			fmt.Println(uri)
+		}
+	case command == "add" && flag.NArg() == 2:
+		uri := flag.Arg(1)
+		if u, err := url.Parse(uri); err != nil || !u.IsAbs() || u.Fragment != "" {
+			log.Fatalf("Redirect uri must be an absolute URI without a fragment: %s", uri)
+		}
+		if err := redirectUris.Add(*clientId, uri); err != nil {
+			log.Fatalf("Error adding redirect uri: %s", err)
+		}
+	case command == "remove" && flag.NArg() == 2:
+		removed, err := redirectUris.Remove(*clientId, flag.Arg(1))
+		if err != nil {
+			log.Fatalf("Error removing redirect uri: %s", err)
+		}
+		if !removed {
+			log.Fatalf("Redirect uri is not registered: %s", flag.Arg(1))
+		}
+	default:
+		usage()
+	}
+}
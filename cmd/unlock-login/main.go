@@ -0,0 +1,58 @@
+// Command unlock-login forgets the failed logins of an account or of a source
+// of requests, which unlocks logins blocked by the user service.
+//
+//	unlock-login -account <email>
+//	unlock-login -source <address>
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	_ "github.com/lib/pq"
+
+	"github.com/opentarock/service-user-management/repository"
+	"github.com/opentarock/service-user-management/service"
+)
+
+var (
+	dataSource = flag.String("db", "user=postgres dbname=users sslmode=disable",
+		"Connection string of the users database")
+	account = flag.String("account", "", "Email address of the account to unlock")
+	source  = flag.String("source", "", "Address of the source to unlock")
+)
+
+func main() {
+	flag.Parse()
+	var key string
+	switch {
+	case *account != "" && *source == "":
+		key = repository.AccountLoginKey(*account)
+	case *source != "" && *account == "":
+		key = repository.SourceLoginKey(*source)
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: %s -account <email> | -source <address>\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	db, err := sql.Open("postgres", *dataSource)
+	if err != nil {
+		log.Fatalf("Error connecting to database: %s", err)
+	}
+	defer db.Close()
+	attempts := repository.NewLoginAttemptRepositoryPostgres(db)
+	defer attempts.Close()
+
+	unlocked, err := service.NewLoginLockout(attempts).Unlock(nil, key)
+	if err != nil {
+		log.Fatalf("Error unlocking logins: %s", err)
+	}
+	if unlocked {
+		fmt.Printf("Failed logins forgotten: %s\n", key)
+	} else {
+		fmt.Printf("No failed logins: %s\n", key)
+	}
+}
@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE TABLE event_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    topic TEXT NOT NULL,
+    envelope BYTEA NOT NULL,
+    recorded_on TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- +goose Down
+DROP TABLE event_outbox;
@@ -0,0 +1,14 @@
+-- +goose Up
+CREATE TABLE sessions (
+    sid TEXT PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_on TIMESTAMP NOT NULL,
+    last_seen_on TIMESTAMP NOT NULL,
+    expires_on TIMESTAMP NOT NULL,
+    client_address TEXT,
+    user_agent TEXT
+);
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+
+-- +goose Down
+DROP TABLE sessions;
@@ -0,0 +1,20 @@
+-- +goose Up
+-- Creating the unique index fails if an email address is already registered
+-- more than once. Duplicates can be found with cmd/email-duplicates before the
+-- migration is applied. Addresses with internationalized domains are stored
+-- in the ASCII form by cmd/email-duplicates -backfill afterwards, which can
+-- not be done in SQL.
+ALTER TABLE users
+ADD COLUMN email_normalized TEXT;
+
+UPDATE users
+SET email_normalized = lower(trim(email));
+
+ALTER TABLE users
+ALTER COLUMN email_normalized SET NOT NULL;
+
+CREATE UNIQUE INDEX users_email_normalized_key ON users (email_normalized);
+
+-- +goose Down
+ALTER TABLE users
+DROP COLUMN email_normalized;
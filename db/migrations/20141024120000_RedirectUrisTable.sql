@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE TABLE redirect_uris (
+    client_id TEXT NOT NULL REFERENCES clients (client_id) ON DELETE CASCADE,
+    redirect_uri TEXT NOT NULL,
+    created_on TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (client_id, redirect_uri)
+);
+
+-- +goose Down
+DROP TABLE redirect_uris;
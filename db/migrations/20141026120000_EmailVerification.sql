@@ -0,0 +1,17 @@
+-- +goose Up
+-- Existing users have not verified their email addresses either.
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Only hashes of the tokens sent to the users are stored.
+CREATE TABLE email_verifications (
+    token_hash TEXT PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    created_on TIMESTAMP NOT NULL,
+    expires_on TIMESTAMP NOT NULL
+);
+CREATE INDEX email_verifications_user_id_idx ON email_verifications (user_id);
+
+-- +goose Down
+DROP TABLE email_verifications;
+ALTER TABLE users DROP COLUMN email_verified;
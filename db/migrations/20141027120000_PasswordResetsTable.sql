@@ -0,0 +1,12 @@
+-- +goose Up
+-- Only hashes of the tokens sent to the users are stored.
+CREATE TABLE password_resets (
+    token_hash TEXT PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_on TIMESTAMP NOT NULL,
+    expires_on TIMESTAMP NOT NULL
+);
+CREATE INDEX password_resets_user_id_idx ON password_resets (user_id);
+
+-- +goose Down
+DROP TABLE password_resets;
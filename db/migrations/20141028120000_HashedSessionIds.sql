@@ -0,0 +1,12 @@
+-- +goose Up
+-- Only hashes of the session ids are stored. Ids of the existing sessions can
+-- not be hashed in SQL the same way as in the service, so the sessions are
+-- ended.
+DELETE FROM sessions;
+ALTER TABLE sessions RENAME COLUMN sid TO sid_hash;
+CREATE INDEX sessions_expires_on_idx ON sessions (expires_on);
+
+-- +goose Down
+DROP INDEX sessions_expires_on_idx;
+DELETE FROM sessions;
+ALTER TABLE sessions RENAME COLUMN sid_hash TO sid;
@@ -0,0 +1,165 @@
+package events
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+
+	"github.com/opentarock/service-api/go/proto_oauth2"
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/util"
+)
+
+// Topics of the published events. Every published message starts with the
+// topic so subscribers can subscribe to a single event or to a prefix, e.g.
+// "user." for all the user events.
+const (
+	TopicUserRegistered       = "user.registered"
+	TopicUserAuthenticated    = "user.authenticated"
+	TopicAuthenticationFailed = "user.authentication_failed"
+	TopicEmailVerified        = "user.email_verified"
+	TopicPasswordReset        = "user.password_reset"
+	TopicTokenIssued          = "oauth2.token_issued"
+	TopicTokenRefreshed       = "oauth2.token_refreshed"
+	TopicTokenRevoked         = "oauth2.token_revoked"
+)
+
+// Separates the topic from the envelope in published messages.
+const topicSeparator = 0
+
+const eventIdLength = 16
+
+var ErrMalformedMessage = errors.New("events: malformed_message")
+
+// Event is a domain event that is recorded in the outbox and published to
+// subscribers.
+type Event struct {
+	Topic      string
+	OccurredAt time.Time
+	// The payload is created when the event is encoded so that values assigned
+	// while saving the change (e.g. user id) are included.
+	payload func() proto.Message
+}
+
+func newEvent(topic string, payload func() proto.Message) *Event {
+	return &Event{
+		Topic:      topic,
+		OccurredAt: time.Now(),
+		payload:    payload,
+	}
+}
+
+// Encode returns the encoded envelope of the event with a new unique id.
+func (e *Event) Encode() ([]byte, error) {
+	payloadData, err := proto.Marshal(e.payload())
+	if err != nil {
+		return nil, fmt.Errorf("Error marshalling %s payload: %s", e.Topic, err)
+	}
+	id, err := util.NewRandTokenGenerator().GenerateHex(eventIdLength)
+	if err != nil {
+		return nil, fmt.Errorf("Error generating event id: %s", err)
+	}
+	return proto.Marshal(&Envelope{
+		Id:         proto.String(id),
+		Topic:      proto.String(e.Topic),
+		OccurredAt: proto.Int64(e.OccurredAt.UnixNano() / int64(time.Millisecond)),
+		Payload:    payloadData,
+	})
+}
+
+// EncodeMessage returns the message that is published for the envelope.
+func EncodeMessage(topic string, envelopeData []byte) []byte {
+	message := make([]byte, 0, len(topic)+1+len(envelopeData))
+	message = append(message, topic...)
+	message = append(message, topicSeparator)
+	return append(message, envelopeData...)
+}
+
+// DecodeMessage decodes the published message.
+func DecodeMessage(message []byte) (*Envelope, error) {
+	i := bytes.IndexByte(message, topicSeparator)
+	if i < 0 {
+		return nil, ErrMalformedMessage
+	}
+	envelope := &Envelope{}
+	err := proto.Unmarshal(message[i+1:], envelope)
+	if err != nil {
+		return nil, err
+	}
+	if envelope.GetTopic() != string(message[:i]) {
+		return nil, ErrMalformedMessage
+	}
+	return envelope, nil
+}
+
+func NewUserRegistered(user *proto_user.User) *Event {
+	return newEvent(TopicUserRegistered, func() proto.Message {
+		return &UserRegistered{
+			UserId:      user.Id,
+			Email:       user.Email,
+			DisplayName: user.DisplayName,
+		}
+	})
+}
+
+func NewUserAuthenticated(user *proto_user.User) *Event {
+	return newEvent(TopicUserAuthenticated, func() proto.Message {
+		return &UserAuthenticated{
+			UserId: user.Id,
+		}
+	})
+}
+
+func NewAuthenticationFailed(email, method string) *Event {
+	return newEvent(TopicAuthenticationFailed, func() proto.Message {
+		return &AuthenticationFailed{
+			Email:  proto.String(email),
+			Method: proto.String(method),
+		}
+	})
+}
+
+func NewEmailVerified(userId uint64, email string) *Event {
+	return newEvent(TopicEmailVerified, func() proto.Message {
+		return &EmailVerified{
+			UserId: proto.Uint64(userId),
+			Email:  proto.String(email),
+		}
+	})
+}
+
+// NewPasswordReset is recorded when the user sets a new password with a reset
+// token. All sessions and access tokens of the user are revoked with it.
+func NewPasswordReset(userId uint64) *Event {
+	return newEvent(TopicPasswordReset, func() proto.Message {
+		return &PasswordReset{
+			UserId: proto.Uint64(userId),
+		}
+	})
+}
+
+func NewTokenIssued(user *proto_user.User, client *proto_oauth2.Client) *Event {
+	return newTokenEvent(TopicTokenIssued, user.Id, client.GetId())
+}
+
+func NewTokenRefreshed(user *proto_user.User, client *proto_oauth2.Client) *Event {
+	return newTokenEvent(TopicTokenRefreshed, user.Id, client.GetId())
+}
+
+// NewTokenRevoked is recorded when the parents of a refreshed token are
+// deleted.
+func NewTokenRevoked(userId uint64, clientId string) *Event {
+	return newTokenEvent(TopicTokenRevoked, proto.Uint64(userId), clientId)
+}
+
+func newTokenEvent(topic string, userId *uint64, clientId string) *Event {
+	return newEvent(topic, func() proto.Message {
+		return &TokenEvent{
+			UserId:   userId,
+			ClientId: proto.String(clientId),
+		}
+	})
+}
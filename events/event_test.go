@@ -0,0 +1,61 @@
+package events_test
+
+import (
+	"testing"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/events"
+)
+
+func TestPayloadIsCreatedWhenEventIsEncoded(t *testing.T) {
+	user := &proto_user.User{
+		Email: proto.String("mail@example.com"),
+	}
+	event := events.NewUserRegistered(user)
+	// Id is assigned when the user is saved, after the event is created.
+	user.Id = proto.Uint64(5)
+
+	envelopeData, err := event.Encode()
+	assert.Nil(t, err)
+	envelope := &events.Envelope{}
+	err = proto.Unmarshal(envelopeData, envelope)
+	assert.Nil(t, err)
+	assert.Equal(t, events.TopicUserRegistered, envelope.GetTopic())
+	assert.NotEmpty(t, envelope.GetId())
+
+	payload := &events.UserRegistered{}
+	err = proto.Unmarshal(envelope.GetPayload(), payload)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), payload.GetUserId())
+	assert.Equal(t, "mail@example.com", payload.GetEmail())
+}
+
+func TestEveryEncodedEventHasUniqueId(t *testing.T) {
+	event := events.NewAuthenticationFailed("mail@example.com", "session")
+	first, err := event.Encode()
+	assert.Nil(t, err)
+	second, err := event.Encode()
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, second)
+}
+
+func TestMessageStartsWithTopic(t *testing.T) {
+	envelopeData, err := events.NewTokenRevoked(1, "client").Encode()
+	assert.Nil(t, err)
+	message := events.EncodeMessage(events.TopicTokenRevoked, envelopeData)
+	assert.Equal(t, "oauth2.", string(message[:len("oauth2.")]))
+
+	envelope, err := events.DecodeMessage(message)
+	assert.Nil(t, err)
+	assert.Equal(t, events.TopicTokenRevoked, envelope.GetTopic())
+}
+
+func TestMessageWithWrongTopicIsMalformed(t *testing.T) {
+	envelopeData, err := events.NewTokenRevoked(1, "client").Encode()
+	assert.Nil(t, err)
+	_, err = events.DecodeMessage(events.EncodeMessage(events.TopicTokenIssued, envelopeData))
+	assert.Equal(t, events.ErrMalformedMessage, err)
+}
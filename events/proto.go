@@ -0,0 +1,186 @@
+package events
+
+import "code.google.com/p/gogoprotobuf/proto"
+
+// Envelope wraps the payload of every published event.
+type Envelope struct {
+	Id *string `protobuf:"bytes,1,req,name=id" json:"id,omitempty"`
+	// Topic is the same as the topic prefix of the published message.
+	Topic *string `protobuf:"bytes,2,req,name=topic" json:"topic,omitempty"`
+	// OccurredAt is the time of the event in milliseconds since the Unix epoch.
+	OccurredAt       *int64 `protobuf:"varint,3,req,name=occurred_at" json:"occurred_at,omitempty"`
+	Payload          []byte `protobuf:"bytes,4,req,name=payload" json:"payload,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *Envelope) Reset()         { *m = Envelope{} }
+func (m *Envelope) String() string { return proto.CompactTextString(m) }
+func (*Envelope) ProtoMessage()    {}
+
+func (m *Envelope) GetId() string {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return ""
+}
+
+func (m *Envelope) GetTopic() string {
+	if m != nil && m.Topic != nil {
+		return *m.Topic
+	}
+	return ""
+}
+
+func (m *Envelope) GetOccurredAt() int64 {
+	if m != nil && m.OccurredAt != nil {
+		return *m.OccurredAt
+	}
+	return 0
+}
+
+func (m *Envelope) GetPayload() []byte {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
+type UserRegistered struct {
+	UserId           *uint64 `protobuf:"varint,1,req,name=user_id" json:"user_id,omitempty"`
+	Email            *string `protobuf:"bytes,2,req,name=email" json:"email,omitempty"`
+	DisplayName      *string `protobuf:"bytes,3,opt,name=display_name" json:"display_name,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *UserRegistered) Reset()         { *m = UserRegistered{} }
+func (m *UserRegistered) String() string { return proto.CompactTextString(m) }
+func (*UserRegistered) ProtoMessage()    {}
+
+func (m *UserRegistered) GetUserId() uint64 {
+	if m != nil && m.UserId != nil {
+		return *m.UserId
+	}
+	return 0
+}
+
+func (m *UserRegistered) GetEmail() string {
+	if m != nil && m.Email != nil {
+		return *m.Email
+	}
+	return ""
+}
+
+func (m *UserRegistered) GetDisplayName() string {
+	if m != nil && m.DisplayName != nil {
+		return *m.DisplayName
+	}
+	return ""
+}
+
+type UserAuthenticated struct {
+	UserId           *uint64 `protobuf:"varint,1,req,name=user_id" json:"user_id,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *UserAuthenticated) Reset()         { *m = UserAuthenticated{} }
+func (m *UserAuthenticated) String() string { return proto.CompactTextString(m) }
+func (*UserAuthenticated) ProtoMessage()    {}
+
+func (m *UserAuthenticated) GetUserId() uint64 {
+	if m != nil && m.UserId != nil {
+		return *m.UserId
+	}
+	return 0
+}
+
+type EmailVerified struct {
+	UserId           *uint64 `protobuf:"varint,1,req,name=user_id" json:"user_id,omitempty"`
+	Email            *string `protobuf:"bytes,2,req,name=email" json:"email,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *EmailVerified) Reset()         { *m = EmailVerified{} }
+func (m *EmailVerified) String() string { return proto.CompactTextString(m) }
+func (*EmailVerified) ProtoMessage()    {}
+
+func (m *EmailVerified) GetUserId() uint64 {
+	if m != nil && m.UserId != nil {
+		return *m.UserId
+	}
+	return 0
+}
+
+func (m *EmailVerified) GetEmail() string {
+	if m != nil && m.Email != nil {
+		return *m.Email
+	}
+	return ""
+}
+
+type PasswordReset struct {
+	UserId           *uint64 `protobuf:"varint,1,req,name=user_id" json:"user_id,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *PasswordReset) Reset()         { *m = PasswordReset{} }
+func (m *PasswordReset) String() string { return proto.CompactTextString(m) }
+func (*PasswordReset) ProtoMessage()    {}
+
+func (m *PasswordReset) GetUserId() uint64 {
+	if m != nil && m.UserId != nil {
+		return *m.UserId
+	}
+	return 0
+}
+
+type AuthenticationFailed struct {
+	Email *string `protobuf:"bytes,1,req,name=email" json:"email,omitempty"`
+	// Method is the way the user tried to authenticate, e.g. session or
+	// password_grant.
+	Method           *string `protobuf:"bytes,2,opt,name=method" json:"method,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *AuthenticationFailed) Reset()         { *m = AuthenticationFailed{} }
+func (m *AuthenticationFailed) String() string { return proto.CompactTextString(m) }
+func (*AuthenticationFailed) ProtoMessage()    {}
+
+func (m *AuthenticationFailed) GetEmail() string {
+	if m != nil && m.Email != nil {
+		return *m.Email
+	}
+	return ""
+}
+
+func (m *AuthenticationFailed) GetMethod() string {
+	if m != nil && m.Method != nil {
+		return *m.Method
+	}
+	return ""
+}
+
+// TokenEvent is the payload of all the access token events. Token values are
+// never published.
+type TokenEvent struct {
+	UserId           *uint64 `protobuf:"varint,1,opt,name=user_id" json:"user_id,omitempty"`
+	ClientId         *string `protobuf:"bytes,2,req,name=client_id" json:"client_id,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *TokenEvent) Reset()         { *m = TokenEvent{} }
+func (m *TokenEvent) String() string { return proto.CompactTextString(m) }
+func (*TokenEvent) ProtoMessage()    {}
+
+func (m *TokenEvent) GetUserId() uint64 {
+	if m != nil && m.UserId != nil {
+		return *m.UserId
+	}
+	return 0
+}
+
+func (m *TokenEvent) GetClientId() string {
+	if m != nil && m.ClientId != nil {
+		return *m.ClientId
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+package events
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	nmsg "github.com/op/go-nanomsg"
+)
+
+// How long publishing a message can block before it fails.
+const publishTimeout = time.Second
+
+// Publisher sends encoded event envelopes to subscribers.
+type Publisher interface {
+	Publish(topic string, envelopeData []byte) error
+	Close() error
+}
+
+type PublisherFunc func(topic string, envelopeData []byte) error
+
+func (f PublisherFunc) Publish(topic string, envelopeData []byte) error {
+	return f(topic, envelopeData)
+}
+
+func (f PublisherFunc) Close() error {
+	return nil
+}
+
+type nanomsgPublisher struct {
+	socket *nmsg.PubSocket
+}
+
+// NewNanomsgPublisher binds a PUB socket to the address. Subscribers connect
+// with SUB sockets and subscribe to topic prefixes.
+func NewNanomsgPublisher(address string) (*nanomsgPublisher, error) {
+	socket, err := nmsg.NewPubSocket()
+	if err != nil {
+		return nil, fmt.Errorf("Error creating publish socket: %s", err)
+	}
+	err = socket.SetSendTimeout(publishTimeout)
+	if err != nil {
+		socket.Close()
+		return nil, fmt.Errorf("Error setting send timeout: %s", err)
+	}
+	endpoint, err := socket.Bind(address)
+	if err != nil {
+		socket.Close()
+		return nil, fmt.Errorf("Error binding socket: %s", err)
+	}
+	log.Printf("Publishing events on: %s", endpoint.Address)
+	return &nanomsgPublisher{socket: socket}, nil
+}
+
+func (p *nanomsgPublisher) Publish(topic string, envelopeData []byte) error {
+	_, err := p.socket.Send(EncodeMessage(topic, envelopeData), 0)
+	return err
+}
+
+func (p *nanomsgPublisher) Close() error {
+	return p.socket.Close()
+}
@@ -0,0 +1,107 @@
+package events
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRelayInterval is how often the outbox is checked for new events.
+	DefaultRelayInterval = time.Second
+	// DefaultRelayBatchSize is the maximum number of events read at once.
+	DefaultRelayBatchSize = 100
+)
+
+// OutboxEvent is an event recorded in the outbox that was not published yet.
+type OutboxEvent struct {
+	Id           int64
+	Topic        string
+	EnvelopeData []byte
+}
+
+// Outbox stores events recorded together with the changes that caused them.
+type Outbox interface {
+	// Pending returns at most limit events in the order they were recorded.
+	Pending(limit int) ([]*OutboxEvent, error)
+	// Delete removes a published event from the outbox.
+	Delete(id int64) error
+}
+
+// Relay publishes events from the outbox. An event is removed from the outbox
+// only after it was published, so it is published at least once and
+// subscribers should use the envelope id to ignore duplicates. Only one relay
+// should run for an outbox.
+type Relay struct {
+	Interval  time.Duration
+	BatchSize int
+	outbox    Outbox
+	publisher Publisher
+	stopping  chan struct{}
+	stopOnce  sync.Once
+	done      chan struct{}
+}
+
+func NewRelay(outbox Outbox, publisher Publisher) *Relay {
+	return &Relay{
+		Interval:  DefaultRelayInterval,
+		BatchSize: DefaultRelayBatchSize,
+		outbox:    outbox,
+		publisher: publisher,
+		stopping:  make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start publishes events from the outbox until the relay is stopped.
+func (r *Relay) Start() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		_, err := r.Flush()
+		if err != nil {
+			log.Printf("Error publishing events: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-r.stopping:
+			return
+		}
+	}
+}
+
+// Flush publishes all the pending events and returns the number of published
+// events. It stops at the first event that could not be published so the
+// order of events is preserved.
+func (r *Relay) Flush() (int, error) {
+	published := 0
+	for {
+		pending, err := r.outbox.Pending(r.BatchSize)
+		if err != nil {
+			return published, err
+		}
+		for _, event := range pending {
+			err := r.publisher.Publish(event.Topic, event.EnvelopeData)
+			if err != nil {
+				return published, err
+			}
+			err = r.outbox.Delete(event.Id)
+			if err != nil {
+				return published, err
+			}
+			published++
+		}
+		if len(pending) < r.BatchSize {
+			return published, nil
+		}
+	}
+}
+
+// Stop stops the relay started with Start and waits for it to finish.
+func (r *Relay) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stopping)
+	})
+	<-r.done
+}
@@ -0,0 +1,81 @@
+package events_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-user-management/events"
+)
+
+type memoryOutbox struct {
+	events []*events.OutboxEvent
+}
+
+func (o *memoryOutbox) Pending(limit int) ([]*events.OutboxEvent, error) {
+	if len(o.events) < limit {
+		limit = len(o.events)
+	}
+	return o.events[:limit], nil
+}
+
+func (o *memoryOutbox) Delete(id int64) error {
+	for i, event := range o.events {
+		if event.Id == id {
+			o.events = append(o.events[:i], o.events[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("not found")
+}
+
+func newMemoryOutbox(n int) *memoryOutbox {
+	outbox := &memoryOutbox{}
+	for i := 1; i <= n; i++ {
+		outbox.events = append(outbox.events, &events.OutboxEvent{
+			Id:    int64(i),
+			Topic: events.TopicUserAuthenticated,
+		})
+	}
+	return outbox
+}
+
+func TestRelayPublishesAllPendingEventsInOrder(t *testing.T) {
+	outbox := newMemoryOutbox(5)
+	published := []string{}
+	relay := events.NewRelay(outbox, events.PublisherFunc(func(topic string, envelopeData []byte) error {
+		published = append(published, topic)
+		return nil
+	}))
+	relay.BatchSize = 2
+
+	n, err := relay.Flush()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, 5, len(published))
+	assert.Empty(t, outbox.events)
+}
+
+func TestEventIsKeptInOutboxIfPublishFails(t *testing.T) {
+	outbox := newMemoryOutbox(3)
+	calls := 0
+	relay := events.NewRelay(outbox, events.PublisherFunc(func(topic string, envelopeData []byte) error {
+		calls++
+		if calls == 2 {
+			return errors.New("publish failed")
+		}
+		return nil
+	}))
+
+	n, err := relay.Flush()
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 2, len(outbox.events))
+	assert.Equal(t, int64(2), outbox.events[0].Id)
+
+	n, err = relay.Flush()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Empty(t, outbox.events)
+}
@@ -0,0 +1,234 @@
+// Package i18n translates messages shown to the end users. Messages are looked
+// up in a catalog by message id and formatted in the language negotiated from
+// the locales requested by the user.
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Message is the translation of a message with a format for every plural
+// category used by the language, e.g. "one" and "other" in English. Messages
+// that do not depend on a number only have the "other" format.
+type Message map[string]string
+
+// UnmarshalJSON accepts either a single format or an object with formats by
+// plural category.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var format string
+	if err := json.Unmarshal(data, &format); err == nil {
+		*m = Message{PluralOther: format}
+		return nil
+	}
+	var forms map[string]string
+	if err := json.Unmarshal(data, &forms); err != nil {
+		return err
+	}
+	*m = Message(forms)
+	return nil
+}
+
+// Messages are the translations of messages to one locale by message id.
+type Messages map[string]Message
+
+// Catalog holds the translations of messages to all supported locales.
+// Translations must not be added while messages are being translated.
+type Catalog struct {
+	defaultLocale string
+	locales       map[string]Messages
+}
+
+// NewCatalog returns a catalog with the messages in the default locale, which
+// is used when none of the requested locales are supported and for messages
+// that are not translated.
+func NewCatalog(defaultLocale string, messages Messages) *Catalog {
+	c := &Catalog{
+		defaultLocale: normalizeLocale(defaultLocale),
+		locales:       make(map[string]Messages),
+	}
+	c.Add(defaultLocale, messages)
+	return c
+}
+
+// Add adds translations to the locale, replacing existing translations of the
+// same messages.
+func (c *Catalog) Add(locale string, messages Messages) {
+	locale = normalizeLocale(locale)
+	if c.locales[locale] == nil {
+		c.locales[locale] = make(Messages)
+	}
+	for id, message := range messages {
+		c.locales[locale][id] = message
+	}
+}
+
+// LoadDir adds translations from all files named <locale>.json in the
+// directory. A file contains an object with messages by message id.
+func (c *Catalog) LoadDir(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var messages Messages
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return fmt.Errorf("Error parsing %s: %s", path, err)
+		}
+		c.Add(strings.TrimSuffix(filepath.Base(path), ".json"), messages)
+	}
+	return nil
+}
+
+// Locales returns all supported locales.
+func (c *Catalog) Locales() []string {
+	locales := make([]string, 0, len(c.locales))
+	for locale := range c.locales {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Negotiate returns the supported locale that best matches the requested
+// locales. Every argument is a single locale or a list in the format of the
+// HTTP Accept-Language header and the arguments are tried in order. A locale
+// matches if it is supported or if its language is, e.g. "de-AT" is matched
+// by "de". The default locale is returned if nothing matches.
+func (c *Catalog) Negotiate(requested ...string) string {
+	for _, list := range requested {
+		for _, locale := range parseLocaleList(list) {
+			if _, ok := c.locales[locale]; ok {
+				return locale
+			}
+			if _, ok := c.locales[language(locale)]; ok {
+				return language(locale)
+			}
+		}
+	}
+	return c.defaultLocale
+}
+
+// Localizer returns a localizer for the locale negotiated from the requested
+// locales.
+func (c *Catalog) Localizer(requested ...string) *Localizer {
+	return &Localizer{
+		catalog: c,
+		locale:  c.Negotiate(requested...),
+	}
+}
+
+// lookup returns the translation of the message to the locale, falling back
+// to the language of the locale and the default locale.
+func (c *Catalog) lookup(locale, id string) (string, Message) {
+	for _, l := range []string{locale, language(locale), c.defaultLocale} {
+		if message, ok := c.locales[l][id]; ok {
+			return l, message
+		}
+	}
+	return c.defaultLocale, nil
+}
+
+// Localizer translates messages to a single locale.
+type Localizer struct {
+	catalog *Catalog
+	locale  string
+}
+
+// Locale returns the locale messages are translated to.
+func (l *Localizer) Locale() string {
+	return l.locale
+}
+
+// T translates the message and formats it with the arguments as fmt.Sprintf
+// does. The message id is returned if the message is not in the catalog.
+func (l *Localizer) T(id string, args ...interface{}) string {
+	_, message := l.catalog.lookup(l.locale, id)
+	return format(message, PluralOther, id, args)
+}
+
+// N translates the message using the plural form for the number n. The
+// message is formatted with n followed by the other arguments.
+func (l *Localizer) N(id string, n int, args ...interface{}) string {
+	locale, message := l.catalog.lookup(l.locale, id)
+	return format(message, PluralCategory(locale, n), id, append([]interface{}{n}, args...))
+}
+
+func format(message Message, category, id string, args []interface{}) string {
+	f, ok := message[category]
+	if !ok {
+		f, ok = message[PluralOther]
+	}
+	if !ok {
+		return id
+	}
+	if len(args) == 0 {
+		return f
+	}
+	return fmt.Sprintf(f, args...)
+}
+
+// normalizeLocale converts the locale to lowercase with parts separated by a
+// hyphen, e.g. "en_US" to "en-us".
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
+
+// language returns the language part of the locale, e.g. "en" for "en-us".
+func language(locale string) string {
+	if i := strings.Index(locale, "-"); i >= 0 {
+		return locale[:i]
+	}
+	return locale
+}
+
+type weightedLocale struct {
+	locale  string
+	quality float64
+}
+
+type byQuality []weightedLocale
+
+func (a byQuality) Len() int           { return len(a) }
+func (a byQuality) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byQuality) Less(i, j int) bool { return a[i].quality > a[j].quality }
+
+// parseLocaleList parses a list of locales with optional quality values, e.g.
+// "de-AT, de;q=0.8, en;q=0.5", and returns the locales ordered by quality.
+func parseLocaleList(list string) []string {
+	weighted := make([]weightedLocale, 0)
+	for _, item := range strings.Split(list, ",") {
+		parts := strings.Split(item, ";")
+		locale := normalizeLocale(parts[0])
+		if locale == "" || locale == "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			weighted = append(weighted, weightedLocale{locale, quality})
+		}
+	}
+	sort.Stable(byQuality(weighted))
+	locales := make([]string, len(weighted))
+	for i, w := range weighted {
+		locales[i] = w.locale
+	}
+	return locales
+}
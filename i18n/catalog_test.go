@@ -0,0 +1,114 @@
+package i18n_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-user-management/i18n"
+)
+
+func newCatalog() *i18n.Catalog {
+	catalog := i18n.NewCatalog("en", i18n.Messages{
+		"hello": {i18n.PluralOther: "Hello, %s."},
+		"items": {
+			i18n.PluralOne:   "%d item in %s",
+			i18n.PluralOther: "%d items in %s",
+		},
+		"bye": {i18n.PluralOther: "Bye."},
+	})
+	catalog.Add("sl", i18n.Messages{
+		"hello": {i18n.PluralOther: "Zdravo, %s."},
+		"items": {
+			i18n.PluralOne:   "%d predmet v %s",
+			i18n.PluralTwo:   "%d predmeta v %s",
+			i18n.PluralFew:   "%d predmeti v %s",
+			i18n.PluralOther: "%d predmetov v %s",
+		},
+	})
+	catalog.Add("pt-BR", i18n.Messages{
+		"hello": {i18n.PluralOther: "Olá, %s."},
+	})
+	return catalog
+}
+
+func TestLocaleIsNegotiated(t *testing.T) {
+	catalog := newCatalog()
+	assert.Equal(t, "sl", catalog.Negotiate("sl"))
+	assert.Equal(t, "sl", catalog.Negotiate("sl-SI"))
+	assert.Equal(t, "pt-br", catalog.Negotiate("pt_BR"))
+	assert.Equal(t, "en", catalog.Negotiate("pt"))
+	assert.Equal(t, "en", catalog.Negotiate("fr", ""))
+	assert.Equal(t, "sl", catalog.Negotiate("fr", "de, sl"))
+	assert.Equal(t, "sl", catalog.Negotiate("en;q=0.5, sl;q=0.9, *"))
+	assert.Equal(t, "en", catalog.Negotiate("sl;q=0, en-GB"))
+}
+
+func TestMessagesAreTranslated(t *testing.T) {
+	catalog := newCatalog()
+	assert.Equal(t, "Zdravo, Ana.", catalog.Localizer("sl-SI").T("hello", "Ana"))
+	assert.Equal(t, "Hello, Ana.", catalog.Localizer("de").T("hello", "Ana"))
+	// Messages that are not translated fall back to the default locale.
+	assert.Equal(t, "Bye.", catalog.Localizer("sl").T("bye"))
+	assert.Equal(t, "unknown", catalog.Localizer("sl").T("unknown"))
+}
+
+func TestPluralFormsAreUsed(t *testing.T) {
+	catalog := newCatalog()
+	en := catalog.Localizer("en")
+	assert.Equal(t, "1 item in box", en.N("items", 1, "box"))
+	assert.Equal(t, "2 items in box", en.N("items", 2, "box"))
+
+	sl := catalog.Localizer("sl")
+	assert.Equal(t, "1 predmet v škatli", sl.N("items", 1, "škatli"))
+	assert.Equal(t, "102 predmeta v škatli", sl.N("items", 102, "škatli"))
+	assert.Equal(t, "3 predmeti v škatli", sl.N("items", 3, "škatli"))
+	assert.Equal(t, "5 predmetov v škatli", sl.N("items", 5, "škatli"))
+
+	// Plural forms of the default locale are used for untranslated messages.
+	assert.Equal(t, "2 items in box", catalog.Localizer("pt-BR").N("items", 2, "box"))
+}
+
+func TestPluralCategories(t *testing.T) {
+	assert.Equal(t, i18n.PluralOne, i18n.PluralCategory("en", 1))
+	assert.Equal(t, i18n.PluralOther, i18n.PluralCategory("en", 0))
+	assert.Equal(t, i18n.PluralOne, i18n.PluralCategory("fr", 0))
+	assert.Equal(t, i18n.PluralOther, i18n.PluralCategory("ja", 1))
+	assert.Equal(t, i18n.PluralFew, i18n.PluralCategory("ru", 22))
+	assert.Equal(t, i18n.PluralMany, i18n.PluralCategory("ru", 11))
+	assert.Equal(t, i18n.PluralMany, i18n.PluralCategory("pl", 5))
+	assert.Equal(t, i18n.PluralFew, i18n.PluralCategory("cs", 4))
+}
+
+func TestTranslationsAreLoadedFromFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locales")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "de.json"), []byte(`{
+		"hello": "Hallo, %s.",
+		"items": {"one": "%d Ding in %s", "other": "%d Dinge in %s"}
+	}`), 0644)
+	assert.Nil(t, err)
+
+	catalog := newCatalog()
+	err = catalog.LoadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"de", "en", "pt-br", "sl"}, catalog.Locales())
+	de := catalog.Localizer("de-DE")
+	assert.Equal(t, "Hallo, Ana.", de.T("hello", "Ana"))
+	assert.Equal(t, "1 Ding in Kiste", de.N("items", 1, "Kiste"))
+	assert.Equal(t, "3 Dinge in Kiste", de.N("items", 3, "Kiste"))
+}
+
+func TestInvalidTranslationFileIsReported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locales")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "de.json"), []byte(`{"hello": 1}`), 0644)
+	assert.Nil(t, err)
+
+	assert.NotNil(t, newCatalog().LoadDir(dir))
+}
@@ -0,0 +1,69 @@
+package i18n
+
+// Plural categories as defined by the Unicode CLDR.
+const (
+	PluralZero  = "zero"
+	PluralOne   = "one"
+	PluralTwo   = "two"
+	PluralFew   = "few"
+	PluralMany  = "many"
+	PluralOther = "other"
+)
+
+// PluralCategory returns the plural category of the non-negative integer n in
+// the language of the locale. Languages without known rules use the English
+// rule.
+func PluralCategory(locale string, n int) string {
+	switch language(normalizeLocale(locale)) {
+	case "ja", "ko", "zh", "th", "vi", "id", "tr":
+		return PluralOther
+	case "fr", "pt":
+		if n == 0 || n == 1 {
+			return PluralOne
+		}
+	case "sl":
+		switch n % 100 {
+		case 1:
+			return PluralOne
+		case 2:
+			return PluralTwo
+		case 3, 4:
+			return PluralFew
+		}
+	case "hr", "sr", "bs":
+		switch {
+		case n%10 == 1 && n%100 != 11:
+			return PluralOne
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+			return PluralFew
+		}
+	case "ru", "uk":
+		switch {
+		case n%10 == 1 && n%100 != 11:
+			return PluralOne
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+			return PluralFew
+		}
+		return PluralMany
+	case "pl":
+		switch {
+		case n == 1:
+			return PluralOne
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+			return PluralFew
+		}
+		return PluralMany
+	case "cs", "sk":
+		switch {
+		case n == 1:
+			return PluralOne
+		case n >= 2 && n <= 4:
+			return PluralFew
+		}
+	default:
+		if n == 1 {
+			return PluralOne
+		}
+	}
+	return PluralOther
+}
@@ -0,0 +1,68 @@
+package mailer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Extension of the files written by the file mailer.
+const messageExtension = ".eml"
+
+type fileMailer struct {
+	dir  string
+	from string
+	mu   sync.Mutex
+	sent int
+}
+
+// NewFileMailer returns a mailer that writes every message to a new file in
+// the directory instead of sending it, e.g. for development without a mail
+// server. Files are named so that they sort in the order they were written.
+func NewFileMailer(dir, from string) *fileMailer {
+	return &fileMailer{
+		dir:  dir,
+		from: from,
+	}
+}
+
+func (m *fileMailer) Send(message *Message) error {
+	now := time.Now()
+	data, err := Format(m.from, message, now)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent++
+	name := fmt.Sprintf("%s-%06d%s", now.UTC().Format("20060102T150405.000000000"), m.sent, messageExtension)
+	return ioutil.WriteFile(filepath.Join(m.dir, name), data, 0600)
+}
+
+// Messages returns all the messages written to the directory in the order they
+// were written.
+func (m *fileMailer) Messages() ([]*Message, error) {
+	paths, err := filepath.Glob(filepath.Join(m.dir, "*"+messageExtension))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	messages := make([]*Message, 0, len(paths))
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		message, err := ReadMessage(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", path, err)
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
@@ -0,0 +1,94 @@
+// Package mailer sends email messages to users.
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ErrInvalidHeader is returned for messages with line breaks in the headers.
+var ErrInvalidHeader = errors.New("mailer: invalid_header")
+
+// Message is a plain text email message.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends messages.
+type Mailer interface {
+	Send(message *Message) error
+}
+
+// Format returns the message in the Internet Message Format (RFC 5322) with
+// UTF-8 text.
+func Format(from string, message *Message, date time.Time) ([]byte, error) {
+	for _, header := range []string{from, message.To, message.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", message.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", encodeHeader(message.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	body := strings.Replace(message.Body, "\r\n", "\n", -1)
+	b.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return b.Bytes(), nil
+}
+
+// ReadMessage parses a message written by Format.
+func ReadMessage(r io.Reader) (*Message, error) {
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(m.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		To:      m.Header.Get("To"),
+		Subject: decodeHeader(m.Header.Get("Subject")),
+		Body:    strings.Replace(string(body), "\r\n", "\n", -1),
+	}, nil
+}
+
+const (
+	encodedWordPrefix = "=?UTF-8?B?"
+	encodedWordSuffix = "?="
+)
+
+// encodeHeader encodes headers that are not ASCII as specified by RFC 2047.
+func encodeHeader(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return encodedWordPrefix + base64.StdEncoding.EncodeToString([]byte(s)) + encodedWordSuffix
+		}
+	}
+	return s
+}
+
+func decodeHeader(s string) string {
+	if strings.HasPrefix(s, encodedWordPrefix) && strings.HasSuffix(s, encodedWordSuffix) {
+		encoded := s[len(encodedWordPrefix) : len(s)-len(encodedWordSuffix)]
+		if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+			return string(decoded)
+		}
+	}
+	return s
+}
@@ -0,0 +1,59 @@
+package mailer_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-user-management/mailer"
+)
+
+func TestMessageIsFormatted(t *testing.T) {
+	message := &mailer.Message{
+		To:      "user@example.com",
+		Subject: "Bestätigen Sie Ihre E-Mail-Adresse",
+		Body:    "Hello,\nclick the link.\n",
+	}
+	data, err := mailer.Format("noreply@example.com", message, time.Now())
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(data), "From: noreply@example.com\r\n"))
+	assert.True(t, strings.Contains(string(data), "Subject: =?UTF-8?B?"))
+	assert.True(t, strings.HasSuffix(string(data), "\r\n\r\nHello,\r\nclick the link.\r\n"))
+
+	read, err := mailer.ReadMessage(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, message, read)
+}
+
+func TestHeadersWithLineBreaksAreRejected(t *testing.T) {
+	message := &mailer.Message{
+		To:      "user@example.com\r\nBcc: other@example.com",
+		Subject: "Subject",
+	}
+	_, err := mailer.Format("noreply@example.com", message, time.Now())
+	assert.Equal(t, mailer.ErrInvalidHeader, err)
+}
+
+func TestFileMailerWritesMessagesInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mail")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	m := mailer.NewFileMailer(dir, "noreply@example.com")
+	for _, subject := range []string{"first", "second", "third"} {
+		err := m.Send(&mailer.Message{To: "user@example.com", Subject: subject, Body: "Body"})
+		assert.Nil(t, err)
+	}
+	messages, err := m.Messages()
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 3) {
+		assert.Equal(t, "first", messages[0].Subject)
+		assert.Equal(t, "third", messages[2].Subject)
+		assert.Equal(t, "Body", messages[2].Body)
+	}
+}
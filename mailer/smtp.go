@@ -0,0 +1,31 @@
+package mailer
+
+import (
+	"net/smtp"
+	"time"
+)
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer returns a mailer that sends messages from the address through
+// the SMTP server at addr, e.g. "localhost:25". Auth can be nil if the server
+// does not require authentication.
+func NewSMTPMailer(addr, from string, auth smtp.Auth) *smtpMailer {
+	return &smtpMailer{
+		addr: addr,
+		from: from,
+		auth: auth,
+	}
+}
+
+func (m *smtpMailer) Send(message *Message) error {
+	data, err := Format(m.from, message, time.Now())
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{message.To}, data)
+}
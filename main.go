@@ -2,22 +2,147 @@ package main
 
 import (
 	"database/sql"
+	"flag"
 	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/opentarock/service-api/go/proto_oauth2"
+	"github.com/opentarock/service-api/go/proto_password"
+	"github.com/opentarock/service-api/go/proto_session"
 	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-api/go/proto_verification"
+	"github.com/opentarock/service-user-management/events"
+	"github.com/opentarock/service-user-management/i18n"
+	"github.com/opentarock/service-user-management/mailer"
 	"github.com/opentarock/service-user-management/nnservice"
 	"github.com/opentarock/service-user-management/repository"
 	"github.com/opentarock/service-user-management/service"
+	"github.com/opentarock/service-user-management/trace"
 	"github.com/opentarock/service-user-management/util"
 )
 
+const (
+	// Address of the socket publishing domain events.
+	eventsAddress = "tcp://*:6003"
+	// Address of the HTTP/JSON gateway.
+	gatewayAddress = ":6080"
+	// Address of the HTTP server exposing Prometheus metrics on /metrics and
+	// health checks on /healthz and /readyz.
+	metricsAddress = ":6081"
+	// How long in-flight requests are given to finish on shutdown.
+	shutdownTimeout = 10 * time.Second
+)
+
+// Version of the service reported by the reflection message, set at build time
+// with -ldflags "-X main.version <version>".
+var version = "dev"
+
+var (
+	rateLimiterBackend = flag.String("rate-limiter", "memory",
+		"Where rate limits are kept: memory or postgres (shared by all instances)")
+	rateLimitKey = flag.String("rate-limit-key", service.RateLimitKeyClientAddress,
+		"What identifies end users in rate limits: client-address (client id and end user address) or caller (caller header)")
+	rateLimits = service.DefaultRateLimits()
+)
+
+func init() {
+	flag.Var(rateLimits, "rate-limits",
+		"Comma separated list of rate limits as name=rate/burst or name=off, overriding the defaults")
+}
+
+var trustedProxies = flag.String("trusted-proxies", "",
+	"Comma separated list of addresses and networks of reverse proxies whose X-Forwarded-For header is trusted")
+
+var (
+	disposableEmailDomains = flag.String("disposable-email-domains", "",
+		"File with domains of disposable email providers that are rejected at registration, one per line")
+	allowedEmailDomains = flag.String("allowed-email-domains", "",
+		"Comma separated list of the only email domains accepted at registration")
+	deniedEmailDomains = flag.String("denied-email-domains", "",
+		"Comma separated list of email domains rejected at registration")
+)
+
+var (
+	passwordMinLength = flag.Int("password-min-length", 6,
+		"Minimum number of characters of passwords")
+	passwordCharacterClasses = flag.Int("password-character-classes", 0,
+		"Number of character classes (lowercase, uppercase, digits, symbols) passwords must contain")
+	passwordMinStrength = flag.Int("password-min-strength", 0,
+		"Minimum estimated password strength from 0 (too guessable) to 4 (very unguessable)")
+	breachedPasswords = flag.String("breached-passwords", "",
+		"Directory with the breached password list split into files by SHA-1 hash prefix (disabled by default)")
+)
+
+var (
+	lockoutThreshold = flag.Int("lockout-threshold", service.DefaultAccountLockout.Threshold,
+		"Number of failed logins after which the account is locked, 0 to never lock accounts")
+	sourceLockoutThreshold = flag.Int("source-lockout-threshold", service.DefaultSourceLockout.Threshold,
+		"Number of failed logins after which logins from the address are locked, 0 to never lock addresses")
+	lockoutDuration = flag.Duration("lockout-duration", service.DefaultAccountLockout.LockoutDuration,
+		"How long logins are locked after too many failures")
+	lockoutWindow = flag.Duration("lockout-window", service.DefaultAccountLockout.Window,
+		"Time after the last failed login when failures are forgotten")
+)
+
+var (
+	smtpServer = flag.String("smtp-server", "",
+		"Address (host:port) of the SMTP server sending emails, the password is read from the SMTP_PASSWORD environment variable")
+	smtpUsername = flag.String("smtp-username", "",
+		"User name for authenticating to the SMTP server (no authentication by default)")
+	mailDir = flag.String("mail-dir", "",
+		"Directory emails are written to instead of sending them, for development without an SMTP server")
+	mailFrom = flag.String("mail-from", "noreply@localhost",
+		"Sender address of emails")
+	verifyEmailUri = flag.String("verify-email-uri", "",
+		"Page that verifies email addresses with the token query parameter (email addresses are not verified by default)")
+	verificationLifetime = flag.Duration("verification-lifetime", service.DefaultVerificationTokenLifetime,
+		"How long email verification links can be used")
+	requireVerifiedEmail = flag.Bool("require-verified-email", false,
+		"Deny logins of users who did not verify their email address")
+	resetPasswordUri = flag.String("reset-password-uri", "",
+		"Page that sets a new password with the token query parameter (passwords can not be reset by default)")
+	passwordResetLifetime = flag.Duration("password-reset-lifetime", service.DefaultPasswordResetTokenLifetime,
+		"How long password reset links can be used")
+	passwordResetMaxPending = flag.Int("password-reset-max-pending", service.DefaultMaxPendingPasswordResets,
+		"How many unexpired password reset links a user can have (0 is unlimited)")
+)
+
+var defaultClientId = flag.String("default-client", "",
+	"Client whose redirect URIs are accepted at registration when the request does not identify the client")
+
+var locales = flag.String("locales", "",
+	"Directory with translations of messages, one <locale>.json file per locale (English only by default)")
+
+var traceFile = flag.String("trace-file", "",
+	"File the request spans are appended to as OTLP/JSON, - for stdout (disabled by default)")
+
 func main() {
+	flag.Parse()
 	log.SetFlags(log.Ldate | log.Lmicroseconds)
+	if *traceFile == "-" {
+		trace.SetExporter(trace.NewOTLPJSONExporter(os.Stdout, "user-management"))
+	} else if *traceFile != "" {
+		f, err := os.OpenFile(*traceFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatalf("Error opening trace file: %s", err)
+		}
+		defer f.Close()
+		trace.SetExporter(trace.NewOTLPJSONExporter(f, "user-management"))
+	}
 	userService := nnservice.NewRepService("tcp://*:6001")
 	oauth2Service := nnservice.NewRepService("tcp://*:6002")
+	userService.Version = version
+	oauth2Service.Version = version
 
 	db, err := sql.Open("postgres", "user=postgres dbname=users sslmode=disable")
 	if err != nil {
@@ -28,25 +153,314 @@ func main() {
 	userRepository := repository.NewUserRepositoryPostgres(db)
 	clientRepository := repository.NewClientRepositoryPostgres(db)
 	accessTokenRepository := repository.NewAccessTokenRepositoryPostgres(db)
+	outboxRepository := repository.NewOutboxRepositoryPostgres(db)
+	sessionRepository := repository.NewSessionRepositoryPostgres(db)
+	redirectUriRepository := repository.NewRedirectUriRepositoryPostgres(db)
+	loginAttemptRepository := repository.NewLoginAttemptRepositoryPostgres(db)
+	emailVerificationRepository := repository.NewEmailVerificationRepositoryPostgres(db)
+	passwordResetRepository := repository.NewPasswordResetRepositoryPostgres(db)
 
 	tokenGenerator := util.NewRandTokenGenerator()
 
-	userServiceHandlers := service.NewUserServiceHandlers(userRepository)
+	var rateLimiter nnservice.RateLimiter
+	// Buckets of the rate limiter that have to be deleted when refilled.
+	var rateLimitBuckets service.RateLimitBuckets
+	switch *rateLimiterBackend {
+	case "memory":
+		rateLimiter = nnservice.NewMemoryRateLimiter()
+	case "postgres":
+		postgresRateLimiter := repository.NewRateLimiterPostgres(db)
+		rateLimiter, rateLimitBuckets = postgresRateLimiter, postgresRateLimiter
+	default:
+		log.Fatalf("Unknown rate limiter: %s", *rateLimiterBackend)
+	}
+	endUserKey, err := service.EndUserKey(*rateLimitKey)
+	if err != nil {
+		log.Fatalf("Error configuring rate limits: %s", err)
+	}
+	log.Printf("Rate limits per %s: %s", *rateLimitKey, rateLimits)
+
+	databaseHealthCheck := repository.NewDatabaseHealthCheck(db)
+	userService.AddHealthCheck("database", databaseHealthCheck)
+	oauth2Service.AddHealthCheck("database", databaseHealthCheck)
+
+	userService.Use(nnservice.RecoverPanics, nnservice.LogRequests)
+	oauth2Service.Use(nnservice.RecoverPanics, nnservice.LogRequests)
+
+	lockout := loginLockout(loginAttemptRepository)
+	m := newMailer()
+	verifier := emailVerifier(emailVerificationRepository, m, tokenGenerator)
+	jobs := service.NewJobQueue(service.DefaultJobWorkers, service.DefaultJobQueueSize)
+
+	userServiceHandlers := service.NewUserServiceHandlers(userRepository, sessionRepository)
+	userServiceHandlers.Outbox = outboxRepository
+	userServiceHandlers.EmailDomains = emailDomainPolicy()
+	userServiceHandlers.PasswordPolicy = passwordPolicy()
+	userServiceHandlers.Messages = messages()
+	userServiceHandlers.RedirectUris = redirectUriRepository
+	userServiceHandlers.DefaultClientId = *defaultClientId
+	userServiceHandlers.Lockout = lockout
+	userServiceHandlers.Verifier = verifier
+	userServiceHandlers.PasswordResets = passwordResetter(passwordResetRepository, m, tokenGenerator)
+	userServiceHandlers.Jobs = jobs
 	userService.AddHandler(
 		proto_user.RegisterUserMessage,
 		userServiceHandlers.RegisterUserMessageHandler())
 	userService.AddHandler(
 		proto_user.AuthenticateUserMessage,
-		userServiceHandlers.AuthenticateUserMessageHandler(tokenGenerator))
-	go userService.Start()
+		userServiceHandlers.AuthenticateUserMessageHandler(tokenGenerator),
+		rateLimits.Middleware(rateLimiter, service.RateLimitAuthenticate, endUserKey)...)
+	userService.AddHandler(
+		proto_session.ValidateSessionMessage,
+		userServiceHandlers.ValidateSessionHandler())
+	userService.AddHandler(
+		proto_session.TouchSessionMessage,
+		userServiceHandlers.TouchSessionHandler())
+	userService.AddHandler(
+		proto_session.LogoutMessage,
+		userServiceHandlers.LogoutHandler())
+	userService.AddHandler(
+		proto_verification.VerifyEmailMessage,
+		userServiceHandlers.VerifyEmailHandler())
+	userService.AddHandler(
+		proto_verification.ResendVerificationMessage,
+		userServiceHandlers.ResendVerificationHandler(),
+		rateLimits.Middleware(rateLimiter, service.RateLimitResendVerification, service.ResendVerificationKey)...)
+	userService.AddHandler(
+		proto_password.RequestPasswordResetMessage,
+		userServiceHandlers.RequestPasswordResetHandler(),
+		rateLimits.Middleware(rateLimiter, service.RateLimitRequestPasswordReset, service.RequestPasswordResetKey)...)
+	userService.AddHandler(
+		proto_password.ResetPasswordMessage,
+		userServiceHandlers.ResetPasswordHandler(),
+		rateLimits.Middleware(rateLimiter, service.RateLimitResetPassword, endUserKey)...)
 
 	oauth2ServiceHandlers := service.NewOauth2ServiceHandlers(
 		userRepository, clientRepository, accessTokenRepository)
+	oauth2ServiceHandlers.Outbox = outboxRepository
+	oauth2ServiceHandlers.Lockout = lockout
+	oauth2ServiceHandlers.Verifier = verifier
+	accessTokenLimit := rateLimits.Middleware(rateLimiter, service.RateLimitAccessToken, service.AccessTokenKey(endUserKey))
 	oauth2Service.AddHandler(
 		proto_oauth2.AccessTokenAuthenticationMessage,
-		oauth2ServiceHandlers.AccessTokenRequestHandler(tokenGenerator))
+		oauth2ServiceHandlers.AccessTokenRequestHandler(tokenGenerator),
+		accessTokenLimit...)
 	oauth2Service.AddHandler(
 		proto_oauth2.ValidateMessage,
 		oauth2ServiceHandlers.ValidateHandler())
-	oauth2Service.Start()
+
+	proxies, err := nnservice.ParseTrustedProxies(*trustedProxies)
+	if err != nil {
+		log.Fatalf("Error parsing trusted proxies: %s", err)
+	}
+	oauth2ServiceHandlers.TrustedProxies = proxies
+	oauth2ServiceHandlers.TokenEndpointMiddleware = accessTokenLimit
+	gateway := nnservice.NewGateway()
+	gateway.TrustedProxies = proxies
+	service.AddUserRoutes(gateway, userService)
+	service.AddOauth2Routes(gateway, oauth2Service)
+	gateway.Handle("/oauth2/token", oauth2ServiceHandlers.TokenEndpoint(tokenGenerator))
+	gatewayListener, err := net.Listen("tcp", gatewayAddress)
+	if err != nil {
+		log.Fatalf("Error starting gateway: %s", err)
+	}
+	log.Printf("Gateway listening on: %s", gatewayListener.Addr())
+
+	publisher, err := events.NewNanomsgPublisher(eventsAddress)
+	if err != nil {
+		log.Fatalf("Error starting event publisher: %s", err)
+	}
+	defer publisher.Close()
+	relay := events.NewRelay(outboxRepository, publisher)
+	go relay.Start()
+	cleaners := []*service.Cleaner{service.NewSessionCleaner(sessionRepository)}
+	if rateLimitBuckets != nil {
+		cleaners = append(cleaners, service.NewRateLimitCleaner(rateLimitBuckets, rateLimits))
+	}
+	for _, cleaner := range cleaners {
+		go cleaner.Start()
+	}
+
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", promhttp.Handler())
+	metricsMux.Handle("/healthz", nnservice.LivenessHandler(userService, oauth2Service))
+	metricsMux.Handle("/readyz", nnservice.ReadinessHandler(userService, oauth2Service))
+	metricsListener, err := net.Listen("tcp", metricsAddress)
+	if err != nil {
+		log.Fatalf("Error starting metrics server: %s", err)
+	}
+	log.Printf("Metrics listening on: %s", metricsListener.Addr())
+
+	errs := make(chan error, 4)
+	go func() {
+		errs <- userService.Start()
+	}()
+	go func() {
+		errs <- oauth2Service.Start()
+	}()
+	go func() {
+		errs <- http.Serve(gatewayListener, gateway)
+	}()
+	go func() {
+		errs <- http.Serve(metricsListener, metricsMux)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down", sig)
+	case err := <-errs:
+		log.Printf("Service stopped: %s", err)
+	}
+
+	gatewayListener.Close()
+	metricsListener.Close()
+	for _, s := range []*nnservice.RepService{userService, oauth2Service} {
+		if err := s.Stop(shutdownTimeout); err != nil {
+			log.Printf("Error stopping service %s: %s", s.Address, err)
+		}
+	}
+	if err := jobs.Stop(shutdownTimeout); err != nil {
+		log.Printf("Error stopping jobs: %s", err)
+	}
+	relay.Stop()
+	for _, cleaner := range cleaners {
+		cleaner.Stop()
+	}
+}
+
+func emailDomainPolicy() *service.EmailDomainPolicy {
+	var disposable []string
+	if *disposableEmailDomains != "" {
+		var err error
+		disposable, err = service.LoadDomainList(*disposableEmailDomains)
+		if err != nil {
+			log.Fatalf("Error loading disposable email domains: %s", err)
+		}
+	}
+	policy, err := service.NewEmailDomainPolicy(
+		splitList(*allowedEmailDomains), splitList(*deniedEmailDomains), disposable)
+	if err != nil {
+		log.Fatalf("Error configuring email domains: %s", err)
+	}
+	return policy
+}
+
+func passwordPolicy() service.PasswordPolicy {
+	policy := service.PasswordPolicy{
+		service.PasswordLength(*passwordMinLength, service.MaxPasswordLength),
+		service.PasswordWithoutUserData(),
+	}
+	if *passwordCharacterClasses > 0 {
+		policy = append(policy, service.PasswordCharacterClasses(*passwordCharacterClasses))
+	}
+	if *passwordMinStrength > 0 {
+		policy = append(policy, service.PasswordStrength(*passwordMinStrength))
+	}
+	if *breachedPasswords != "" {
+		// Missing prefix files mean that no password with the prefix was
+		// breached, so a wrong directory would accept every password.
+		if info, err := os.Stat(*breachedPasswords); err != nil {
+			log.Fatalf("Error opening breached passwords: %s", err)
+		} else if !info.IsDir() {
+			log.Fatalf("Breached passwords is not a directory: %s", *breachedPasswords)
+		}
+		policy = append(policy, service.BreachedPasswords(*breachedPasswords))
+	}
+	return policy
+}
+
+func loginLockout(attempts repository.LoginAttemptRepository) *service.LoginLockout {
+	lockout := service.NewLoginLockout(attempts)
+	lockout.Account.Threshold = *lockoutThreshold
+	lockout.Account.LockoutDuration = *lockoutDuration
+	lockout.Account.Window = *lockoutWindow
+	lockout.Source.Threshold = *sourceLockoutThreshold
+	lockout.Source.LockoutDuration = *lockoutDuration
+	lockout.Source.Window = *lockoutWindow
+	return lockout
+}
+
+// newMailer returns nil if sending emails is not configured.
+func newMailer() mailer.Mailer {
+	switch {
+	case *mailDir != "":
+		log.Printf("Writing emails to: %s", *mailDir)
+		return mailer.NewFileMailer(*mailDir, *mailFrom)
+	case *smtpServer != "":
+		var auth smtp.Auth
+		if *smtpUsername != "" {
+			host, _, err := net.SplitHostPort(*smtpServer)
+			if err != nil {
+				log.Fatalf("Invalid SMTP server address: %s", err)
+			}
+			auth = smtp.PlainAuth("", *smtpUsername, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		return mailer.NewSMTPMailer(*smtpServer, *mailFrom, auth)
+	}
+	return nil
+}
+
+// emailVerifier returns nil if email addresses are not verified.
+func emailVerifier(
+	verifications repository.EmailVerificationRepository,
+	m mailer.Mailer,
+	tokenGenerator util.TokenGenerator) *service.EmailVerifier {
+
+	if *verifyEmailUri == "" {
+		if *requireVerifiedEmail {
+			log.Fatalf("Verified email addresses can not be required without -verify-email-uri")
+		}
+		return nil
+	}
+	if m == nil {
+		log.Fatalf("Verifying email addresses requires -smtp-server or -mail-dir")
+	}
+	verifier := service.NewEmailVerifier(verifications, m, tokenGenerator)
+	verifier.VerifyUri = *verifyEmailUri
+	verifier.TokenLifetime = *verificationLifetime
+	verifier.Required = *requireVerifiedEmail
+	return verifier
+}
+
+// passwordResetter returns nil if passwords can not be reset.
+func passwordResetter(
+	resets repository.PasswordResetRepository,
+	m mailer.Mailer,
+	tokenGenerator util.TokenGenerator) *service.PasswordResetter {
+
+	if *resetPasswordUri == "" {
+		return nil
+	}
+	if m == nil {
+		log.Fatalf("Resetting passwords requires -smtp-server or -mail-dir")
+	}
+	resetter := service.NewPasswordResetter(resets, m, tokenGenerator)
+	resetter.ResetUri = *resetPasswordUri
+	resetter.TokenLifetime = *passwordResetLifetime
+	resetter.MaxPending = *passwordResetMaxPending
+	return resetter
+}
+
+func messages() *i18n.Catalog {
+	catalog := service.DefaultMessages()
+	if *locales != "" {
+		if err := catalog.LoadDir(*locales); err != nil {
+			log.Fatalf("Error loading translations: %s", err)
+		}
+		log.Printf("Supported locales: %s", strings.Join(catalog.Locales(), ", "))
+	}
+	return catalog
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
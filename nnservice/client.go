@@ -0,0 +1,237 @@
+package nnservice
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/opentarock/service-user-management/util"
+)
+
+const (
+	// DefaultTimeout is the time a call waits for the reply when the client
+	// timeout is not set.
+	DefaultTimeout = 5 * time.Second
+	// Maximum number of idle connections kept open for every endpoint.
+	maxIdleSockets = 8
+	// Length in bytes of generated request ids.
+	requestIdLength = 8
+)
+
+// Client sends requests to services started with RepService. A client can be
+// connected to more endpoints of the same service in which case requests are
+// distributed between them and retried on another endpoint when they fail.
+// Client is safe for concurrent use.
+type Client struct {
+	// Timeout is the default time a call waits for the reply.
+	Timeout time.Duration
+	// Retries is the number of times idempotent calls are retried after a
+	// timeout or retryable error. By default every other endpoint is tried once.
+	Retries int
+	// Headers are sent with every request, e.g. HeaderCaller.
+	Headers map[string]string
+	// LegacyFraming makes the client send legacy frames to services that do
+	// not support versioned frames. Headers are not sent in legacy frames.
+	LegacyFraming bool
+
+	tokenGenerator util.TokenGenerator
+	endpoints      []*clientEndpoint
+	mu             sync.Mutex
+	next           int
+	idempotent     map[int]bool
+}
+
+type clientEndpoint struct {
+	address   string
+	transport Transport
+	idle      chan Conn
+}
+
+func NewClient(endpoints ...string) *Client {
+	client := &Client{
+		Timeout:        DefaultTimeout,
+		Retries:        len(endpoints) - 1,
+		Headers:        make(map[string]string),
+		tokenGenerator: util.NewRandTokenGenerator(),
+		idempotent:     map[int]bool{ReflectionMessage: true},
+	}
+	for _, address := range endpoints {
+		client.endpoints = append(client.endpoints, &clientEndpoint{
+			address:   address,
+			transport: transportFor(address),
+			idle:      make(chan Conn, maxIdleSockets),
+		})
+	}
+	return client
+}
+
+// SetIdempotent marks the message types that are safe to be retried.
+func (c *Client) SetIdempotent(messageIds ...int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, messageId := range messageIds {
+		c.idempotent[messageId] = true
+	}
+}
+
+// Call sends the request and decodes the reply into response. If the service
+// replies with an error reply it is returned as *Error.
+func (c *Client) Call(messageId int, request, response proto.Message) error {
+	return c.CallTimeout(messageId, request, response, c.Timeout)
+}
+
+// CallTimeout is like Call but waits at most timeout for every attempt.
+func (c *Client) CallTimeout(messageId int, request, response proto.Message, timeout time.Duration) error {
+	if len(c.endpoints) == 0 {
+		return errors.New("Client has no endpoints")
+	}
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("Error marshalling %s: %s", messageName(request), err)
+	}
+
+	attempts := 1
+	if c.isIdempotent(messageId) && c.Retries > 0 {
+		attempts += c.Retries
+	}
+	for i := 0; i < attempts; i++ {
+		endpoint := c.nextEndpoint()
+		var replyData []byte
+		replyData, err = c.send(endpoint, messageId, requestData, timeout)
+		if err == nil && IsErrorReply(replyData) {
+			err = decodeError(replyData)
+		}
+		if err == nil {
+			err = proto.Unmarshal(replyData, response)
+			if err != nil {
+				return fmt.Errorf("Error unmarshalling %s: %s", messageName(response), err)
+			}
+			return nil
+		}
+		if !isRetryable(err) {
+			return err
+		}
+		log.Printf("Request to %s failed: %s", endpoint.address, err)
+	}
+	return err
+}
+
+// send sends the request in a new frame and returns the reply message.
+func (c *Client) send(
+	endpoint *clientEndpoint, messageId int, requestData []byte, timeout time.Duration) ([]byte, error) {
+
+	header := &Header{
+		Version:   FrameVersion,
+		MessageId: messageId,
+	}
+	if c.LegacyFraming {
+		header.Version = LegacyFrameVersion
+	} else {
+		requestId, err := c.tokenGenerator.GenerateHex(requestIdLength)
+		if err != nil {
+			return nil, fmt.Errorf("Error generating request id: %s", err)
+		}
+		header.RequestId = requestId
+		for key, value := range c.Headers {
+			header.Set(key, value)
+		}
+		header.SetDeadline(time.Now().Add(timeout))
+	}
+	frame, err := EncodeFrame(header, requestData)
+	if err != nil {
+		return nil, err
+	}
+	replyFrame, err := endpoint.send(frame, timeout)
+	if err != nil || c.LegacyFraming {
+		return replyFrame, err
+	}
+	replyHeader, replyData, err := DecodeFrame(replyFrame)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding reply: %s", err)
+	}
+	if replyHeader.RequestId != "" && replyHeader.RequestId != header.RequestId {
+		return nil, fmt.Errorf("Reply for unexpected request: %s", replyHeader.RequestId)
+	}
+	return replyData, nil
+}
+
+func (c *Client) isIdempotent(messageId int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.idempotent[messageId]
+}
+
+func (c *Client) nextEndpoint() *clientEndpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	endpoint := c.endpoints[c.next]
+	c.next = (c.next + 1) % len(c.endpoints)
+	return endpoint
+}
+
+func decodeError(replyData []byte) error {
+	e, err := DecodeErrorReply(replyData)
+	if err != nil {
+		return fmt.Errorf("Error unmarshalling ErrorReply: %s", err)
+	}
+	return e
+}
+
+func isRetryable(err error) bool {
+	if e, ok := err.(*Error); ok {
+		return e.Retryable
+	}
+	return err == ErrTimeout
+}
+
+// Close closes all the idle connections of the client.
+func (c *Client) Close() {
+	for _, endpoint := range c.endpoints {
+		endpoint.close()
+	}
+}
+
+func (e *clientEndpoint) send(requestData []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := e.conn()
+	if err != nil {
+		return nil, err
+	}
+	replyData, err := conn.Request(requestData, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	e.release(conn)
+	return replyData, nil
+}
+
+func (e *clientEndpoint) conn() (Conn, error) {
+	select {
+	case conn := <-e.idle:
+		return conn, nil
+	default:
+	}
+	return e.transport.Dial(e.address)
+}
+
+func (e *clientEndpoint) release(conn Conn) {
+	select {
+	case e.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (e *clientEndpoint) close() {
+	for {
+		select {
+		case conn := <-e.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
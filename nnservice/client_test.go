@@ -0,0 +1,99 @@
+package nnservice_test
+
+import (
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-user-management/nnservice"
+)
+
+func newEchoRequest(message string) *nnservice.ErrorReply {
+	return &nnservice.ErrorReply{
+		Code:    proto.Uint32(1),
+		Message: proto.String(message),
+	}
+}
+
+func TestClientReceivesReply(t *testing.T) {
+	repService := nnservice.NewRepService("mem://client-reply")
+	repService.AddHandler(1, nnservice.ProtoHandler(newErrorReply,
+		func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+			return request, nil
+		}))
+	go func() {
+		repService.Start()
+	}()
+	defer repService.Close()
+
+	client := nnservice.NewClient("mem://client-reply")
+	defer client.Close()
+	response := &nnservice.ErrorReply{}
+	err := client.Call(1, newEchoRequest("echo"), response)
+	assert.Nil(t, err)
+	assert.Equal(t, "echo", response.GetMessage())
+}
+
+func TestClientReturnsErrorFromErrorReply(t *testing.T) {
+	repService := nnservice.NewRepService("mem://client-error")
+	go func() {
+		repService.Start()
+	}()
+	defer repService.Close()
+
+	client := nnservice.NewClient("mem://client-error")
+	defer client.Close()
+	err := client.Call(1, newEchoRequest("echo"), &nnservice.ErrorReply{})
+	e, ok := err.(*nnservice.Error)
+	assert.True(t, ok)
+	assert.Equal(t, nnservice.ErrorCodeUnknownMessage, e.Code)
+}
+
+func TestIdempotentCallIsRetriedOnAnotherEndpoint(t *testing.T) {
+	repService := nnservice.NewRepService("mem://client-retry")
+	repService.AddHandler(1, nnservice.ProtoHandler(newErrorReply,
+		func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+			return request, nil
+		}))
+	go func() {
+		repService.Start()
+	}()
+	defer repService.Close()
+
+	// Nothing is listening on the first endpoint.
+	client := nnservice.NewClient("mem://client-retry-missing", "mem://client-retry")
+	client.Timeout = 20 * time.Millisecond
+	client.SetIdempotent(1)
+	defer client.Close()
+	err := client.Call(1, newEchoRequest("echo"), &nnservice.ErrorReply{})
+	assert.Nil(t, err)
+}
+
+func TestNonIdempotentCallIsNotRetried(t *testing.T) {
+	client := nnservice.NewClient("mem://client-no-retry-missing", "mem://client-no-retry")
+	client.Timeout = 20 * time.Millisecond
+	defer client.Close()
+	err := client.Call(1, newEchoRequest("echo"), &nnservice.ErrorReply{})
+	assert.Equal(t, nnservice.ErrTimeout, err)
+}
+
+func TestClientWorksOverNanomsgInproc(t *testing.T) {
+	repService := nnservice.NewRepService("inproc://client-inproc")
+	repService.AddHandler(1, nnservice.ProtoHandler(newErrorReply,
+		func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+			return request, nil
+		}))
+	go func() {
+		repService.Start()
+	}()
+	defer repService.Close()
+
+	client := nnservice.NewClient("inproc://client-inproc")
+	defer client.Close()
+	response := &nnservice.ErrorReply{}
+	err := client.Call(1, newEchoRequest("echo"), response)
+	assert.Nil(t, err)
+	assert.Equal(t, "echo", response.GetMessage())
+}
@@ -0,0 +1,157 @@
+package nnservice
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"code.google.com/p/gogoprotobuf/proto"
+)
+
+// errorReplyMarker is the first byte of every error reply. Encoded protobuf
+// messages never start with a zero byte because zero is not a valid field
+// number, so error replies can always be told apart from regular replies.
+const errorReplyMarker = 0
+
+type ErrorCode uint32
+
+const (
+	// Handler failed because of an internal error (e.g. database is not reachable).
+	ErrorCodeInternal ErrorCode = iota + 1
+	// Received message was empty.
+	ErrorCodeEmptyMessage
+	// There is no handler registered for the message type.
+	ErrorCodeUnknownMessage
+	// Message could not be decoded.
+	ErrorCodeMalformedRequest
+	// Frame version is not supported by the service.
+	ErrorCodeUnsupportedVersion
+	// Request deadline passed before the request was handled.
+	ErrorCodeDeadlineExceeded
+	// Caller sent too many requests of the message type.
+	ErrorCodeRateLimited
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ErrorCodeInternal:           "internal",
+	ErrorCodeEmptyMessage:       "empty_message",
+	ErrorCodeUnknownMessage:     "unknown_message",
+	ErrorCodeMalformedRequest:   "malformed_request",
+	ErrorCodeUnsupportedVersion: "unsupported_version",
+	ErrorCodeDeadlineExceeded:   "deadline_exceeded",
+	ErrorCodeRateLimited:        "rate_limited",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("error_%d", uint32(c))
+}
+
+// Error is returned by message handlers to signal that the request failed. It
+// is sent back to the requester as an error reply.
+type Error struct {
+	Code      ErrorCode
+	Message   string
+	Retryable bool
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("nnservice: error %d: %s", e.Code, e.Message)
+}
+
+func NewInternalError(message string) *Error {
+	return &Error{
+		Code:      ErrorCodeInternal,
+		Message:   message,
+		Retryable: true,
+	}
+}
+
+func NewMalformedRequestError(message string) *Error {
+	return &Error{
+		Code:    ErrorCodeMalformedRequest,
+		Message: message,
+	}
+}
+
+// ErrorReply is the protobuf message of an error reply.
+type ErrorReply struct {
+	Code             *uint32 `protobuf:"varint,1,req,name=code" json:"code,omitempty"`
+	Message          *string `protobuf:"bytes,2,opt,name=message" json:"message,omitempty"`
+	Retryable        *bool   `protobuf:"varint,3,opt,name=retryable" json:"retryable,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *ErrorReply) Reset()         { *m = ErrorReply{} }
+func (m *ErrorReply) String() string { return proto.CompactTextString(m) }
+func (*ErrorReply) ProtoMessage()    {}
+
+func (m *ErrorReply) GetCode() uint32 {
+	if m != nil && m.Code != nil {
+		return *m.Code
+	}
+	return 0
+}
+
+func (m *ErrorReply) GetMessage() string {
+	if m != nil && m.Message != nil {
+		return *m.Message
+	}
+	return ""
+}
+
+func (m *ErrorReply) GetRetryable() bool {
+	if m != nil && m.Retryable != nil {
+		return *m.Retryable
+	}
+	return false
+}
+
+// internalErrorMessage is the message of internal errors that are not of type
+// *Error, which can contain details of the service, e.g. database errors.
+const internalErrorMessage = "Internal error"
+
+// EncodeErrorReply encodes the error as an error reply. Errors that are not of
+// type *Error are sent as retryable internal errors with a generic message,
+// so they have to be logged by the caller.
+func EncodeErrorReply(err error) []byte {
+	e, ok := err.(*Error)
+	if !ok {
+		e = NewInternalError(internalErrorMessage)
+	}
+	reply := &ErrorReply{
+		Code:      proto.Uint32(uint32(e.Code)),
+		Message:   proto.String(e.Message),
+		Retryable: proto.Bool(e.Retryable),
+	}
+	replyData, err := proto.Marshal(reply)
+	if err != nil {
+		log.Printf("Error marshalling ErrorReply: %s", err)
+		return []byte{errorReplyMarker}
+	}
+	return append([]byte{errorReplyMarker}, replyData...)
+}
+
+// IsErrorReply reports whether the reply data is an error reply.
+func IsErrorReply(data []byte) bool {
+	return len(data) > 0 && data[0] == errorReplyMarker
+}
+
+// DecodeErrorReply decodes an error reply into an *Error.
+func DecodeErrorReply(data []byte) (*Error, error) {
+	if !IsErrorReply(data) {
+		return nil, errors.New("Not an error reply")
+	}
+	reply := &ErrorReply{}
+	err := proto.Unmarshal(data[1:], reply)
+	if err != nil {
+		return nil, err
+	}
+	return &Error{
+		Code:      ErrorCode(reply.GetCode()),
+		Message:   reply.GetMessage(),
+		Retryable: reply.GetRetryable(),
+	}, nil
+}
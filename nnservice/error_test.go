@@ -0,0 +1,34 @@
+package nnservice_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-user-management/nnservice"
+)
+
+func TestErrorReplyIsDecoded(t *testing.T) {
+	replyData := nnservice.EncodeErrorReply(nnservice.NewMalformedRequestError("bad"))
+	assert.True(t, nnservice.IsErrorReply(replyData))
+	e, err := nnservice.DecodeErrorReply(replyData)
+	assert.Nil(t, err)
+	assert.Equal(t, nnservice.ErrorCodeMalformedRequest, e.Code)
+	assert.Equal(t, "bad", e.Message)
+	assert.False(t, e.Retryable)
+}
+
+func TestOtherErrorsAreSentAsRetryableInternalErrors(t *testing.T) {
+	replyData := nnservice.EncodeErrorReply(errors.New("db down"))
+	e, err := nnservice.DecodeErrorReply(replyData)
+	assert.Nil(t, err)
+	assert.Equal(t, nnservice.ErrorCodeInternal, e.Code)
+	assert.Equal(t, "Internal error", e.Message, "details of the error are not sent")
+	assert.True(t, e.Retryable)
+}
+
+func TestRegularReplyIsNotErrorReply(t *testing.T) {
+	assert.False(t, nnservice.IsErrorReply([]byte{}))
+	assert.False(t, nnservice.IsErrorReply([]byte{0x08, 0x01}))
+}
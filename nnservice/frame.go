@@ -0,0 +1,223 @@
+package nnservice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/opentarock/service-user-management/trace"
+)
+
+// Requests come in two formats. Legacy frames consist of a single byte with the
+// message type followed by the message:
+//
+//	[message type][message]
+//
+// Versioned frames start with a zero byte, which is never used as a legacy
+// message type, followed by the frame version, the length of the encoded
+// FrameHeader as an unsigned varint, the header and the message:
+//
+//	[0][version][header length][FrameHeader][message]
+//
+// Replies to versioned frames are versioned frames with the same message type
+// and request id, replies to legacy frames contain only the reply message.
+const (
+	frameMarker = 0
+	// FrameVersion is the version of versioned frames that are sent.
+	FrameVersion = 1
+	// LegacyFrameVersion is the version of the header of legacy frames.
+	LegacyFrameVersion = 0
+)
+
+// Well known header keys.
+const (
+	// Id of the trace the request is part of, 32 hex digits.
+	HeaderTraceId = "trace-id"
+	// Time after which the reply is not needed anymore, in milliseconds since epoch.
+	HeaderDeadline = "deadline"
+	// Identity of the service that sent the request.
+	HeaderCaller = "caller"
+	// Address of the end user the request is made for, set by a trusted
+	// gateway or frontend, if known.
+	HeaderClientAddress = "client-address"
+	// User agent of the end user the request is made for, if known.
+	HeaderUserAgent = "user-agent"
+	// Languages preferred by the end user in the format of the HTTP
+	// Accept-Language header, if known.
+	HeaderAcceptLanguage = "accept-language"
+	// Id of the OAuth2 client, e.g. a frontend application, the request is
+	// made through.
+	HeaderClientId = "client-id"
+)
+
+// Header holds the metadata of a request.
+type Header struct {
+	Version   int
+	MessageId int
+	RequestId string
+	Headers   map[string]string
+	// Span traces the handling of the request. It is set by RepService.Dispatch
+	// and is not sent in frames.
+	Span *trace.Span
+}
+
+func (h *Header) Get(key string) string {
+	return h.Headers[key]
+}
+
+func (h *Header) Set(key, value string) {
+	if h.Headers == nil {
+		h.Headers = make(map[string]string)
+	}
+	h.Headers[key] = value
+}
+
+// Deadline returns the request deadline if it is set.
+func (h *Header) Deadline() (time.Time, bool) {
+	millis, err := strconv.ParseInt(h.Get(HeaderDeadline), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, millis*int64(time.Millisecond)), true
+}
+
+func (h *Header) SetDeadline(deadline time.Time) {
+	h.Set(HeaderDeadline, strconv.FormatInt(deadline.UnixNano()/int64(time.Millisecond), 10))
+}
+
+// FrameHeader is the protobuf message of the header of versioned frames.
+type FrameHeader struct {
+	MessageId        *uint32              `protobuf:"varint,1,req,name=message_id" json:"message_id,omitempty"`
+	RequestId        *string              `protobuf:"bytes,2,opt,name=request_id" json:"request_id,omitempty"`
+	Headers          []*FrameHeader_Entry `protobuf:"bytes,3,rep,name=headers" json:"headers,omitempty"`
+	XXX_unrecognized []byte               `json:"-"`
+}
+
+func (m *FrameHeader) Reset()         { *m = FrameHeader{} }
+func (m *FrameHeader) String() string { return proto.CompactTextString(m) }
+func (*FrameHeader) ProtoMessage()    {}
+
+func (m *FrameHeader) GetMessageId() uint32 {
+	if m != nil && m.MessageId != nil {
+		return *m.MessageId
+	}
+	return 0
+}
+
+func (m *FrameHeader) GetRequestId() string {
+	if m != nil && m.RequestId != nil {
+		return *m.RequestId
+	}
+	return ""
+}
+
+func (m *FrameHeader) GetHeaders() []*FrameHeader_Entry {
+	if m != nil {
+		return m.Headers
+	}
+	return nil
+}
+
+type FrameHeader_Entry struct {
+	Key              *string `protobuf:"bytes,1,req,name=key" json:"key,omitempty"`
+	Value            *string `protobuf:"bytes,2,req,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *FrameHeader_Entry) Reset()         { *m = FrameHeader_Entry{} }
+func (m *FrameHeader_Entry) String() string { return proto.CompactTextString(m) }
+func (*FrameHeader_Entry) ProtoMessage()    {}
+
+func (m *FrameHeader_Entry) GetKey() string {
+	if m != nil && m.Key != nil {
+		return *m.Key
+	}
+	return ""
+}
+
+func (m *FrameHeader_Entry) GetValue() string {
+	if m != nil && m.Value != nil {
+		return *m.Value
+	}
+	return ""
+}
+
+// EncodeFrame encodes the header and the message into a frame. Legacy frame is
+// produced if the header version is LegacyFrameVersion.
+func EncodeFrame(header *Header, data []byte) ([]byte, error) {
+	if header.Version == LegacyFrameVersion {
+		if header.MessageId < 1 || header.MessageId > 255 {
+			return nil, fmt.Errorf("Message type can not be sent in legacy frame: %d", header.MessageId)
+		}
+		return append([]byte{byte(header.MessageId)}, data...), nil
+	}
+	if header.MessageId < 0 || int64(header.MessageId) > int64(^uint32(0)) {
+		return nil, fmt.Errorf("Message type out of range: %d", header.MessageId)
+	}
+	frameHeader := &FrameHeader{
+		MessageId: proto.Uint32(uint32(header.MessageId)),
+	}
+	if header.RequestId != "" {
+		frameHeader.RequestId = proto.String(header.RequestId)
+	}
+	for key, value := range header.Headers {
+		frameHeader.Headers = append(frameHeader.Headers, &FrameHeader_Entry{
+			Key:   proto.String(key),
+			Value: proto.String(value),
+		})
+	}
+	headerData, err := proto.Marshal(frameHeader)
+	if err != nil {
+		return nil, fmt.Errorf("Error marshalling FrameHeader: %s", err)
+	}
+	frame := make([]byte, 2+binary.MaxVarintLen64, 2+binary.MaxVarintLen64+len(headerData)+len(data))
+	frame[0] = frameMarker
+	frame[1] = byte(header.Version)
+	n := binary.PutUvarint(frame[2:], uint64(len(headerData)))
+	frame = append(frame[:2+n], headerData...)
+	return append(frame, data...), nil
+}
+
+// DecodeFrame decodes the frame into the header and the message. The returned
+// header is never nil so the reply can be sent in the same format even if the
+// frame could not be decoded.
+func DecodeFrame(frame []byte) (*Header, []byte, error) {
+	if len(frame) < 1 {
+		return &Header{}, nil, &Error{
+			Code:    ErrorCodeEmptyMessage,
+			Message: "Empty message",
+		}
+	}
+	if frame[0] != frameMarker {
+		return &Header{MessageId: int(frame[0])}, frame[1:], nil
+	}
+	header := &Header{Version: FrameVersion}
+	if len(frame) < 2 {
+		return header, nil, NewMalformedRequestError("Missing frame version")
+	}
+	if frame[1] != FrameVersion {
+		return header, nil, &Error{
+			Code:    ErrorCodeUnsupportedVersion,
+			Message: fmt.Sprintf("Unsupported frame version: %d", frame[1]),
+		}
+	}
+	headerLength, n := binary.Uvarint(frame[2:])
+	if n <= 0 || headerLength > uint64(len(frame)-2-n) {
+		return header, nil, NewMalformedRequestError("Invalid frame header length")
+	}
+	headerEnd := 2 + n + int(headerLength)
+	frameHeader := &FrameHeader{}
+	err := proto.Unmarshal(frame[2+n:headerEnd], frameHeader)
+	if err != nil {
+		return header, nil, NewMalformedRequestError(
+			fmt.Sprintf("Error unmarshalling FrameHeader: %s", err))
+	}
+	header.MessageId = int(frameHeader.GetMessageId())
+	header.RequestId = frameHeader.GetRequestId()
+	for _, entry := range frameHeader.GetHeaders() {
+		header.Set(entry.GetKey(), entry.GetValue())
+	}
+	return header, frame[headerEnd:], nil
+}
@@ -0,0 +1,70 @@
+package nnservice_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-user-management/nnservice"
+)
+
+func TestVersionedFrameIsDecoded(t *testing.T) {
+	header := &nnservice.Header{
+		Version:   nnservice.FrameVersion,
+		MessageId: 70000,
+		RequestId: "request",
+	}
+	header.Set(nnservice.HeaderCaller, "lobby")
+	frame, err := nnservice.EncodeFrame(header, []byte{1, 2, 3})
+	assert.Nil(t, err)
+
+	decodedHeader, data, err := nnservice.DecodeFrame(frame)
+	assert.Nil(t, err)
+	assert.Equal(t, header, decodedHeader)
+	assert.Equal(t, []byte{1, 2, 3}, data)
+}
+
+func TestLegacyFrameIsDecoded(t *testing.T) {
+	header, data, err := nnservice.DecodeFrame([]byte{5, 1, 2})
+	assert.Nil(t, err)
+	assert.Equal(t, nnservice.LegacyFrameVersion, header.Version)
+	assert.Equal(t, 5, header.MessageId)
+	assert.Equal(t, []byte{1, 2}, data)
+}
+
+func TestLegacyFrameIsEncoded(t *testing.T) {
+	frame, err := nnservice.EncodeFrame(&nnservice.Header{MessageId: 5}, []byte{1})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{5, 1}, frame)
+
+	_, err = nnservice.EncodeFrame(&nnservice.Header{MessageId: 256}, []byte{1})
+	assert.NotNil(t, err)
+}
+
+func TestUnsupportedFrameVersionIsRejected(t *testing.T) {
+	header, _, err := nnservice.DecodeFrame([]byte{0, 99, 0})
+	assert.Equal(t, nnservice.FrameVersion, header.Version)
+	e, ok := err.(*nnservice.Error)
+	assert.True(t, ok)
+	assert.Equal(t, nnservice.ErrorCodeUnsupportedVersion, e.Code)
+}
+
+func TestTruncatedFrameIsRejected(t *testing.T) {
+	_, _, err := nnservice.DecodeFrame([]byte{0, nnservice.FrameVersion, 10, 1})
+	e, ok := err.(*nnservice.Error)
+	assert.True(t, ok)
+	assert.Equal(t, nnservice.ErrorCodeMalformedRequest, e.Code)
+}
+
+func TestHeaderDeadline(t *testing.T) {
+	header := &nnservice.Header{}
+	_, ok := header.Deadline()
+	assert.False(t, ok)
+
+	deadline := time.Unix(1408000000, 123000000)
+	header.SetDeadline(deadline)
+	decoded, ok := header.Deadline()
+	assert.True(t, ok)
+	assert.True(t, deadline.Equal(decoded))
+}
@@ -0,0 +1,192 @@
+package nnservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/opentarock/service-user-management/trace"
+)
+
+// Maximum size of the request body accepted by the gateway.
+const maxGatewayRequestSize = 1 << 20
+
+// Gateway exposes message handlers of services as HTTP endpoints. Requests and
+// replies are protobuf messages encoded as JSON using the json field tags of
+// the generated messages. Requests are passed to RepService.Dispatch so they
+// are handled exactly like requests received by the service itself.
+type Gateway struct {
+	// TrustedProxies are used to find the address of the end user when the
+	// gateway is behind reverse proxies.
+	TrustedProxies TrustedProxies
+	mux            *http.ServeMux
+}
+
+func NewGateway() *Gateway {
+	return &Gateway{
+		mux: http.NewServeMux(),
+	}
+}
+
+// AddRoute exposes the handler for the message type of the service on the path.
+// Request is decoded into the message returned by newRequest and the reply
+// into the message returned by newResponse.
+func (g *Gateway) AddRoute(
+	path string,
+	service *RepService,
+	messageId int,
+	newRequest, newResponse func() proto.Message) {
+
+	log.Printf("Adding gateway route %s for: %d", path, messageId)
+	g.mux.Handle(path, &gatewayRoute{
+		gateway:     g,
+		service:     service,
+		messageId:   messageId,
+		newRequest:  newRequest,
+		newResponse: newResponse,
+	})
+}
+
+// Handle registers a plain HTTP handler on the gateway.
+func (g *Gateway) Handle(path string, handler http.Handler) {
+	g.mux.Handle(path, handler)
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mux.ServeHTTP(w, r)
+}
+
+type gatewayRoute struct {
+	gateway     *Gateway
+	service     *RepService
+	messageId   int
+	newRequest  func() proto.Message
+	newResponse func() proto.Message
+}
+
+// gatewayError is the JSON body of failed gateway requests.
+type gatewayError struct {
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message"`
+	Retryable bool      `json:"retryable"`
+}
+
+func (route *gatewayRoute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	span := trace.NewSpan("", r.Header.Get("X-Request-Id"), r.Method+" "+r.URL.Path)
+	defer span.Finish()
+	w.Header().Set("X-Request-Id", span.RequestId)
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeGatewayError(w, http.StatusMethodNotAllowed, &Error{
+			Code:    ErrorCodeMalformedRequest,
+			Message: fmt.Sprintf("Method not allowed: %s", r.Method),
+		})
+		return
+	}
+	requestData, err := route.decodeRequest(w, r)
+	if err != nil {
+		writeGatewayError(w, http.StatusBadRequest, NewMalformedRequestError(err.Error()))
+		return
+	}
+
+	header := &Header{
+		Version:   FrameVersion,
+		MessageId: route.messageId,
+		RequestId: span.RequestId,
+		Span:      span,
+	}
+	// Callers are identified by their address, e.g. for rate limiting.
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		header.Set(HeaderCaller, host)
+	}
+	if address := route.gateway.TrustedProxies.ClientAddress(r); address != "" {
+		header.Set(HeaderClientAddress, address)
+	}
+	if userAgent := r.Header.Get("User-Agent"); userAgent != "" {
+		header.Set(HeaderUserAgent, userAgent)
+	}
+	if acceptLanguage := r.Header.Get("Accept-Language"); acceptLanguage != "" {
+		header.Set(HeaderAcceptLanguage, acceptLanguage)
+	}
+	if clientId := r.Header.Get("X-Client-Id"); clientId != "" {
+		header.Set(HeaderClientId, clientId)
+	}
+	replyData := route.service.Dispatch(header, requestData)
+	if IsErrorReply(replyData) {
+		e, err := DecodeErrorReply(replyData)
+		if err != nil {
+			span.Logf("Error decoding error reply: %s", err)
+			e = NewInternalError(internalErrorMessage)
+		}
+		writeGatewayError(w, gatewayStatus(e), e)
+		return
+	}
+
+	response := route.newResponse()
+	err = proto.Unmarshal(replyData, response)
+	if err != nil {
+		span.Logf("Error unmarshalling %s: %s", messageName(response), err)
+		writeGatewayError(w, http.StatusInternalServerError, NewInternalError("Invalid reply"))
+		return
+	}
+	writeJson(w, http.StatusOK, response)
+}
+
+// decodeRequest decodes the JSON body and encodes it as a protobuf message.
+func (route *gatewayRoute) decodeRequest(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxGatewayRequestSize))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading request: %s", err)
+	}
+	request := route.newRequest()
+	err = json.Unmarshal(body, request)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding %s: %s", messageName(request), err)
+	}
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", messageName(request), err)
+	}
+	return requestData, nil
+}
+
+func gatewayStatus(e *Error) int {
+	switch e.Code {
+	case ErrorCodeMalformedRequest, ErrorCodeEmptyMessage, ErrorCodeUnsupportedVersion:
+		return http.StatusBadRequest
+	case ErrorCodeUnknownMessage:
+		return http.StatusNotFound
+	case ErrorCodeDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case ErrorCodeRateLimited:
+		return http.StatusTooManyRequests
+	}
+	if e.Retryable {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func writeGatewayError(w http.ResponseWriter, status int, e *Error) {
+	writeJson(w, status, &gatewayError{
+		Code:      e.Code,
+		Message:   e.Message,
+		Retryable: e.Retryable,
+	})
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("Error encoding JSON response: %s", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,113 @@
+package nnservice_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-user-management/nnservice"
+)
+
+func newGateway() *nnservice.Gateway {
+	repService := nnservice.NewRepService("mem://gateway")
+	repService.AddHandler(1, nnservice.ProtoHandler(newErrorReply,
+		func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+			reply := request.(*nnservice.ErrorReply)
+			reply.Message = proto.String(reply.GetMessage() + " reply")
+			return reply, nil
+		}))
+	repService.AddHandler(2, nnservice.MessageHandlerFunc(
+		func(header *nnservice.Header, data []byte) ([]byte, error) {
+			return nil, nnservice.NewInternalError("failed")
+		}))
+	gateway := nnservice.NewGateway()
+	gateway.AddRoute("/echo", repService, 1, newErrorReply, newErrorReply)
+	gateway.AddRoute("/fail", repService, 2, newErrorReply, newErrorReply)
+	gateway.AddRoute("/unknown", repService, 3, newErrorReply, newErrorReply)
+	return gateway
+}
+
+func post(gateway *nnservice.Gateway, path, body string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest("POST", path, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	gateway.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func decodeGatewayError(t *testing.T, recorder *httptest.ResponseRecorder) map[string]interface{} {
+	var body map[string]interface{}
+	err := json.Unmarshal(recorder.Body.Bytes(), &body)
+	assert.Nil(t, err)
+	return body
+}
+
+func TestGatewayPassesJsonRequestToHandler(t *testing.T) {
+	recorder := post(newGateway(), "/echo", `{"code": 1, "message": "request"}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json; charset=utf-8", recorder.Header().Get("Content-Type"))
+
+	reply := &nnservice.ErrorReply{}
+	err := json.Unmarshal(recorder.Body.Bytes(), reply)
+	assert.Nil(t, err)
+	assert.Equal(t, "request reply", reply.GetMessage())
+}
+
+func TestGatewayRejectsInvalidJson(t *testing.T) {
+	recorder := post(newGateway(), "/echo", `{"code": `)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	body := decodeGatewayError(t, recorder)
+	assert.EqualValues(t, nnservice.ErrorCodeMalformedRequest, body["code"])
+}
+
+func TestGatewayRejectsRequestWithMissingRequiredFields(t *testing.T) {
+	recorder := post(newGateway(), "/echo", `{"message": "request"}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestGatewayOnlyAcceptsPost(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/echo", nil)
+	recorder := httptest.NewRecorder()
+	newGateway().ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	assert.Equal(t, "POST", recorder.Header().Get("Allow"))
+}
+
+func TestGatewayReturnsHandlerErrors(t *testing.T) {
+	recorder := post(newGateway(), "/fail", `{"code": 1}`)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	body := decodeGatewayError(t, recorder)
+	assert.EqualValues(t, nnservice.ErrorCodeInternal, body["code"])
+	assert.Equal(t, "failed", body["message"])
+	assert.Equal(t, true, body["retryable"])
+}
+
+func TestGatewayReturnsNotFoundForUnknownMessage(t *testing.T) {
+	recorder := post(newGateway(), "/unknown", `{"code": 1}`)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestGatewayPassesClientAddress(t *testing.T) {
+	var address string
+	repService := nnservice.NewRepService("mem://gateway-address")
+	repService.AddHandler(1, nnservice.ProtoHandler(newErrorReply,
+		func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+			address = header.Get(nnservice.HeaderClientAddress)
+			return request, nil
+		}))
+	gateway := nnservice.NewGateway()
+	gateway.TrustedProxies, _ = nnservice.ParseTrustedProxies("10.0.0.1")
+	gateway.AddRoute("/echo", repService, 1, newErrorReply, newErrorReply)
+
+	request, _ := http.NewRequest("POST", "/echo", strings.NewReader(`{"code": 1}`))
+	request.RemoteAddr = "10.0.0.1:4321"
+	request.Header.Set("X-Forwarded-For", "198.51.100.1")
+	recorder := httptest.NewRecorder()
+	gateway.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "198.51.100.1", address)
+}
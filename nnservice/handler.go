@@ -1,11 +1,14 @@
 package nnservice
 
+// MessageHandler handles a request and returns the reply data. If the request
+// fails an error is returned instead and sent to the requester as an error
+// reply, see Error.
 type MessageHandler interface {
-	HandleMessage(data []byte) []byte
+	HandleMessage(header *Header, data []byte) ([]byte, error)
 }
 
-type MessageHandlerFunc func(data []byte) []byte
+type MessageHandlerFunc func(header *Header, data []byte) ([]byte, error)
 
-func (f MessageHandlerFunc) HandleMessage(data []byte) []byte {
-	return f(data)
+func (f MessageHandlerFunc) HandleMessage(header *Header, data []byte) ([]byte, error) {
+	return f(header, data)
 }
@@ -0,0 +1,229 @@
+package nnservice
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+)
+
+// HealthMessage is the message type reserved on every service for health
+// checks. The request is empty and the reply is a HealthResponse.
+const HealthMessage = 255
+
+// DefaultHealthCheckInterval is used when RepService.HealthCheckInterval is
+// not set.
+const DefaultHealthCheckInterval = 5 * time.Second
+
+// Detail reported for failed checks. The error itself is only logged, because
+// health checks can be requested by anyone who can reach the service.
+const unhealthyDetail = "unavailable"
+
+// HealthCheck checks a component the service depends on (e.g. the database).
+type HealthCheck interface {
+	// Check returns the details about the component or an error if it is not
+	// healthy.
+	Check() (string, error)
+}
+
+type HealthCheckFunc func() (string, error)
+
+func (f HealthCheckFunc) Check() (string, error) {
+	return f()
+}
+
+type namedHealthCheck struct {
+	name  string
+	check HealthCheck
+}
+
+// HealthResponse is the reply to the health check message.
+type HealthResponse struct {
+	Service          *string                 `protobuf:"bytes,1,req,name=service" json:"service,omitempty"`
+	Bound            *bool                   `protobuf:"varint,2,req,name=bound" json:"bound,omitempty"`
+	Healthy          *bool                   `protobuf:"varint,3,req,name=healthy" json:"healthy,omitempty"`
+	Checks           []*HealthResponse_Check `protobuf:"bytes,4,rep,name=checks" json:"checks,omitempty"`
+	XXX_unrecognized []byte                  `json:"-"`
+}
+
+func (m *HealthResponse) Reset()         { *m = HealthResponse{} }
+func (m *HealthResponse) String() string { return proto.CompactTextString(m) }
+func (*HealthResponse) ProtoMessage()    {}
+
+func (m *HealthResponse) GetService() string {
+	if m != nil && m.Service != nil {
+		return *m.Service
+	}
+	return ""
+}
+
+func (m *HealthResponse) GetBound() bool {
+	if m != nil && m.Bound != nil {
+		return *m.Bound
+	}
+	return false
+}
+
+func (m *HealthResponse) GetHealthy() bool {
+	if m != nil && m.Healthy != nil {
+		return *m.Healthy
+	}
+	return false
+}
+
+func (m *HealthResponse) GetChecks() []*HealthResponse_Check {
+	if m != nil {
+		return m.Checks
+	}
+	return nil
+}
+
+type HealthResponse_Check struct {
+	Name             *string `protobuf:"bytes,1,req,name=name" json:"name,omitempty"`
+	Healthy          *bool   `protobuf:"varint,2,req,name=healthy" json:"healthy,omitempty"`
+	Detail           *string `protobuf:"bytes,3,opt,name=detail" json:"detail,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *HealthResponse_Check) Reset()         { *m = HealthResponse_Check{} }
+func (m *HealthResponse_Check) String() string { return proto.CompactTextString(m) }
+func (*HealthResponse_Check) ProtoMessage()    {}
+
+func (m *HealthResponse_Check) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *HealthResponse_Check) GetHealthy() bool {
+	if m != nil && m.Healthy != nil {
+		return *m.Healthy
+	}
+	return false
+}
+
+func (m *HealthResponse_Check) GetDetail() string {
+	if m != nil && m.Detail != nil {
+		return *m.Detail
+	}
+	return ""
+}
+
+// AddHealthCheck adds a check that is run on health check requests. It must
+// be called before the service handles the first request.
+func (s *RepService) AddHealthCheck(name string, check HealthCheck) {
+	s.healthChecks = append(s.healthChecks, namedHealthCheck{name, check})
+}
+
+// Bound reports whether the service is listening on its address.
+func (s *RepService) Bound() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listener != nil && !s.isStopping()
+}
+
+// Health runs the health checks. Service is healthy if it is bound and all
+// the checks passed. Results of the checks are reused for
+// HealthCheckInterval, so that frequent requests do not load the components.
+func (s *RepService) Health() *HealthResponse {
+	bound := s.Bound()
+	checks, healthy := s.runHealthChecks()
+	return &HealthResponse{
+		Service: proto.String(s.Address),
+		Bound:   proto.Bool(bound),
+		Healthy: proto.Bool(bound && healthy),
+		Checks:  checks,
+	}
+}
+
+func (s *RepService) runHealthChecks() ([]*HealthResponse_Check, bool) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	interval := s.HealthCheckInterval
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	if s.healthResults != nil && time.Since(s.healthCheckedAt) < interval {
+		return s.healthResults, s.healthPassed
+	}
+
+	healthy := true
+	checks := make([]*HealthResponse_Check, 0, len(s.healthChecks))
+	for _, c := range s.healthChecks {
+		detail, err := c.check.Check()
+		if err != nil {
+			log.Printf("Health check %s failed: %s", c.name, err)
+			detail = unhealthyDetail
+			healthy = false
+		}
+		checks = append(checks, &HealthResponse_Check{
+			Name:    proto.String(c.name),
+			Healthy: proto.Bool(err == nil),
+			Detail:  proto.String(detail),
+		})
+	}
+	s.healthResults = checks
+	s.healthPassed = healthy
+	s.healthCheckedAt = time.Now()
+	return checks, healthy
+}
+
+func (s *RepService) healthHandler() MessageHandler {
+	return MessageHandlerFunc(func(header *Header, data []byte) ([]byte, error) {
+		return proto.Marshal(s.Health())
+	})
+}
+
+// healthReport is the JSON body of the HTTP health endpoints.
+type healthReport struct {
+	Healthy  bool              `json:"healthy"`
+	Services []*HealthResponse `json:"services"`
+}
+
+// LivenessHandler reports whether the services are bound to their addresses.
+// It always responds with 200 OK while the process is able to handle requests,
+// except when one of the services failed.
+func LivenessHandler(services ...*RepService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := &healthReport{Healthy: true}
+		for _, s := range services {
+			failed := s.failure() != nil
+			if failed {
+				report.Healthy = false
+			}
+			report.Services = append(report.Services, &HealthResponse{
+				Service: proto.String(s.Address),
+				Bound:   proto.Bool(s.Bound()),
+				Healthy: proto.Bool(!failed),
+			})
+		}
+		writeHealthReport(w, report)
+	})
+}
+
+// ReadinessHandler runs health checks of the services and responds with 200 OK
+// only if all the services are healthy.
+func ReadinessHandler(services ...*RepService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := &healthReport{Healthy: true}
+		for _, s := range services {
+			health := s.Health()
+			if !health.GetHealthy() {
+				report.Healthy = false
+			}
+			report.Services = append(report.Services, health)
+		}
+		writeHealthReport(w, report)
+	})
+}
+
+func writeHealthReport(w http.ResponseWriter, report *healthReport) {
+	w.Header().Set("Cache-Control", "no-cache")
+	status := http.StatusOK
+	if !report.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeJson(w, status, report)
+}
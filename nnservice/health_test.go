@@ -0,0 +1,109 @@
+package nnservice_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-user-management/nnservice"
+)
+
+func passingCheck() (string, error) {
+	return "ok", nil
+}
+
+func failingCheck() (string, error) {
+	return "", errors.New("unreachable")
+}
+
+func TestHealthMessageIsHandledByEveryService(t *testing.T) {
+	repService := nnservice.NewRepService("mem://health-message")
+	repService.AddHealthCheck("check", nnservice.HealthCheckFunc(passingCheck))
+	go func() {
+		repService.Start()
+	}()
+	defer repService.Close()
+
+	reply := request(t, "mem://health-message", []byte{nnservice.HealthMessage})
+	health := &nnservice.HealthResponse{}
+	err := proto.Unmarshal(reply, health)
+	assert.Nil(t, err)
+	assert.Equal(t, "mem://health-message", health.GetService())
+	assert.True(t, health.GetBound())
+	assert.True(t, health.GetHealthy())
+	assert.Equal(t, 1, len(health.GetChecks()))
+	assert.Equal(t, "ok", health.GetChecks()[0].GetDetail())
+}
+
+func TestHealthMessageIdIsReserved(t *testing.T) {
+	repService := nnservice.NewRepService("mem://health-reserved")
+	assert.Panics(t, func() {
+		repService.AddHandler(nnservice.HealthMessage, nnservice.MessageHandlerFunc(
+			func(header *nnservice.Header, data []byte) ([]byte, error) {
+				return []byte{}, nil
+			}))
+	})
+}
+
+func TestServiceIsUnhealthyIfCheckFails(t *testing.T) {
+	repService := nnservice.NewRepService("mem://health-failing")
+	repService.AddHealthCheck("check", nnservice.HealthCheckFunc(failingCheck))
+
+	health := repService.Health()
+	assert.False(t, health.GetHealthy())
+	assert.False(t, health.GetChecks()[0].GetHealthy())
+	assert.Equal(t, "unavailable", health.GetChecks()[0].GetDetail(), "error is not exposed")
+}
+
+func TestHealthCheckResultsAreReused(t *testing.T) {
+	repService := nnservice.NewRepService("mem://health-reused")
+	runs := 0
+	repService.AddHealthCheck("check", nnservice.HealthCheckFunc(func() (string, error) {
+		runs++
+		return "ok", nil
+	}))
+
+	repService.Health()
+	repService.Health()
+	assert.Equal(t, 1, runs)
+
+	repService.HealthCheckInterval = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	repService.Health()
+	assert.Equal(t, 2, runs)
+}
+
+func TestServiceThatIsNotBoundIsNotReady(t *testing.T) {
+	repService := nnservice.NewRepService("mem://health-not-bound")
+	repService.AddHealthCheck("check", nnservice.HealthCheckFunc(passingCheck))
+
+	request, _ := http.NewRequest("GET", "/readyz", nil)
+	recorder := httptest.NewRecorder()
+	nnservice.ReadinessHandler(repService).ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+
+	var report struct {
+		Healthy  bool
+		Services []*nnservice.HealthResponse
+	}
+	err := json.Unmarshal(recorder.Body.Bytes(), &report)
+	assert.Nil(t, err)
+	assert.False(t, report.Healthy)
+	assert.False(t, report.Services[0].GetBound())
+}
+
+func TestLivenessDoesNotRunChecks(t *testing.T) {
+	repService := nnservice.NewRepService("mem://health-liveness")
+	repService.AddHealthCheck("check", nnservice.HealthCheckFunc(failingCheck))
+
+	request, _ := http.NewRequest("GET", "/healthz", nil)
+	recorder := httptest.NewRecorder()
+	nnservice.LivenessHandler(repService).ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
@@ -0,0 +1,61 @@
+package nnservice
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Label used instead of the message id for messages without a handler so that
+// clients can not create an unbounded number of time series.
+const unknownMessageLabel = "unknown"
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nnservice",
+		Name:      "requests_total",
+		Help:      "Number of handled requests.",
+	}, []string{"service", "message_id"})
+
+	requestErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nnservice",
+		Name:      "request_errors_total",
+		Help:      "Number of requests that were answered with an error reply.",
+	}, []string{"service", "message_id", "reason"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "nnservice",
+		Name:      "request_duration_seconds",
+		Help:      "Time it took to handle a request.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"service", "message_id"})
+
+	requestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nnservice",
+		Name:      "requests_in_flight",
+		Help:      "Number of requests currently being handled.",
+	}, []string{"service"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestErrorsTotal, requestDuration, requestsInFlight)
+}
+
+// messageIdLabel returns the label value for the message type.
+func (s *RepService) messageIdLabel(messageId int) string {
+	if _, ok := s.handlers[messageId]; !ok {
+		return unknownMessageLabel
+	}
+	return strconv.Itoa(messageId)
+}
+
+// errorReason returns the reason label of the error.
+func errorReason(err error) string {
+	if err == errNoReply {
+		return "no_reply"
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Code.String()
+	}
+	return ErrorCodeInternal.String()
+}
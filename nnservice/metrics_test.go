@@ -0,0 +1,57 @@
+package nnservice_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-user-management/nnservice"
+)
+
+func scrapeMetrics() string {
+	request, _ := http.NewRequest("GET", "/metrics", nil)
+	recorder := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(recorder, request)
+	return recorder.Body.String()
+}
+
+func TestRequestsAreCounted(t *testing.T) {
+	repService := nnservice.NewRepService("mem://metrics-requests")
+	repService.AddHandler(1, nnservice.MessageHandlerFunc(
+		func(header *nnservice.Header, data []byte) ([]byte, error) {
+			return []byte{1}, nil
+		}))
+	repService.Dispatch(&nnservice.Header{MessageId: 1}, []byte{})
+	repService.Dispatch(&nnservice.Header{MessageId: 1}, []byte{})
+
+	metrics := scrapeMetrics()
+	assert.Contains(t, metrics,
+		`nnservice_requests_total{message_id="1",service="mem://metrics-requests"} 2`)
+	assert.Contains(t, metrics,
+		`nnservice_request_duration_seconds_count{message_id="1",service="mem://metrics-requests"} 2`)
+	assert.Contains(t, metrics,
+		`nnservice_requests_in_flight{service="mem://metrics-requests"} 0`)
+}
+
+func TestErrorsAreCountedByReason(t *testing.T) {
+	repService := nnservice.NewRepService("mem://metrics-errors")
+	repService.AddHandler(1, nnservice.MessageHandlerFunc(
+		func(header *nnservice.Header, data []byte) ([]byte, error) {
+			return nil, nil
+		}))
+	repService.AddHandler(2, nnservice.ProtoHandler(newErrorReply, nil))
+	repService.Dispatch(&nnservice.Header{MessageId: 1}, []byte{})
+	repService.Dispatch(&nnservice.Header{MessageId: 2}, []byte{1, 2, 3})
+	repService.Dispatch(&nnservice.Header{MessageId: 3}, []byte{})
+
+	metrics := scrapeMetrics()
+	assert.Contains(t, metrics,
+		`nnservice_request_errors_total{message_id="1",reason="no_reply",service="mem://metrics-errors"} 1`)
+	assert.Contains(t, metrics,
+		`nnservice_request_errors_total{message_id="2",reason="malformed_request",service="mem://metrics-errors"} 1`)
+	assert.Contains(t, metrics,
+		`nnservice_request_errors_total{message_id="unknown",reason="unknown_message",service="mem://metrics-errors"} 1`)
+}
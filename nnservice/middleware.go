@@ -0,0 +1,92 @@
+package nnservice
+
+import (
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+)
+
+// Middleware wraps the handler for the message type to add behaviour around
+// handling of the request, similar to http.Handler wrappers.
+type Middleware func(messageId int, handler MessageHandler) MessageHandler
+
+// Chain wraps the handler with the middleware. The first middleware is the
+// outermost one and sees the request first.
+func Chain(messageId int, handler MessageHandler, middleware ...Middleware) MessageHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](messageId, handler)
+	}
+	return handler
+}
+
+// RecoverPanics turns a panic in the handler into an internal error reply so the
+// service keeps running.
+func RecoverPanics(messageId int, handler MessageHandler) MessageHandler {
+	return MessageHandlerFunc(func(header *Header, data []byte) (responseData []byte, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				header.Span.Logf("Handler for message type %d panicked: %v\n%s", messageId, r, debug.Stack())
+				responseData = nil
+				err = &Error{
+					Code:    ErrorCodeInternal,
+					Message: "Handler panicked",
+				}
+			}
+		}()
+		return handler.HandleMessage(header, data)
+	})
+}
+
+// LogRequests logs every handled request together with the time it took.
+func LogRequests(messageId int, handler MessageHandler) MessageHandler {
+	return MessageHandlerFunc(func(header *Header, data []byte) ([]byte, error) {
+		start := time.Now()
+		responseData, err := handler.HandleMessage(header, data)
+		status := "ok"
+		if err != nil {
+			status = "error"
+		}
+		header.Span.Logf("Handled message type %d in %s: %s", messageId, time.Since(start), status)
+		return responseData, err
+	})
+}
+
+// ProtoHandler returns a handler that unmarshals the request into the message
+// returned by newRequest, passes it to handle together with the request header
+// and marshals the reply.
+func ProtoHandler(
+	newRequest func() proto.Message,
+	handle func(header *Header, request proto.Message) (proto.Message, error)) MessageHandler {
+
+	return MessageHandlerFunc(func(header *Header, data []byte) ([]byte, error) {
+		request := newRequest()
+		err := proto.Unmarshal(data, request)
+		if err != nil {
+			return nil, NewMalformedRequestError(
+				fmt.Sprintf("Error unmarshalling %s: %s", messageName(request), err))
+		}
+		response, err := handle(header, request)
+		if err != nil {
+			return nil, err
+		}
+		responseData, err := proto.Marshal(response)
+		if err != nil {
+			return nil, fmt.Errorf("Error marshalling %s: %s", messageName(response), err)
+		}
+		return responseData, nil
+	})
+}
+
+func messageName(message proto.Message) string {
+	t := reflect.TypeOf(message)
+	if t == nil {
+		return "<nil>"
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
@@ -0,0 +1,78 @@
+package nnservice_test
+
+import (
+	"errors"
+	"testing"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-user-management/nnservice"
+)
+
+func recordingMiddleware(name string, calls *[]string) nnservice.Middleware {
+	return func(messageId int, handler nnservice.MessageHandler) nnservice.MessageHandler {
+		return nnservice.MessageHandlerFunc(func(header *nnservice.Header, data []byte) ([]byte, error) {
+			*calls = append(*calls, name)
+			return handler.HandleMessage(header, data)
+		})
+	}
+}
+
+func TestFirstMiddlewareInChainIsOutermost(t *testing.T) {
+	calls := []string{}
+	handler := nnservice.Chain(1,
+		nnservice.MessageHandlerFunc(func(header *nnservice.Header, data []byte) ([]byte, error) {
+			calls = append(calls, "handler")
+			return []byte{}, nil
+		}),
+		recordingMiddleware("first", &calls),
+		recordingMiddleware("second", &calls))
+	_, err := handler.HandleMessage(&nnservice.Header{}, []byte{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"first", "second", "handler"}, calls)
+}
+
+func TestPanicIsTurnedIntoInternalError(t *testing.T) {
+	handler := nnservice.RecoverPanics(1,
+		nnservice.MessageHandlerFunc(func(header *nnservice.Header, data []byte) ([]byte, error) {
+			panic("boom")
+		}))
+	responseData, err := handler.HandleMessage(&nnservice.Header{}, []byte{})
+	assert.Nil(t, responseData)
+	e, ok := err.(*nnservice.Error)
+	assert.True(t, ok)
+	assert.Equal(t, nnservice.ErrorCodeInternal, e.Code)
+}
+
+func newErrorReply() proto.Message {
+	return &nnservice.ErrorReply{}
+}
+
+func TestProtoHandlerMarshalsReply(t *testing.T) {
+	handler := nnservice.ProtoHandler(newErrorReply, func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+		reply := request.(*nnservice.ErrorReply)
+		reply.Message = proto.String(reply.GetMessage() + " reply")
+		return reply, nil
+	})
+	requestData, err := proto.Marshal(&nnservice.ErrorReply{
+		Code:    proto.Uint32(1),
+		Message: proto.String("request"),
+	})
+	assert.Nil(t, err)
+	responseData, err := handler.HandleMessage(&nnservice.Header{}, requestData)
+	assert.Nil(t, err)
+	reply := &nnservice.ErrorReply{}
+	assert.Nil(t, proto.Unmarshal(responseData, reply))
+	assert.Equal(t, "request reply", reply.GetMessage())
+}
+
+func TestProtoHandlerReturnsMalformedRequestError(t *testing.T) {
+	handler := nnservice.ProtoHandler(newErrorReply, func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+		return nil, errors.New("Should not be called")
+	})
+	_, err := handler.HandleMessage(&nnservice.Header{}, []byte{0xff})
+	e, ok := err.(*nnservice.Error)
+	assert.True(t, ok)
+	assert.Equal(t, nnservice.ErrorCodeMalformedRequest, e.Code)
+}
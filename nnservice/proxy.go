@@ -0,0 +1,83 @@
+package nnservice
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies are the networks of reverse proxies that are trusted to add
+// the address of the end user to the X-Forwarded-For header.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a comma separated list of IP addresses and
+// networks in CIDR notation.
+func ParseTrustedProxies(list string) (TrustedProxies, error) {
+	proxies := make(TrustedProxies, 0)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid proxy address: %s", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy network: %s", item)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (p TrustedProxies) contains(ip net.IP) bool {
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAddress returns the address of the end user that sent the request.
+// It is the address of the connection, unless the connection is from a trusted
+// proxy, in which case the X-Forwarded-For header is followed from the last
+// address to the first one that is not a trusted proxy. An empty string is
+// returned if the address is not known or only proxies are known.
+func (p TrustedProxies) ClientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && p.contains(ip); i-- {
+		address := strings.TrimSpace(forwarded[i])
+		if address == "" {
+			continue
+		}
+		ip = net.ParseIP(address)
+		if ip == nil {
+			return ""
+		}
+	}
+	if p.contains(ip) {
+		// Only proxies are known, which are shared by many users.
+		return ""
+	}
+	return ip.String()
+}
@@ -0,0 +1,45 @@
+package nnservice_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-user-management/nnservice"
+)
+
+func forwardedRequest(remoteAddr string, forwardedFor ...string) *http.Request {
+	request, _ := http.NewRequest("POST", "/", nil)
+	request.RemoteAddr = remoteAddr
+	for _, f := range forwardedFor {
+		request.Header.Add("X-Forwarded-For", f)
+	}
+	return request
+}
+
+func TestClientAddressIsConnectionAddressWithoutTrustedProxies(t *testing.T) {
+	var proxies nnservice.TrustedProxies
+	assert.Equal(t, "192.0.2.1", proxies.ClientAddress(forwardedRequest("192.0.2.1:4321", "198.51.100.1")))
+}
+
+func TestClientAddressIsForwardedByTrustedProxies(t *testing.T) {
+	proxies, err := nnservice.ParseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	assert.Nil(t, err)
+
+	assert.Equal(t, "198.51.100.1",
+		proxies.ClientAddress(forwardedRequest("10.0.0.1:4321", "198.51.100.1")))
+	assert.Equal(t, "198.51.100.1",
+		proxies.ClientAddress(forwardedRequest("10.0.0.1:4321", "203.0.113.9, 198.51.100.1", "192.0.2.1")),
+		"addresses added by the end user are ignored")
+	assert.Equal(t, "", proxies.ClientAddress(forwardedRequest("10.0.0.1:4321")),
+		"address of a proxy is not an end user address")
+	assert.Equal(t, "", proxies.ClientAddress(forwardedRequest("10.0.0.1:4321", "unknown")))
+}
+
+func TestInvalidTrustedProxiesAreRejected(t *testing.T) {
+	_, err := nnservice.ParseTrustedProxies("10.0.0.0/33")
+	assert.NotNil(t, err)
+	_, err = nnservice.ParseTrustedProxies("proxy.example.com")
+	assert.NotNil(t, err)
+}
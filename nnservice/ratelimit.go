@@ -0,0 +1,186 @@
+package nnservice
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+)
+
+// Number of buckets kept by the memory rate limiter.
+const maxMemoryBuckets = 10000
+
+// RateLimit is the configuration of a token bucket. Bucket holds at most Burst
+// tokens and is refilled with Rate tokens per second. Every request takes one
+// token and is rejected if the bucket is empty.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseRateLimit parses a limit in the format rate/burst, e.g. 0.5/10.
+func ParseRateLimit(s string) (RateLimit, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("Invalid rate limit: %s", s)
+	}
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || rate <= 0 {
+		return RateLimit{}, fmt.Errorf("Invalid rate: %s", parts[0])
+	}
+	burst, err := strconv.Atoi(parts[1])
+	if err != nil || burst < 1 {
+		return RateLimit{}, fmt.Errorf("Invalid burst: %s", parts[1])
+	}
+	return RateLimit{Rate: rate, Burst: burst}, nil
+}
+
+// RefillTime returns how long an empty bucket takes to be full again.
+func (l RateLimit) RefillTime() time.Duration {
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+}
+
+func (l RateLimit) String() string {
+	return strconv.FormatFloat(l.Rate, 'g', -1, 64) + "/" + strconv.Itoa(l.Burst)
+}
+
+// RateLimiter keeps token buckets.
+type RateLimiter interface {
+	// Allow takes a token from the bucket for the key and reports whether
+	// there was one.
+	Allow(key string, limit RateLimit) (bool, error)
+}
+
+// CallerKey returns the key that identifies the caller of the request.
+type CallerKey func(header *Header, data []byte) string
+
+// HeaderCallerKey identifies callers by the value of the request header.
+func HeaderCallerKey(name string) CallerKey {
+	return func(header *Header, data []byte) string {
+		return header.Get(name)
+	}
+}
+
+// MessageCallerKey identifies callers by a field of the request message, e.g.
+// the client id. Requests that can not be unmarshalled are left to the handler
+// and are identified by fallback if it is set.
+func MessageCallerKey(
+	newRequest func() proto.Message,
+	key func(request proto.Message) string,
+	fallback CallerKey) CallerKey {
+
+	return func(header *Header, data []byte) string {
+		request := newRequest()
+		if err := proto.Unmarshal(data, request); err == nil {
+			if k := key(request); k != "" {
+				return k
+			}
+		}
+		if fallback != nil {
+			return fallback(header, data)
+		}
+		return ""
+	}
+}
+
+// RateLimited rejects requests of callers that exceeded the limit with a rate
+// limited error. Every message type has its own buckets. Requests are allowed
+// if the limiter fails so that a broken limiter does not stop the service.
+// Requests of callers that can not be identified are not limited, because
+// sharing one bucket between them would limit all of them together.
+func RateLimited(limiter RateLimiter, limit RateLimit, callerKey CallerKey) Middleware {
+	return func(messageId int, handler MessageHandler) MessageHandler {
+		return MessageHandlerFunc(func(header *Header, data []byte) ([]byte, error) {
+			caller := callerKey(header, data)
+			if caller == "" {
+				return handler.HandleMessage(header, data)
+			}
+			allowed, err := limiter.Allow(strconv.Itoa(messageId)+":"+caller, limit)
+			if err != nil {
+				header.Span.Logf("Error checking rate limit: %s", err)
+			} else if !allowed {
+				header.Span.Logf("Rate limit exceeded for message type %d: %s", messageId, caller)
+				return nil, &Error{
+					Code:    ErrorCodeRateLimited,
+					Message: fmt.Sprintf("Rate limit exceeded for message type %d", messageId),
+				}
+			}
+			return handler.HandleMessage(header, data)
+		})
+	}
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// refill adds tokens for the time since the last update.
+func (b *tokenBucket) refill(now time.Time, limit RateLimit) {
+	b.tokens += now.Sub(b.updated).Seconds() * limit.Rate
+	if b.tokens > float64(limit.Burst) {
+		b.tokens = float64(limit.Burst)
+	}
+	b.updated = now
+}
+
+type memoryRateLimiter struct {
+	mu sync.Mutex
+	// buckets holds the elements of lru by key.
+	buckets map[string]*list.Element
+	// lru orders the buckets from the most to the least recently used one.
+	lru *list.List
+	now func() time.Time
+}
+
+type memoryBucket struct {
+	key string
+	tokenBucket
+}
+
+// NewMemoryRateLimiter returns a rate limiter that keeps the buckets in
+// memory. Every instance of the service has its own buckets. At most
+// maxMemoryBuckets buckets are kept, the least recently used one is removed
+// for a new one.
+func NewMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+func (l *memoryRateLimiter) Allow(key string, limit RateLimit) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	element, ok := l.buckets[key]
+	if ok {
+		l.lru.MoveToFront(element)
+	} else {
+		if l.lru.Len() >= maxMemoryBuckets {
+			oldest := l.lru.Back()
+			delete(l.buckets, oldest.Value.(*memoryBucket).key)
+			l.lru.Remove(oldest)
+		}
+		element = l.lru.PushFront(&memoryBucket{
+			key: key,
+			tokenBucket: tokenBucket{
+				tokens:  float64(limit.Burst),
+				updated: now,
+			},
+		})
+		l.buckets[key] = element
+	}
+	bucket := element.Value.(*memoryBucket)
+	bucket.refill(now, limit)
+	if bucket.tokens < 1 {
+		return false, nil
+	}
+	bucket.tokens--
+	return true, nil
+}
@@ -0,0 +1,139 @@
+package nnservice_test
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-user-management/nnservice"
+)
+
+// Limit that is never refilled during a test.
+var testRateLimit = nnservice.RateLimit{Rate: 0.0001, Burst: 2}
+
+func okHandler() nnservice.MessageHandler {
+	return nnservice.MessageHandlerFunc(func(header *nnservice.Header, data []byte) ([]byte, error) {
+		return []byte{1}, nil
+	})
+}
+
+func callerHeader(caller string) *nnservice.Header {
+	header := &nnservice.Header{}
+	header.Set(nnservice.HeaderCaller, caller)
+	return header
+}
+
+func TestRequestsOverBurstAreRateLimited(t *testing.T) {
+	limiter := nnservice.NewMemoryRateLimiter()
+	handler := nnservice.RateLimited(limiter, testRateLimit,
+		nnservice.HeaderCallerKey(nnservice.HeaderCaller))(1, okHandler())
+
+	for i := 0; i < 2; i++ {
+		_, err := handler.HandleMessage(callerHeader("a"), []byte{})
+		assert.Nil(t, err)
+	}
+	_, err := handler.HandleMessage(callerHeader("a"), []byte{})
+	e, ok := err.(*nnservice.Error)
+	assert.True(t, ok)
+	assert.Equal(t, nnservice.ErrorCodeRateLimited, e.Code)
+	assert.False(t, e.Retryable)
+}
+
+func TestCallersAndMessageTypesHaveSeparateBuckets(t *testing.T) {
+	limiter := nnservice.NewMemoryRateLimiter()
+	middleware := nnservice.RateLimited(limiter, testRateLimit,
+		nnservice.HeaderCallerKey(nnservice.HeaderCaller))
+	first := middleware(1, okHandler())
+	second := middleware(2, okHandler())
+
+	for i := 0; i < 2; i++ {
+		_, err := first.HandleMessage(callerHeader("a"), []byte{})
+		assert.Nil(t, err)
+	}
+	_, err := first.HandleMessage(callerHeader("b"), []byte{})
+	assert.Nil(t, err)
+	_, err = second.HandleMessage(callerHeader("a"), []byte{})
+	assert.Nil(t, err)
+}
+
+func TestBucketIsRefilled(t *testing.T) {
+	limiter := nnservice.NewMemoryRateLimiter()
+	limit := nnservice.RateLimit{Rate: 1e9, Burst: 1}
+	for i := 0; i < 3; i++ {
+		allowed, err := limiter.Allow("key", limit)
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+	}
+}
+
+func TestLeastRecentlyUsedBucketIsRemoved(t *testing.T) {
+	limiter := nnservice.NewMemoryRateLimiter()
+	limit := nnservice.RateLimit{Rate: 0.0001, Burst: 1}
+	allowed, _ := limiter.Allow("first", limit)
+	assert.True(t, allowed)
+	allowed, _ = limiter.Allow("second", limit)
+	assert.True(t, allowed)
+	// Limiter keeps 10000 buckets, the first one is used again before it would
+	// be removed, so the second one is removed instead.
+	for i := 0; i < 9998; i++ {
+		limiter.Allow(strconv.Itoa(i), limit)
+	}
+	allowed, _ = limiter.Allow("first", limit)
+	assert.False(t, allowed)
+	limiter.Allow("new", limit)
+
+	allowed, _ = limiter.Allow("first", limit)
+	assert.False(t, allowed, "recently used bucket is kept")
+	allowed, _ = limiter.Allow("second", limit)
+	assert.True(t, allowed, "least recently used bucket is removed")
+}
+
+func TestCallerIsIdentifiedByMessageField(t *testing.T) {
+	callerKey := nnservice.MessageCallerKey(newErrorReply, func(request proto.Message) string {
+		return request.(*nnservice.ErrorReply).GetMessage()
+	}, nnservice.HeaderCallerKey(nnservice.HeaderCaller))
+
+	data, err := proto.Marshal(newEchoRequest("client"))
+	assert.Nil(t, err)
+	assert.Equal(t, "client", callerKey(callerHeader("a"), data))
+	assert.Equal(t, "a", callerKey(callerHeader("a"), []byte{0xff}))
+}
+
+type failingRateLimiter struct{}
+
+func (failingRateLimiter) Allow(key string, limit nnservice.RateLimit) (bool, error) {
+	return false, errors.New("unavailable")
+}
+
+func TestRequestIsAllowedIfLimiterFails(t *testing.T) {
+	handler := nnservice.RateLimited(failingRateLimiter{}, testRateLimit,
+		nnservice.HeaderCallerKey(nnservice.HeaderCaller))(1, okHandler())
+	_, err := handler.HandleMessage(callerHeader("a"), []byte{})
+	assert.Nil(t, err)
+}
+
+func TestUnidentifiedCallersAreNotRateLimited(t *testing.T) {
+	handler := nnservice.RateLimited(nnservice.NewMemoryRateLimiter(), testRateLimit,
+		nnservice.HeaderCallerKey(nnservice.HeaderCaller))(1, okHandler())
+	for i := 0; i < 3; i++ {
+		_, err := handler.HandleMessage(&nnservice.Header{}, []byte{})
+		assert.Nil(t, err)
+	}
+}
+
+func TestRateLimitIsParsed(t *testing.T) {
+	limit, err := nnservice.ParseRateLimit("0.5/10")
+	assert.Nil(t, err)
+	assert.Equal(t, nnservice.RateLimit{Rate: 0.5, Burst: 10}, limit)
+	assert.Equal(t, "0.5/10", limit.String())
+	assert.Equal(t, 20*time.Second, limit.RefillTime())
+
+	for _, invalid := range []string{"", "1", "0/10", "1/0", "a/1", "1/2/3"} {
+		_, err := nnservice.ParseRateLimit(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
@@ -0,0 +1,209 @@
+package nnservice
+
+import (
+	"reflect"
+	"sort"
+
+	"code.google.com/p/gogoprotobuf/proto"
+)
+
+// ReflectionMessage is the message type reserved on every service for
+// discovering the handled message types. The request is a ReflectionRequest
+// and the reply is a ReflectionResponse.
+const ReflectionMessage = 254
+
+// TypedHandler is a handler that knows the types of its request and reply
+// messages, which are listed in the reply to the reflection message.
+type TypedHandler interface {
+	MessageHandler
+	// MessageTypes returns the type names of the request and reply messages.
+	MessageTypes() (request, response string)
+}
+
+type typedHandler struct {
+	MessageHandler
+	requestType  string
+	responseType string
+}
+
+func (h *typedHandler) MessageTypes() (string, string) {
+	return h.requestType, h.responseType
+}
+
+// WithMessageTypes returns the handler annotated with the types of its request
+// and reply messages.
+func WithMessageTypes(handler MessageHandler, request, response proto.Message) TypedHandler {
+	return &typedHandler{
+		MessageHandler: handler,
+		requestType:    MessageTypeName(request),
+		responseType:   MessageTypeName(response),
+	}
+}
+
+// MessageTypeName returns the name of the Go type of the generated message
+// including the package name, e.g. proto_user.RegisterUser.
+func MessageTypeName(message proto.Message) string {
+	t := reflect.TypeOf(message)
+	if t == nil {
+		return ""
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.String()
+}
+
+// ReflectionRequest is the request of the reflection message.
+type ReflectionRequest struct {
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *ReflectionRequest) Reset()         { *m = ReflectionRequest{} }
+func (m *ReflectionRequest) String() string { return proto.CompactTextString(m) }
+func (*ReflectionRequest) ProtoMessage()    {}
+
+// ReflectionResponse is the reply to the reflection message.
+type ReflectionResponse struct {
+	Service          *string                       `protobuf:"bytes,1,req,name=service" json:"service,omitempty"`
+	Version          *string                       `protobuf:"bytes,2,opt,name=version" json:"version,omitempty"`
+	Messages         []*ReflectionResponse_Message `protobuf:"bytes,3,rep,name=messages" json:"messages,omitempty"`
+	XXX_unrecognized []byte                        `json:"-"`
+}
+
+func (m *ReflectionResponse) Reset()         { *m = ReflectionResponse{} }
+func (m *ReflectionResponse) String() string { return proto.CompactTextString(m) }
+func (*ReflectionResponse) ProtoMessage()    {}
+
+func (m *ReflectionResponse) GetService() string {
+	if m != nil && m.Service != nil {
+		return *m.Service
+	}
+	return ""
+}
+
+func (m *ReflectionResponse) GetVersion() string {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return ""
+}
+
+func (m *ReflectionResponse) GetMessages() []*ReflectionResponse_Message {
+	if m != nil {
+		return m.Messages
+	}
+	return nil
+}
+
+// Message returns the description of the message type or nil if the service
+// does not handle it.
+func (m *ReflectionResponse) Message(messageId int) *ReflectionResponse_Message {
+	for _, message := range m.GetMessages() {
+		if int(message.GetMessageId()) == messageId {
+			return message
+		}
+	}
+	return nil
+}
+
+// Supports reports whether the service handles the message type with the given
+// request and reply messages. Types are not compared if the service does not
+// know them.
+func (m *ReflectionResponse) Supports(messageId int, request, response proto.Message) bool {
+	message := m.Message(messageId)
+	if message == nil {
+		return false
+	}
+	return (message.GetRequestType() == "" || message.GetRequestType() == MessageTypeName(request)) &&
+		(message.GetResponseType() == "" || message.GetResponseType() == MessageTypeName(response))
+}
+
+type ReflectionResponse_Message struct {
+	MessageId        *uint32 `protobuf:"varint,1,req,name=message_id" json:"message_id,omitempty"`
+	RequestType      *string `protobuf:"bytes,2,opt,name=request_type" json:"request_type,omitempty"`
+	ResponseType     *string `protobuf:"bytes,3,opt,name=response_type" json:"response_type,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *ReflectionResponse_Message) Reset()         { *m = ReflectionResponse_Message{} }
+func (m *ReflectionResponse_Message) String() string { return proto.CompactTextString(m) }
+func (*ReflectionResponse_Message) ProtoMessage()    {}
+
+func (m *ReflectionResponse_Message) GetMessageId() uint32 {
+	if m != nil && m.MessageId != nil {
+		return *m.MessageId
+	}
+	return 0
+}
+
+func (m *ReflectionResponse_Message) GetRequestType() string {
+	if m != nil && m.RequestType != nil {
+		return *m.RequestType
+	}
+	return ""
+}
+
+func (m *ReflectionResponse_Message) GetResponseType() string {
+	if m != nil && m.ResponseType != nil {
+		return *m.ResponseType
+	}
+	return ""
+}
+
+// Reflect describes the message types handled by the service, including the
+// reserved ones, ordered by message id. Types are known only for handlers that
+// implement TypedHandler.
+func (s *RepService) Reflect() *ReflectionResponse {
+	types := map[int][2]string{
+		HealthMessage:     {"", MessageTypeName(&HealthResponse{})},
+		ReflectionMessage: {MessageTypeName(&ReflectionRequest{}), MessageTypeName(&ReflectionResponse{})},
+	}
+	for messageId, handler := range s.messageHandlers {
+		var requestType, responseType string
+		if typed, ok := handler.(TypedHandler); ok {
+			requestType, responseType = typed.MessageTypes()
+		}
+		types[messageId] = [2]string{requestType, responseType}
+	}
+	messageIds := make([]int, 0, len(types))
+	for messageId := range types {
+		messageIds = append(messageIds, messageId)
+	}
+	sort.Ints(messageIds)
+
+	response := &ReflectionResponse{
+		Service: proto.String(s.Address),
+	}
+	if s.Version != "" {
+		response.Version = proto.String(s.Version)
+	}
+	for _, messageId := range messageIds {
+		message := &ReflectionResponse_Message{
+			MessageId: proto.Uint32(uint32(messageId)),
+		}
+		if requestType := types[messageId][0]; requestType != "" {
+			message.RequestType = proto.String(requestType)
+		}
+		if responseType := types[messageId][1]; responseType != "" {
+			message.ResponseType = proto.String(responseType)
+		}
+		response.Messages = append(response.Messages, message)
+	}
+	return response
+}
+
+func (s *RepService) reflectionHandler() MessageHandler {
+	return MessageHandlerFunc(func(header *Header, data []byte) ([]byte, error) {
+		return proto.Marshal(s.Reflect())
+	})
+}
+
+// Reflect asks the service for the message types it handles.
+func (c *Client) Reflect() (*ReflectionResponse, error) {
+	response := &ReflectionResponse{}
+	err := c.Call(ReflectionMessage, &ReflectionRequest{}, response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
@@ -0,0 +1,64 @@
+package nnservice_test
+
+import (
+	"testing"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-user-management/nnservice"
+)
+
+func echoHandler() nnservice.MessageHandler {
+	return nnservice.ProtoHandler(newErrorReply,
+		func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+			return request, nil
+		})
+}
+
+func TestReflectionListsRegisteredHandlers(t *testing.T) {
+	repService := nnservice.NewRepService("mem://reflection")
+	repService.Version = "1.2.3"
+	repService.AddHandler(2, echoHandler())
+	repService.AddHandler(1, nnservice.WithMessageTypes(echoHandler(), newErrorReply(), newErrorReply()))
+	go func() {
+		repService.Start()
+	}()
+	defer repService.Close()
+
+	client := nnservice.NewClient("mem://reflection")
+	defer client.Close()
+	reflection, err := client.Reflect()
+	assert.Nil(t, err)
+	assert.Equal(t, "mem://reflection", reflection.GetService())
+	assert.Equal(t, "1.2.3", reflection.GetVersion())
+
+	messages := reflection.GetMessages()
+	assert.Equal(t, 4, len(messages))
+	assert.Equal(t, uint32(1), messages[0].GetMessageId())
+	assert.Equal(t, "nnservice.ErrorReply", messages[0].GetRequestType())
+	assert.Equal(t, "nnservice.ErrorReply", messages[0].GetResponseType())
+	assert.Equal(t, uint32(2), messages[1].GetMessageId())
+	assert.Empty(t, messages[1].GetRequestType())
+	assert.Equal(t, uint32(nnservice.ReflectionMessage), messages[2].GetMessageId())
+	assert.Equal(t, uint32(nnservice.HealthMessage), messages[3].GetMessageId())
+}
+
+func TestReflectionChecksSupportedMessages(t *testing.T) {
+	repService := nnservice.NewRepService("mem://reflection-supports")
+	repService.AddHandler(1, nnservice.WithMessageTypes(echoHandler(), newErrorReply(), newErrorReply()))
+	repService.AddHandler(2, echoHandler())
+
+	reflection := repService.Reflect()
+	assert.True(t, reflection.Supports(1, newErrorReply(), newErrorReply()))
+	assert.False(t, reflection.Supports(1, newErrorReply(), &nnservice.HealthResponse{}))
+	assert.True(t, reflection.Supports(2, newErrorReply(), &nnservice.HealthResponse{}))
+	assert.False(t, reflection.Supports(3, newErrorReply(), newErrorReply()))
+}
+
+func TestReflectionMessageIdIsReserved(t *testing.T) {
+	repService := nnservice.NewRepService("mem://reflection-reserved")
+	assert.Panics(t, func() {
+		repService.AddHandler(nnservice.ReflectionMessage, echoHandler())
+	})
+}
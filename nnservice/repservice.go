@@ -1,55 +1,360 @@
 package nnservice
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"strconv"
+	"sync"
+	"time"
 
 	_ "github.com/lib/pq"
-	nmsg "github.com/op/go-nanomsg"
+	"github.com/opentarock/service-user-management/trace"
 	"github.com/opentarock/service-user-management/util/logutil"
 )
 
+// DefaultWorkers is the number of workers used when RepService.Workers is not set.
+const DefaultWorkers = 4
+
+// How often idle workers check if the service is stopping.
+const workerPollInterval = 100 * time.Millisecond
+
+var ErrStopTimeout = errors.New("repService: stop_timeout")
+
+var errNoReply = &Error{
+	Code:    ErrorCodeInternal,
+	Message: "Handler returned no reply",
+}
+
 type RepService struct {
-	Address         string
-	socket          *nmsg.RepSocket
-	messageHandlers map[int]MessageHandler
+	Address string
+	// Workers is the number of requests that are handled concurrently.
+	Workers int
+	// QueueSize is the size in bytes of the queue of pending requests kept for
+	// every worker when the default nanomsg transport is used, see
+	// NanomsgTransport.
+	QueueSize int64
+	// Transport is used to receive requests. By default it is chosen by the
+	// address scheme, see transportFor.
+	Transport Transport
+	// Version is the version of the service reported by the reflection
+	// message.
+	Version string
+	// HealthCheckInterval is how long results of the health checks are
+	// reused, DefaultHealthCheckInterval if not set.
+	HealthCheckInterval time.Duration
+
+	messageHandlers   map[int]MessageHandler
+	handlerMiddleware map[int][]Middleware
+	middleware        []Middleware
+	// Handlers wrapped with middleware, built when the first request is handled.
+	handlers     map[int]MessageHandler
+	handlersOnce sync.Once
+	healthChecks []namedHealthCheck
+
+	healthMu        sync.Mutex
+	healthResults   []*HealthResponse_Check
+	healthPassed    bool
+	healthCheckedAt time.Time
+
+	mu        sync.Mutex
+	listener  Listener
+	receivers []Receiver
+	err       error
+
+	running      sync.WaitGroup
+	stopping     chan struct{}
+	stoppingOnce sync.Once
 }
 
 func NewRepService(bind string) *RepService {
 	return &RepService{
-		Address:         bind,
-		messageHandlers: make(map[int]MessageHandler),
+		Address:           bind,
+		Workers:           DefaultWorkers,
+		messageHandlers:   make(map[int]MessageHandler),
+		handlerMiddleware: make(map[int][]Middleware),
+		stopping:          make(chan struct{}),
 	}
 }
 
-func (s *RepService) AddHandler(messageId int, handler MessageHandler) {
+// AddHandler sets the handler for the message type. Optional middleware is
+// applied only to this handler, inside of the middleware added with Use.
+func (s *RepService) AddHandler(messageId int, handler MessageHandler, middleware ...Middleware) {
+	switch messageId {
+	case HealthMessage:
+		panic(fmt.Sprintf("Message type %d is reserved for health checks", messageId))
+	case ReflectionMessage:
+		panic(fmt.Sprintf("Message type %d is reserved for reflection", messageId))
+	}
 	log.Printf("Adding handler for: %d", messageId)
 	s.messageHandlers[messageId] = handler
+	s.handlerMiddleware[messageId] = middleware
+}
+
+// Use adds middleware that is applied to all the handlers. It must be called
+// before the service handles the first request.
+func (s *RepService) Use(middleware ...Middleware) {
+	s.middleware = append(s.middleware, middleware...)
+}
+
+// Start starts listening on the service address and dispatches received
+// requests to a pool of workers. Start blocks until the service is stopped and
+// returns nil if it was stopped with Stop or Close.
+func (s *RepService) Start() error {
+	listener, err := s.listen()
+	if err != nil {
+		s.closeListener()
+		return err
+	}
+	err = listener.Serve()
+	if s.isStopping() {
+		return s.failure()
+	}
+	s.Close()
+	if err == nil {
+		err = errors.New("Listener closed")
+	}
+	return fmt.Errorf("Error forwarding requests: %s", err)
+}
+
+func (s *RepService) transport() Transport {
+	if s.Transport != nil {
+		return s.Transport
+	}
+	transport := transportFor(s.Address)
+	if nanomsgTransport, ok := transport.(*NanomsgTransport); ok {
+		nanomsgTransport.QueueSize = s.QueueSize
+	}
+	return transport
+}
+
+func (s *RepService) listen() (Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isStopping() {
+		return nil, errors.New("Service is stopped")
+	}
+
+	listener, err := s.transport().Listen(s.Address)
+	if err != nil {
+		return nil, err
+	}
+	s.listener = listener
+
+	numWorkers := s.Workers
+	if numWorkers < 1 {
+		numWorkers = DefaultWorkers
+	}
+	for i := 0; i < numWorkers; i++ {
+		receiver, err := listener.NewReceiver()
+		if err != nil {
+			return nil, fmt.Errorf("Error creating worker: %s", err)
+		}
+		s.receivers = append(s.receivers, receiver)
+		s.running.Add(1)
+		go s.work(receiver)
+	}
+	log.Printf("Started %d workers", numWorkers)
+	return listener, nil
+}
+
+func (s *RepService) work(receiver Receiver) {
+	defer s.running.Done()
+	for !s.isStopping() {
+		recvData, err := receiver.Receive(workerPollInterval)
+		if err == ErrTimeout {
+			continue
+		} else if err != nil {
+			if !s.isStopping() {
+				s.fail(fmt.Errorf("Error receiving message: %s", err))
+			}
+			return
+		}
+		err = receiver.Reply(s.handle(recvData))
+		logutil.ErrorNormal("Error sending reply", err)
+	}
 }
 
-func (s *RepService) Start() {
-	socket, err := nmsg.NewRepSocket()
-	logutil.ErrorFatal("Error creating response socket", err)
-	s.socket = socket
+// handle decodes the frame and encodes the reply in the same frame format.
+func (s *RepService) handle(recvData []byte) []byte {
+	header, data, err := DecodeFrame(recvData)
+	var responseData []byte
+	if err != nil {
+		log.Printf("Error decoding frame: %s", err)
+		responseData = EncodeErrorReply(err)
+	} else {
+		responseData = s.Dispatch(header, data)
+	}
+	if header.Version == LegacyFrameVersion {
+		return responseData
+	}
+	replyHeader := &Header{
+		Version:   FrameVersion,
+		MessageId: header.MessageId,
+		RequestId: header.RequestId,
+	}
+	replyData, err := EncodeFrame(replyHeader, responseData)
+	if err != nil {
+		log.Printf("Error encoding reply: %s", err)
+		return EncodeErrorReply(err)
+	}
+	return replyData
+}
+
+func (s *RepService) buildHandlers() {
+	s.handlers = make(map[int]MessageHandler)
+	for messageId, handler := range s.messageHandlers {
+		handler = Chain(messageId, handler, s.handlerMiddleware[messageId]...)
+		s.handlers[messageId] = Chain(messageId, handler, s.middleware...)
+	}
+	// Health checks are not passed through middleware so that frequent probes
+	// do not fill the logs.
+	s.handlers[HealthMessage] = s.healthHandler()
+	s.handlers[ReflectionMessage] = s.reflectionHandler()
+}
+
+// Dispatch passes the request to the handler for its message type and returns
+// the reply. Error reply is returned if the request can not be handled.
+// Dispatch can be used to handle requests that did not arrive through the
+// service transport, e.g. by the HTTP gateway.
+func (s *RepService) Dispatch(header *Header, data []byte) []byte {
+	s.handlersOnce.Do(s.buildHandlers)
+	messageIdLabel := s.messageIdLabel(header.MessageId)
+	requestsInFlight.WithLabelValues(s.Address).Inc()
+	defer requestsInFlight.WithLabelValues(s.Address).Dec()
 
-	endpoint, err := socket.Bind(s.Address)
-	logutil.ErrorFatal("Error binding socket", err)
-	log.Printf("Bound to endpoint: %s", endpoint.Address)
+	span := s.startSpan(header, messageIdLabel)
+	defer span.Finish()
+	spanHeader := *header
+	spanHeader.Span = span
 
-	for {
-		recvData, err := socket.Recv(0)
-		logutil.ErrorFatal("Error receiving message", err)
-		if len(recvData) < 1 {
-			log.Printf("Unexpected empty message")
+	start := time.Now()
+	responseData, err := s.dispatch(&spanHeader, data)
+	requestDuration.WithLabelValues(s.Address, messageIdLabel).Observe(time.Since(start).Seconds())
+	requestsTotal.WithLabelValues(s.Address, messageIdLabel).Inc()
+	if err != nil {
+		if _, ok := err.(*Error); !ok {
+			span.Logf("%s", err)
 		}
-		if handler, ok := s.messageHandlers[int(recvData[0])]; ok {
-			responseData := handler.HandleMessage(recvData[1:])
-			socket.Send(responseData, 0)
-		} else {
-			log.Printf("Unknown message type: %d", recvData[0])
+		span.SetError(err)
+		requestErrorsTotal.WithLabelValues(s.Address, messageIdLabel, errorReason(err)).Inc()
+		return EncodeErrorReply(err)
+	}
+	return responseData
+}
+
+// startSpan starts the span of the request. The request id from the frame is
+// used if it is set, otherwise one is generated so that log lines of the
+// request can be correlated. The span is a child of the span in the header if
+// the request did not come from a frame.
+func (s *RepService) startSpan(header *Header, messageIdLabel string) *trace.Span {
+	name := "message " + messageIdLabel
+	var span *trace.Span
+	if header.Span != nil {
+		span = header.Span.Child(name, trace.SpanKindServer)
+	} else {
+		span = trace.NewSpan(header.Get(HeaderTraceId), header.RequestId, name)
+	}
+	span.SetAttribute("service", s.Address)
+	span.SetAttribute("message.id", strconv.Itoa(header.MessageId))
+	if caller := header.Get(HeaderCaller); caller != "" {
+		span.SetAttribute("caller", caller)
+	}
+	return span
+}
+
+func (s *RepService) dispatch(header *Header, data []byte) ([]byte, error) {
+	messageId := header.MessageId
+	if deadline, ok := header.Deadline(); ok && time.Now().After(deadline) {
+		header.Span.Logf("Deadline exceeded for message type %d", messageId)
+		return nil, &Error{
+			Code:    ErrorCodeDeadlineExceeded,
+			Message: "Deadline exceeded",
+		}
+	}
+	handler, ok := s.handlers[messageId]
+	if !ok {
+		header.Span.Logf("Unknown message type: %d", messageId)
+		return nil, &Error{
+			Code:    ErrorCodeUnknownMessage,
+			Message: fmt.Sprintf("Unknown message type: %d", messageId),
 		}
 	}
+	responseData, err := handler.HandleMessage(header, data)
+	if err != nil {
+		header.Span.Logf("Error handling message type %d: %s", messageId, err)
+		return nil, err
+	} else if responseData == nil {
+		header.Span.Logf("Handler for message type %d returned no reply", messageId)
+		return nil, errNoReply
+	}
+	return responseData, nil
+}
+
+// Stop stops accepting new requests and waits at most timeout for the requests
+// that are currently being handled to finish before closing the listener.
+// ErrStopTimeout is returned if the requests did not finish in time.
+func (s *RepService) Stop(timeout time.Duration) error {
+	s.mu.Lock()
+	s.stoppingOnce.Do(func() {
+		close(s.stopping)
+	})
+	s.mu.Unlock()
+	defer s.closeListener()
+
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return ErrStopTimeout
+	}
 }
 
+// Close stops the service without waiting for requests that are being handled.
 func (s *RepService) Close() {
-	s.socket.Close()
+	s.Stop(0)
+}
+
+func (s *RepService) isStopping() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// fail stops the service because of an error that Start should return.
+func (s *RepService) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	go s.Close()
+}
+
+func (s *RepService) failure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *RepService) closeListener() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		logutil.ErrorNormal("Error closing listener", s.listener.Close())
+		s.listener = nil
+	}
+	for _, receiver := range s.receivers {
+		logutil.ErrorNormal("Error closing receiver", receiver.Close())
+	}
+	s.receivers = nil
 }
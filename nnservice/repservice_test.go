@@ -7,55 +7,188 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 
-	nmsg "github.com/op/go-nanomsg"
 	"github.com/opentarock/service-user-management/nnservice"
+	"github.com/opentarock/service-user-management/trace"
 )
 
-func TestHandlerIsUsed(t *testing.T) {
-	req, err := nmsg.NewReqSocket()
+func request(t *testing.T, address string, data []byte) []byte {
+	conn, err := nnservice.MemoryTransport.Dial(address)
+	assert.Nil(t, err)
+	defer conn.Close()
+	reply, err := conn.Request(data, time.Second)
 	assert.Nil(t, err)
-	repService := nnservice.NewRepService("tcp://*:9000")
-	req.Connect("tcp://localhost:9000")
+	return reply
+}
+
+func TestHandlerIsUsed(t *testing.T) {
+	repService := nnservice.NewRepService("mem://handler-is-used")
 	called := false
 	repService.AddHandler(1,
-		nnservice.MessageHandlerFunc(func(data []byte) []byte {
+		nnservice.MessageHandlerFunc(func(header *nnservice.Header, data []byte) ([]byte, error) {
 			called = true
-			return []byte{}
+			return []byte{}, nil
 		}))
 	go func() {
 		repService.Start()
 	}()
+	defer repService.Close()
 
-	req.Send([]byte{1}, 0)
-	time.Sleep(100 * time.Millisecond)
+	request(t, "mem://handler-is-used", []byte{1})
 	assert.Equal(t, called, true)
-	defer repService.Close()
 }
 
 func TestOnlyLastAddedHandlerForTypeIsUsed(t *testing.T) {
-	req, err := nmsg.NewReqSocket()
-	assert.Nil(t, err)
-	repService := nnservice.NewRepService("tcp://*:9000")
-	req.Connect("tcp://localhost:9000")
+	repService := nnservice.NewRepService("mem://only-last-handler")
 	calledFirst := false
 	repService.AddHandler(1,
-		nnservice.MessageHandlerFunc(func(data []byte) []byte {
+		nnservice.MessageHandlerFunc(func(header *nnservice.Header, data []byte) ([]byte, error) {
 			calledFirst = true
-			return []byte{}
+			return []byte{}, nil
 		}))
 	calledSecond := false
 	repService.AddHandler(1,
-		nnservice.MessageHandlerFunc(func(data []byte) []byte {
+		nnservice.MessageHandlerFunc(func(header *nnservice.Header, data []byte) ([]byte, error) {
 			calledSecond = true
-			return []byte{}
+			return []byte{}, nil
 		}))
 	go func() {
 		repService.Start()
 	}()
+	defer repService.Close()
 
-	req.Send([]byte{1}, 0)
-	time.Sleep(100 * time.Millisecond)
+	request(t, "mem://only-last-handler", []byte{1})
 	assert.Equal(t, calledFirst, false, "First handler should be owerwritten")
 	assert.Equal(t, calledSecond, true)
+}
+
+// blockingHandler signals on started when it is called and replies only after
+// release is closed.
+func blockingHandler(started chan<- struct{}, release <-chan struct{}) nnservice.MessageHandler {
+	return nnservice.MessageHandlerFunc(func(header *nnservice.Header, data []byte) ([]byte, error) {
+		started <- struct{}{}
+		<-release
+		return []byte{1}, nil
+	})
+}
+
+func TestSlowHandlerDoesNotBlockOtherRequests(t *testing.T) {
+	repService := nnservice.NewRepService("mem://slow-handler")
+	repService.Workers = 2
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	repService.AddHandler(1, blockingHandler(started, release))
+	repService.AddHandler(2,
+		nnservice.MessageHandlerFunc(func(header *nnservice.Header, data []byte) ([]byte, error) {
+			return []byte{2}, nil
+		}))
+	go func() {
+		repService.Start()
+	}()
 	defer repService.Close()
+
+	slowReply := make(chan []byte, 1)
+	go func() {
+		slowReply <- request(t, "mem://slow-handler", []byte{1})
+	}()
+	<-started
+	assert.Equal(t, []byte{2}, request(t, "mem://slow-handler", []byte{2}))
+	close(release)
+	assert.Equal(t, []byte{1}, <-slowReply)
+}
+
+func TestStopWaitsForRequestsInProgress(t *testing.T) {
+	repService := nnservice.NewRepService("mem://stop-waits")
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	repService.AddHandler(1, blockingHandler(started, release))
+	startErr := make(chan error, 1)
+	go func() {
+		startErr <- repService.Start()
+	}()
+
+	reply := make(chan []byte, 1)
+	go func() {
+		reply <- request(t, "mem://stop-waits", []byte{1})
+	}()
+	<-started
+	stopErr := make(chan error, 1)
+	go func() {
+		stopErr <- repService.Stop(time.Second)
+	}()
+	select {
+	case <-stopErr:
+		t.Fatal("Stop should wait for the request in progress")
+	default:
+	}
+	close(release)
+	assert.Equal(t, []byte{1}, <-reply)
+	assert.Nil(t, <-stopErr)
+	assert.Nil(t, <-startErr)
+}
+
+func TestStopTimesOutWhenRequestTakesTooLong(t *testing.T) {
+	repService := nnservice.NewRepService("mem://stop-times-out")
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	repService.AddHandler(1, blockingHandler(started, release))
+	go func() {
+		repService.Start()
+	}()
+
+	go func() {
+		request(t, "mem://stop-times-out", []byte{1})
+	}()
+	<-started
+	err := repService.Stop(10 * time.Millisecond)
+	assert.Equal(t, nnservice.ErrStopTimeout, err)
+}
+
+func TestUnknownMessageTypeGetsErrorReply(t *testing.T) {
+	repService := nnservice.NewRepService("mem://unknown-message")
+	go func() {
+		repService.Start()
+	}()
+	defer repService.Close()
+
+	reply := request(t, "mem://unknown-message", []byte{1})
+	e, err := nnservice.DecodeErrorReply(reply)
+	assert.Nil(t, err)
+	assert.Equal(t, nnservice.ErrorCodeUnknownMessage, e.Code)
+}
+
+func TestEmptyMessageGetsErrorReply(t *testing.T) {
+	repService := nnservice.NewRepService("mem://empty-message")
+	go func() {
+		repService.Start()
+	}()
+	defer repService.Close()
+
+	reply := request(t, "mem://empty-message", []byte{})
+	e, err := nnservice.DecodeErrorReply(reply)
+	assert.Nil(t, err)
+	assert.Equal(t, nnservice.ErrorCodeEmptyMessage, e.Code)
+}
+
+func TestDispatchedRequestIsTracedWithRequestId(t *testing.T) {
+	repService := nnservice.NewRepService("mem://traced-request")
+	spans := []*trace.Span{}
+	repService.AddHandler(1,
+		nnservice.MessageHandlerFunc(func(header *nnservice.Header, data []byte) ([]byte, error) {
+			spans = append(spans, header.Span)
+			return []byte{}, nil
+		}))
+
+	traceId := "0123456789abcdef0123456789abcdef"
+	header := &nnservice.Header{MessageId: 1, RequestId: "request"}
+	header.Set(nnservice.HeaderTraceId, traceId)
+	repService.Dispatch(header, []byte{})
+	repService.Dispatch(&nnservice.Header{MessageId: 1}, []byte{})
+
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "request", spans[0].RequestId)
+	assert.Equal(t, traceId, spans[0].TraceId)
+	assert.NotEmpty(t, spans[1].RequestId)
+	assert.NotEqual(t, traceId, spans[1].TraceId)
+	assert.Nil(t, header.Span)
 }
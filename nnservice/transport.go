@@ -0,0 +1,56 @@
+package nnservice
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrTimeout = errors.New("transport: timeout")
+
+// Transport carries requests from clients to a RepService and the replies back.
+type Transport interface {
+	// Listen starts accepting requests on the address.
+	Listen(address string) (Listener, error)
+	// Dial creates a connection for sending requests to the address.
+	Dial(address string) (Conn, error)
+}
+
+// Listener accepts requests and distributes them between its receivers.
+type Listener interface {
+	// NewReceiver creates a receiver for a worker.
+	NewReceiver() (Receiver, error)
+	// Serve forwards requests to the receivers and blocks until the listener
+	// is closed.
+	Serve() error
+	Close() error
+}
+
+// Receiver receives requests one at a time. Every received request must be
+// replied to before the next one is received.
+type Receiver interface {
+	// Receive waits at most timeout for a request and returns ErrTimeout if
+	// there was none.
+	Receive(timeout time.Duration) ([]byte, error)
+	// Reply sends the reply to the last received request.
+	Reply(data []byte) error
+	Close() error
+}
+
+// Conn sends requests one at a time.
+type Conn interface {
+	// Request sends the request and waits at most timeout for the reply.
+	// ErrTimeout is returned if the reply did not arrive in time.
+	Request(data []byte, timeout time.Duration) ([]byte, error)
+	Close() error
+}
+
+// transportFor returns the transport for the address scheme. Addresses starting
+// with mem:// use the in-memory transport and all the other addresses
+// (tcp://, ipc://, inproc://) use nanomsg.
+func transportFor(address string) Transport {
+	if strings.HasPrefix(address, memoryScheme) {
+		return MemoryTransport
+	}
+	return &NanomsgTransport{}
+}
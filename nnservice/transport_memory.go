@@ -0,0 +1,160 @@
+package nnservice
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	memoryScheme = "mem://"
+	// Maximum number of requests waiting for a receiver on every address.
+	memoryQueueSize = 128
+)
+
+var errListenerClosed = errors.New("memoryTransport: listener_closed")
+
+// MemoryTransport is an in-process Transport that passes requests through Go
+// channels. It is used for addresses starting with mem:// and makes it
+// possible to test services end-to-end without binding ports.
+var MemoryTransport Transport = &memoryTransport{
+	endpoints: make(map[string]*memoryEndpoint),
+}
+
+type memoryTransport struct {
+	mu        sync.Mutex
+	endpoints map[string]*memoryEndpoint
+}
+
+// memoryEndpoint is shared between the listener and connections for the same
+// address. Requests can be sent before the listener is bound and are received
+// when it starts, like with nanomsg.
+type memoryEndpoint struct {
+	requests chan *memoryRequest
+	bound    bool
+}
+
+type memoryRequest struct {
+	data  []byte
+	reply chan []byte
+}
+
+func (t *memoryTransport) endpoint(address string) *memoryEndpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	endpoint, ok := t.endpoints[address]
+	if !ok {
+		endpoint = &memoryEndpoint{
+			requests: make(chan *memoryRequest, memoryQueueSize),
+		}
+		t.endpoints[address] = endpoint
+	}
+	return endpoint
+}
+
+func (t *memoryTransport) Listen(address string) (Listener, error) {
+	endpoint := t.endpoint(address)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if endpoint.bound {
+		return nil, fmt.Errorf("Address already in use: %s", address)
+	}
+	endpoint.bound = true
+	return &memoryListener{
+		transport: t,
+		endpoint:  endpoint,
+		closed:    make(chan struct{}),
+	}, nil
+}
+
+func (t *memoryTransport) Dial(address string) (Conn, error) {
+	return &memoryConn{endpoint: t.endpoint(address)}, nil
+}
+
+type memoryListener struct {
+	transport *memoryTransport
+	endpoint  *memoryEndpoint
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) NewReceiver() (Receiver, error) {
+	return &memoryReceiver{listener: l}, nil
+}
+
+func (l *memoryListener) Serve() error {
+	<-l.closed
+	return nil
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.transport.mu.Lock()
+		l.endpoint.bound = false
+		l.transport.mu.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+type memoryReceiver struct {
+	listener *memoryListener
+	current  *memoryRequest
+}
+
+func (r *memoryReceiver) Receive(timeout time.Duration) ([]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case request := <-r.listener.endpoint.requests:
+		r.current = request
+		return request.data, nil
+	case <-r.listener.closed:
+		return nil, errListenerClosed
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
+
+func (r *memoryReceiver) Reply(data []byte) error {
+	if r.current == nil {
+		return errors.New("No request to reply to")
+	}
+	// Reply channel is buffered so a requester that gave up does not block.
+	r.current.reply <- append([]byte(nil), data...)
+	r.current = nil
+	return nil
+}
+
+func (r *memoryReceiver) Close() error {
+	return nil
+}
+
+type memoryConn struct {
+	endpoint *memoryEndpoint
+}
+
+func (c *memoryConn) Request(data []byte, timeout time.Duration) ([]byte, error) {
+	request := &memoryRequest{
+		data:  append([]byte(nil), data...),
+		reply: make(chan []byte, 1),
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case c.endpoint.requests <- request:
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+	select {
+	case replyData := <-request.reply:
+		return replyData, nil
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
+
+func (c *memoryConn) Close() error {
+	return nil
+}
@@ -0,0 +1,176 @@
+package nnservice
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	nmsg "github.com/op/go-nanomsg"
+)
+
+// Used to give every listener its own inproc address for the workers.
+var workerAddressCounter uint64
+
+// NanomsgTransport is a Transport using nanomsg sockets.
+type NanomsgTransport struct {
+	// QueueSize is the size in bytes of the queue of pending requests kept for
+	// every receiver. When all the queues are full requests wait in the frontend
+	// socket. Default nanomsg buffer size is used when zero.
+	QueueSize int64
+}
+
+// Listen binds a raw REP socket to the address. Requests are forwarded to
+// the receivers with a nanomsg device so that replies are routed back to the
+// requester that sent the request.
+func (t *NanomsgTransport) Listen(address string) (Listener, error) {
+	frontend, err := nmsg.NewSocket(nmsg.AF_SP_RAW, nmsg.REP)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating response socket: %s", err)
+	}
+	endpoint, err := frontend.Bind(address)
+	if err != nil {
+		frontend.Close()
+		return nil, fmt.Errorf("Error binding socket: %s", err)
+	}
+	log.Printf("Bound to endpoint: %s", endpoint.Address)
+
+	backend, err := nmsg.NewSocket(nmsg.AF_SP_RAW, nmsg.REQ)
+	if err != nil {
+		frontend.Close()
+		return nil, fmt.Errorf("Error creating worker socket: %s", err)
+	}
+	workerAddress := fmt.Sprintf("inproc://repservice-workers-%d",
+		atomic.AddUint64(&workerAddressCounter, 1))
+	_, err = backend.Bind(workerAddress)
+	if err != nil {
+		frontend.Close()
+		backend.Close()
+		return nil, fmt.Errorf("Error binding worker socket: %s", err)
+	}
+	return &nanomsgListener{
+		frontend:      frontend,
+		backend:       backend,
+		workerAddress: workerAddress,
+		queueSize:     t.QueueSize,
+	}, nil
+}
+
+func (t *NanomsgTransport) Dial(address string) (Conn, error) {
+	socket, err := nmsg.NewReqSocket()
+	if err != nil {
+		return nil, fmt.Errorf("Error creating request socket: %s", err)
+	}
+	_, err = socket.Connect(address)
+	if err != nil {
+		socket.Close()
+		return nil, fmt.Errorf("Error connecting to %s: %s", address, err)
+	}
+	return &nanomsgConn{socket: socket}, nil
+}
+
+type nanomsgListener struct {
+	frontend      *nmsg.Socket
+	backend       *nmsg.Socket
+	workerAddress string
+	queueSize     int64
+}
+
+func (l *nanomsgListener) NewReceiver() (Receiver, error) {
+	socket, err := nmsg.NewRepSocket()
+	if err != nil {
+		return nil, err
+	}
+	if l.queueSize > 0 {
+		err = socket.SetRecvBuffer(l.queueSize)
+		if err != nil {
+			socket.Close()
+			return nil, err
+		}
+	}
+	_, err = socket.Connect(l.workerAddress)
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+	return &nanomsgReceiver{socket: socket}, nil
+}
+
+func (l *nanomsgListener) Serve() error {
+	return nmsg.Device(l.frontend, l.backend)
+}
+
+func (l *nanomsgListener) Close() error {
+	err := l.frontend.Close()
+	if backendErr := l.backend.Close(); err == nil {
+		err = backendErr
+	}
+	return err
+}
+
+type nanomsgReceiver struct {
+	socket  *nmsg.RepSocket
+	timeout time.Duration
+}
+
+func (r *nanomsgReceiver) Receive(timeout time.Duration) ([]byte, error) {
+	if timeout != r.timeout {
+		err := r.socket.SetRecvTimeout(timeout)
+		if err != nil {
+			return nil, err
+		}
+		r.timeout = timeout
+	}
+	data, err := r.socket.Recv(0)
+	if err != nil {
+		return nil, nanomsgError(err)
+	}
+	return data, nil
+}
+
+func (r *nanomsgReceiver) Reply(data []byte) error {
+	_, err := r.socket.Send(data, 0)
+	return err
+}
+
+func (r *nanomsgReceiver) Close() error {
+	return r.socket.Close()
+}
+
+type nanomsgConn struct {
+	socket *nmsg.ReqSocket
+}
+
+func (c *nanomsgConn) Request(data []byte, timeout time.Duration) ([]byte, error) {
+	err := c.socket.SetSendTimeout(timeout)
+	if err != nil {
+		return nil, err
+	}
+	err = c.socket.SetRecvTimeout(timeout)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.socket.Send(data, 0)
+	if err != nil {
+		return nil, nanomsgError(err)
+	}
+	replyData, err := c.socket.Recv(0)
+	if err != nil {
+		return nil, nanomsgError(err)
+	}
+	return replyData, nil
+}
+
+func (c *nanomsgConn) Close() error {
+	return c.socket.Close()
+}
+
+// nanomsgError converts nanomsg timeouts to ErrTimeout.
+func nanomsgError(err error) error {
+	errno, ok := err.(syscall.Errno)
+	if ok && (errno == syscall.ETIMEDOUT || errno == syscall.EAGAIN) {
+		return ErrTimeout
+	}
+	return err
+}
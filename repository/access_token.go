@@ -3,16 +3,20 @@ package repository
 import (
 	"github.com/opentarock/service-api/go/proto_oauth2"
 	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/events"
 )
 
+// Events passed to the methods that change tokens are recorded in the same
+// transaction as the change.
 type AccessTokenRepository interface {
 	Save(
 		user *proto_user.User,
 		client *proto_oauth2.Client,
 		accessToken *proto_oauth2.AccessToken,
-		parentToken *proto_oauth2.AccessToken) error
+		parentToken *proto_oauth2.AccessToken,
+		newEvents ...*events.Event) error
 
-	DeleteParents(accessToken *AccessTokenRaw) error
+	DeleteParents(accessToken *AccessTokenRaw, newEvents ...*events.Event) error
 
 	FindByTokenRaw(accessTokenRaw string) (*AccessTokenRaw, error)
 	FindUserForToken(accessToken *proto_oauth2.AccessToken) (*proto_user.User, error)
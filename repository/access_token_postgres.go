@@ -7,6 +7,7 @@ import (
 
 	"github.com/opentarock/service-api/go/proto_oauth2"
 	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/events"
 	"github.com/opentarock/service-user-management/util"
 )
 
@@ -65,6 +66,8 @@ func NewAccessTokenRepositoryPostgres(db *sql.DB) *accessTokenRepositoryPostgres
 	     DELETE FROM access_tokens
 	     WHERE access_token IN (SELECT access_token FROM parent_tokens);`)
 
+	util.Prepare(db, repo.statements, "insert_outbox_event", insertOutboxEventQuery)
+
 	return repo
 }
 
@@ -72,14 +75,19 @@ func (r *accessTokenRepositoryPostgres) Save(
 	user *proto_user.User,
 	client *proto_oauth2.Client,
 	accessToken *proto_oauth2.AccessToken,
-	parentToken *proto_oauth2.AccessToken) error {
+	parentToken *proto_oauth2.AccessToken,
+	newEvents ...*events.Event) error {
 
 	expiresOn := time.Now().Add(time.Duration(accessToken.GetExpiresIn()) * time.Second)
 	var parentTokenId interface{}
 	if parentToken != nil {
 		parentTokenId = parentToken.GetAccessToken()
 	}
-	_, err := util.Exec(r.statements, "save_access_token",
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Stmt(r.statements["save_access_token"]).Exec(
 		accessToken.GetAccessToken(),
 		client.GetId(), user.GetId(),
 		accessToken.GetTokenType(),
@@ -87,11 +95,21 @@ func (r *accessTokenRepositoryPostgres) Save(
 		expiresOn,
 		accessToken.RefreshToken,
 		parentTokenId)
-	return err
+	if err != nil {
+		return tryRollback(tx, err)
+	}
+	err = recordEvents(tx, r.statements["insert_outbox_event"], newEvents)
+	if err != nil {
+		return tryRollback(tx, err)
+	}
+	return tx.Commit()
 }
 
-func (r *accessTokenRepositoryPostgres) DeleteParents(accessToken *AccessTokenRaw) error {
+func (r *accessTokenRepositoryPostgres) DeleteParents(accessToken *AccessTokenRaw, newEvents ...*events.Event) error {
 	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
 	clearTokenParentStmt := tx.Stmt(r.statements["clear_token_parent"])
 	_, err = clearTokenParentStmt.Exec(accessToken.Token.GetAccessToken())
 	if err != nil {
@@ -102,6 +120,10 @@ func (r *accessTokenRepositoryPostgres) DeleteParents(accessToken *AccessTokenRa
 	if err != nil {
 		return tryRollback(tx, err)
 	}
+	err = recordEvents(tx, r.statements["insert_outbox_event"], newEvents)
+	if err != nil {
+		return tryRollback(tx, err)
+	}
 	err = tx.Commit()
 	if err != nil {
 		return err
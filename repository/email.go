@@ -0,0 +1,24 @@
+package repository
+
+import (
+	"strings"
+
+	"code.google.com/p/go.net/idna"
+)
+
+// NormalizeEmail returns the form of the email address used to compare
+// addresses. Addresses are compared case-insensitively and internationalized
+// domains are converted to their ASCII form, so that both forms of a domain
+// are the same address. Domains that can not be converted are only lowercased.
+func NormalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	domain, err := idna.ToASCII(email[at+1:])
+	if err != nil {
+		return email
+	}
+	return email[:at+1] + domain
+}
@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"database/sql"
+	"sort"
+)
+
+// DuplicateEmail is a normalized email address used by more than one user.
+type DuplicateEmail struct {
+	EmailNormalized string
+	Users           []*DuplicateEmailUser
+}
+
+type DuplicateEmailUser struct {
+	Id    uint64
+	Email string
+}
+
+// FindDuplicateEmails returns the email addresses that are registered more than
+// once when compared by NormalizeEmail, which are the ones that can not be
+// stored in the unique normalized email column. Addresses are normalized here
+// and not in SQL, so that the result matches the addresses the service
+// stores.
+func FindDuplicateEmails(db *sql.DB) ([]*DuplicateEmail, error) {
+	rows, err := db.Query(`SELECT id, email FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byEmail := make(map[string]*DuplicateEmail)
+	for rows.Next() {
+		user := &DuplicateEmailUser{}
+		err := rows.Scan(&user.Id, &user.Email)
+		if err != nil {
+			return nil, err
+		}
+		emailNormalized := NormalizeEmail(user.Email)
+		duplicate, ok := byEmail[emailNormalized]
+		if !ok {
+			duplicate = &DuplicateEmail{EmailNormalized: emailNormalized}
+			byEmail[emailNormalized] = duplicate
+		}
+		duplicate.Users = append(duplicate.Users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	duplicates := make([]*DuplicateEmail, 0)
+	for _, duplicate := range byEmail {
+		if len(duplicate.Users) > 1 {
+			duplicates = append(duplicates, duplicate)
+		}
+	}
+	sort.Sort(byEmailNormalized(duplicates))
+	return duplicates, nil
+}
+
+type byEmailNormalized []*DuplicateEmail
+
+func (d byEmailNormalized) Len() int           { return len(d) }
+func (d byEmailNormalized) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d byEmailNormalized) Less(i, j int) bool { return d[i].EmailNormalized < d[j].EmailNormalized }
+
+// BackfillNormalizedEmails stores the normalized email address of the users
+// whose address was normalized differently, e.g. by the migration that adds
+// the column, which does not convert internationalized domains to the ASCII
+// form, and returns the number of updated users. It fails without changes if the
+// addresses contain duplicates, see FindDuplicateEmails.
+func BackfillNormalizedEmails(db *sql.DB) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(`SELECT id, email, email_normalized FROM users`)
+	if err != nil {
+		return 0, tryRollback(tx, err)
+	}
+	updates := make(map[uint64]string)
+	for rows.Next() {
+		var id uint64
+		var email string
+		var emailNormalized string
+		if err := rows.Scan(&id, &email, &emailNormalized); err != nil {
+			rows.Close()
+			return 0, tryRollback(tx, err)
+		}
+		if normalized := NormalizeEmail(email); emailNormalized != normalized {
+			updates[id] = normalized
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, tryRollback(tx, err)
+	}
+
+	// Addresses are replaced by placeholders that are not email addresses
+	// first, so that swapped addresses of two users do not violate the unique
+	// index.
+	for id := range updates {
+		_, err := tx.Exec(`UPDATE users SET email_normalized = '#' || id WHERE id = $1`, id)
+		if err != nil {
+			return 0, tryRollback(tx, err)
+		}
+	}
+	for id, emailNormalized := range updates {
+		_, err := tx.Exec(`UPDATE users SET email_normalized = $2 WHERE id = $1`, id, emailNormalized)
+		if err != nil {
+			return 0, tryRollback(tx, err)
+		}
+	}
+	return len(updates), tx.Commit()
+}
@@ -0,0 +1,20 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailIsNormalized(t *testing.T) {
+	for email, normalized := range map[string]string{
+		" Mail@Example.com ":    "mail@example.com",
+		"user@bücher.de":        "user@xn--bcher-kva.de",
+		"User@BÜCHER.de":        "user@xn--bcher-kva.de",
+		"user@xn--bcher-kva.de": "user@xn--bcher-kva.de",
+		"\"a@b\"@example.com":   "\"a@b\"@example.com",
+		"not an address":        "not an address",
+	} {
+		assert.Equal(t, normalized, NormalizeEmail(email), email)
+	}
+}
@@ -0,0 +1,27 @@
+package repository
+
+import "time"
+
+// EmailVerification is a pending verification of the email address of a user.
+type EmailVerification struct {
+	// TokenHash is the hash of the token sent to the user, see util.HashToken.
+	TokenHash string
+	UserId    uint64
+	Email     string
+	CreatedOn time.Time
+	ExpiresOn time.Time
+}
+
+// EmailVerificationRepository keeps pending email verifications and the
+// verified status of users. Expired verifications are never used.
+type EmailVerificationRepository interface {
+	Save(verification *EmailVerification) error
+	// Verify marks the email address of the verification as verified, deletes
+	// all pending verifications of the user and records the EmailVerified
+	// event. It returns sql.ErrNoRows if the verification does not exist, is
+	// expired or the user changed the email address since.
+	Verify(tokenHash string) (*EmailVerification, error)
+	// IsVerified reports whether the user verified the email address. It
+	// returns sql.ErrNoRows if the user does not exist.
+	IsVerified(userId uint64) (bool, error)
+}
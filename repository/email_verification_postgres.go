@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/opentarock/service-user-management/events"
+	"github.com/opentarock/service-user-management/util"
+)
+
+type emailVerificationRepositoryPostgres struct {
+	db         *sql.DB
+	statements map[string]*sql.Stmt
+}
+
+func NewEmailVerificationRepositoryPostgres(db *sql.DB) *emailVerificationRepositoryPostgres {
+	repo := &emailVerificationRepositoryPostgres{
+		db:         db,
+		statements: make(map[string]*sql.Stmt),
+	}
+	util.Prepare(db, repo.statements, "save_email_verification",
+		`INSERT INTO email_verifications (token_hash, user_id, email, created_on, expires_on)
+		 VALUES ($1, $2, $3, $4, $5)`)
+	util.Prepare(db, repo.statements, "take_email_verification",
+		`DELETE FROM email_verifications
+		 WHERE token_hash = $1 AND expires_on > NOW()
+		 RETURNING user_id, email, created_on, expires_on`)
+	// Address is verified only if the user did not change it since the
+	// verification was created.
+	util.Prepare(db, repo.statements, "set_email_verified",
+		`UPDATE users
+		 SET email_verified = TRUE
+		 WHERE id = $1 AND email_normalized = $2`)
+	util.Prepare(db, repo.statements, "delete_email_verifications",
+		`DELETE FROM email_verifications
+		 WHERE user_id = $1`)
+	util.Prepare(db, repo.statements, "is_email_verified",
+		`SELECT email_verified
+		 FROM users
+		 WHERE id = $1`)
+	util.Prepare(db, repo.statements, "insert_outbox_event", insertOutboxEventQuery)
+	return repo
+}
+
+func (r *emailVerificationRepositoryPostgres) Save(verification *EmailVerification) error {
+	_, err := util.Exec(r.statements, "save_email_verification",
+		verification.TokenHash,
+		verification.UserId,
+		verification.Email,
+		verification.CreatedOn,
+		verification.ExpiresOn)
+	return err
+}
+
+func (r *emailVerificationRepositoryPostgres) Verify(tokenHash string) (*EmailVerification, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	verification := &EmailVerification{TokenHash: tokenHash}
+	err = tx.Stmt(r.statements["take_email_verification"]).QueryRow(tokenHash).Scan(
+		&verification.UserId, &verification.Email, &verification.CreatedOn, &verification.ExpiresOn)
+	if err != nil {
+		return nil, tryRollback(tx, err)
+	}
+	result, err := tx.Stmt(r.statements["set_email_verified"]).Exec(
+		verification.UserId, NormalizeEmail(verification.Email))
+	if err != nil {
+		return nil, tryRollback(tx, err)
+	}
+	verified, err := result.RowsAffected()
+	if err != nil {
+		return nil, tryRollback(tx, err)
+	}
+	// Other verifications are not needed anymore, either because the address
+	// is verified or because they are for a previous address.
+	_, err = tx.Stmt(r.statements["delete_email_verifications"]).Exec(verification.UserId)
+	if err != nil {
+		return nil, tryRollback(tx, err)
+	}
+	if verified != 0 {
+		err = recordEvents(tx, r.statements["insert_outbox_event"], []*events.Event{
+			events.NewEmailVerified(verification.UserId, verification.Email),
+		})
+		if err != nil {
+			return nil, tryRollback(tx, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if verified == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return verification, nil
+}
+
+func (r *emailVerificationRepositoryPostgres) IsVerified(userId uint64) (bool, error) {
+	var verified bool
+	err := util.QueryRow(r.statements, "is_email_verified", userId).Scan(&verified)
+	return verified, err
+}
+
+func (r *emailVerificationRepositoryPostgres) Close() {
+	for name, stmt := range r.statements {
+		err := stmt.Close()
+		if err != nil {
+			log.Printf("Error closing statement '%s': %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/opentarock/service-user-management/util"
+)
+
+var ErrNoMigrations = errors.New("databaseHealthCheck: no_migrations")
+
+type databaseHealthCheck struct {
+	db         *sql.DB
+	statements map[string]*sql.Stmt
+}
+
+// NewDatabaseHealthCheck returns a health check that checks the connection to
+// the database and reports the version of the applied migrations.
+func NewDatabaseHealthCheck(db *sql.DB) *databaseHealthCheck {
+	check := &databaseHealthCheck{
+		db:         db,
+		statements: make(map[string]*sql.Stmt),
+	}
+	util.Prepare(db, check.statements, "find_migrations",
+		`SELECT version_id, is_applied
+		 FROM goose_db_version
+		 ORDER BY id DESC`)
+	return check
+}
+
+func (c *databaseHealthCheck) Check() (string, error) {
+	err := c.db.Ping()
+	if err != nil {
+		return "", err
+	}
+	version, err := c.MigrationVersion()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("migration version %d", version), nil
+}
+
+// MigrationVersion returns the version of the last applied migration. Rows
+// of migrations that were rolled back are skipped the same way as goose does.
+func (c *databaseHealthCheck) MigrationVersion() (int64, error) {
+	rows, err := util.Query(c.statements, "find_migrations")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	rolledBack := make(map[int64]bool)
+	for rows.Next() {
+		var version int64
+		var applied bool
+		err := rows.Scan(&version, &applied)
+		if err != nil {
+			return 0, err
+		}
+		if rolledBack[version] {
+			continue
+		}
+		if applied {
+			return version, nil
+		}
+		rolledBack[version] = true
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return 0, ErrNoMigrations
+}
+
+func (c *databaseHealthCheck) Close() {
+	for name, stmt := range c.statements {
+		err := stmt.Close()
+		if err != nil {
+			log.Printf("Error closing statement '%s': %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package repository
+
+import "time"
+
+// LoginAttempts are the consecutive failed logins of an account or of a source
+// of requests.
+type LoginAttempts struct {
+	Key           string
+	Failures      int
+	LastFailureOn time.Time
+}
+
+// AccountLoginKey returns the key of the failed logins of the account with the
+// email address.
+func AccountLoginKey(email string) string {
+	return "account:" + NormalizeEmail(email)
+}
+
+// SourceLoginKey returns the key of the failed logins from the source, e.g. the
+// address of the client.
+func SourceLoginKey(source string) string {
+	return "source:" + source
+}
+
+// LoginAttemptRepository keeps the failed logins.
+type LoginAttemptRepository interface {
+	// Find returns sql.ErrNoRows if there were no failed logins for the key.
+	Find(key string) (*LoginAttempts, error)
+	// RecordFailure counts a failed login at the given time and returns the
+	// updated attempts. Failures are counted from one again if the last
+	// failure was before since.
+	RecordFailure(key string, at, since time.Time) (*LoginAttempts, error)
+	// Reset forgets the failed logins and reports whether there were any.
+	Reset(key string) (bool, error)
+}
@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/opentarock/service-user-management/util"
+)
+
+type loginAttemptRepositoryPostgres struct {
+	db         *sql.DB
+	statements map[string]*sql.Stmt
+}
+
+// NewLoginAttemptRepositoryPostgres returns a repository that keeps the failed
+// logins in the database so they are shared by all the instances of the
+// service.
+func NewLoginAttemptRepositoryPostgres(db *sql.DB) *loginAttemptRepositoryPostgres {
+	repo := &loginAttemptRepositoryPostgres{
+		db:         db,
+		statements: make(map[string]*sql.Stmt),
+	}
+	util.Prepare(db, repo.statements, "find_login_attempts",
+		`SELECT failures, last_failure_on
+		 FROM login_attempts
+		 WHERE key = $1`)
+	// Failures are counted in a single statement so concurrent failures are
+	// all counted.
+	util.Prepare(db, repo.statements, "record_login_failure",
+		`UPDATE login_attempts
+		 SET failures = CASE WHEN last_failure_on < $3 THEN 1 ELSE failures + 1 END,
+		     last_failure_on = $2
+		 WHERE key = $1
+		 RETURNING failures, last_failure_on`)
+	util.Prepare(db, repo.statements, "insert_login_attempts",
+		`INSERT INTO login_attempts (key, failures, last_failure_on)
+		 SELECT $1::text, 1, $2
+		 WHERE NOT EXISTS (SELECT 1 FROM login_attempts WHERE key = $1::text)
+		 RETURNING failures, last_failure_on`)
+	util.Prepare(db, repo.statements, "reset_login_attempts",
+		`DELETE FROM login_attempts
+		 WHERE key = $1`)
+	return repo
+}
+
+func (r *loginAttemptRepositoryPostgres) Find(key string) (*LoginAttempts, error) {
+	attempts := &LoginAttempts{Key: key}
+	err := util.QueryRow(r.statements, "find_login_attempts", key).Scan(
+		&attempts.Failures, &attempts.LastFailureOn)
+	if err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+func (r *loginAttemptRepositoryPostgres) RecordFailure(key string, at, since time.Time) (*LoginAttempts, error) {
+	// The column has no time zone and is read back as UTC, so times are
+	// written in UTC whatever the time zone of the host is.
+	at, since = at.UTC(), since.UTC()
+	attempts := &LoginAttempts{Key: key}
+	err := util.QueryRow(r.statements, "record_login_failure", key, at, since).Scan(
+		&attempts.Failures, &attempts.LastFailureOn)
+	if err == nil {
+		return attempts, nil
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+	// First failure for the key.
+	err = util.QueryRow(r.statements, "insert_login_attempts", key, at).Scan(
+		&attempts.Failures, &attempts.LastFailureOn)
+	if pqErr, ok := err.(*pq.Error); (ok && pqErr.Code == uniqueViolation) || err == sql.ErrNoRows {
+		// Failure was recorded by a concurrent request.
+		err = util.QueryRow(r.statements, "record_login_failure", key, at, since).Scan(
+			&attempts.Failures, &attempts.LastFailureOn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+func (r *loginAttemptRepositoryPostgres) Reset(key string) (bool, error) {
+	result, err := util.Exec(r.statements, "reset_login_attempts", key)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return deleted > 0, nil
+}
+
+func (r *loginAttemptRepositoryPostgres) Close() {
+	for name, stmt := range r.statements {
+		err := stmt.Close()
+		if err != nil {
+			log.Printf("Error closing statement '%s': %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package repository
+
+import "github.com/opentarock/service-user-management/events"
+
+type OutboxRepository interface {
+	events.Outbox
+	// Add records events that are not part of any other change.
+	Add(events ...*events.Event) error
+}
@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/opentarock/service-user-management/events"
+	"github.com/opentarock/service-user-management/util"
+)
+
+// Query used by all the repositories to record events in the same transaction
+// as the change that caused them.
+const insertOutboxEventQuery = `INSERT INTO event_outbox (topic, envelope)
+	VALUES ($1, $2)`
+
+type outboxRepositoryPostgres struct {
+	db         *sql.DB
+	statements map[string]*sql.Stmt
+}
+
+func NewOutboxRepositoryPostgres(db *sql.DB) *outboxRepositoryPostgres {
+	repo := &outboxRepositoryPostgres{
+		db:         db,
+		statements: make(map[string]*sql.Stmt),
+	}
+	util.Prepare(db, repo.statements, "insert_outbox_event", insertOutboxEventQuery)
+	util.Prepare(db, repo.statements, "find_pending_events",
+		`SELECT id, topic, envelope
+		 FROM event_outbox
+		 ORDER BY id
+		 LIMIT $1`)
+	util.Prepare(db, repo.statements, "delete_event",
+		`DELETE FROM event_outbox
+		 WHERE id = $1`)
+	return repo
+}
+
+func (r *outboxRepositoryPostgres) Add(newEvents ...*events.Event) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = recordEvents(tx, r.statements["insert_outbox_event"], newEvents)
+	if err != nil {
+		return tryRollback(tx, err)
+	}
+	return tx.Commit()
+}
+
+func (r *outboxRepositoryPostgres) Pending(limit int) ([]*events.OutboxEvent, error) {
+	rows, err := util.Query(r.statements, "find_pending_events", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pending := make([]*events.OutboxEvent, 0)
+	for rows.Next() {
+		event := &events.OutboxEvent{}
+		err := rows.Scan(&event.Id, &event.Topic, &event.EnvelopeData)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, event)
+	}
+	return pending, rows.Err()
+}
+
+func (r *outboxRepositoryPostgres) Delete(id int64) error {
+	_, err := util.Exec(r.statements, "delete_event", id)
+	return err
+}
+
+func (r *outboxRepositoryPostgres) Close() {
+	for name, stmt := range r.statements {
+		err := stmt.Close()
+		if err != nil {
+			log.Printf("Error closing statement '%s': %s", name, err)
+		}
+	}
+}
+
+// recordEvents inserts the events into the outbox as part of the transaction.
+func recordEvents(tx *sql.Tx, insertStmt *sql.Stmt, newEvents []*events.Event) error {
+	if len(newEvents) == 0 {
+		return nil
+	}
+	stmt := tx.Stmt(insertStmt)
+	defer stmt.Close()
+	for _, event := range newEvents {
+		envelopeData, err := event.Encode()
+		if err != nil {
+			return err
+		}
+		_, err = stmt.Exec(event.Topic, envelopeData)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
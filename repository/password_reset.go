@@ -0,0 +1,33 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/opentarock/service-user-management/events"
+)
+
+// PasswordReset is a pending request of a user to set a new password.
+type PasswordReset struct {
+	// TokenHash is the hash of the token sent to the user, see util.HashToken.
+	TokenHash string
+	UserId    uint64
+	CreatedOn time.Time
+	ExpiresOn time.Time
+}
+
+// PasswordResetRepository keeps pending password resets. Expired resets are
+// never used.
+type PasswordResetRepository interface {
+	Save(reset *PasswordReset) error
+	// Find returns sql.ErrNoRows if the reset does not exist or is expired.
+	Find(tokenHash string) (*PasswordReset, error)
+	// CountPending returns the number of resets of the user that are not
+	// expired.
+	CountPending(userId uint64) (int, error)
+	// Reset sets the password of the user hashed with a new salt, deletes all
+	// pending resets, access tokens and sessions of the user and records the
+	// events in the same transaction, together with a token revoked event for
+	// every client of the deleted access tokens. It returns sql.ErrNoRows if the reset
+	// does not exist or is expired, so every reset can be used only once.
+	Reset(tokenHash, password string, newEvents ...*events.Event) (*PasswordReset, error)
+}
@@ -0,0 +1,162 @@
+package repository
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/opentarock/service-user-management/events"
+	"github.com/opentarock/service-user-management/util"
+)
+
+type passwordResetRepositoryPostgres struct {
+	db             *sql.DB
+	statements     map[string]*sql.Stmt
+	Hasher         util.PasswordHasher
+	TokenGenerator util.TokenGenerator
+}
+
+func NewPasswordResetRepositoryPostgres(db *sql.DB) *passwordResetRepositoryPostgres {
+	repo := &passwordResetRepositoryPostgres{
+		db:         db,
+		statements: make(map[string]*sql.Stmt),
+	}
+	util.Prepare(db, repo.statements, "save_password_reset",
+		`INSERT INTO password_resets (token_hash, user_id, created_on, expires_on)
+		 VALUES ($1, $2, $3, $4)`)
+	util.Prepare(db, repo.statements, "find_password_reset",
+		`SELECT user_id, created_on, expires_on
+		 FROM password_resets
+		 WHERE token_hash = $1 AND expires_on > NOW()`)
+	util.Prepare(db, repo.statements, "count_password_resets",
+		`SELECT COUNT(*)
+		 FROM password_resets
+		 WHERE user_id = $1 AND expires_on > NOW()`)
+	util.Prepare(db, repo.statements, "take_password_reset",
+		`DELETE FROM password_resets
+		 WHERE token_hash = $1 AND expires_on > NOW()
+		 RETURNING user_id, created_on, expires_on`)
+	util.Prepare(db, repo.statements, "set_password",
+		`UPDATE users
+		 SET password = $2, salt = $3
+		 WHERE id = $1`)
+	util.Prepare(db, repo.statements, "delete_password_resets",
+		`DELETE FROM password_resets
+		 WHERE user_id = $1`)
+	util.Prepare(db, repo.statements, "delete_user_access_tokens",
+		`DELETE FROM access_tokens
+		 WHERE user_id = $1
+		 RETURNING client_id`)
+	util.Prepare(db, repo.statements, "delete_user_sessions",
+		`DELETE FROM sessions
+		 WHERE user_id = $1`)
+	util.Prepare(db, repo.statements, "insert_outbox_event", insertOutboxEventQuery)
+
+	repo.Hasher = util.NewPBKDF2PasswordHasher()
+	repo.TokenGenerator = util.NewRandTokenGenerator()
+	return repo
+}
+
+func (r *passwordResetRepositoryPostgres) Save(reset *PasswordReset) error {
+	_, err := util.Exec(r.statements, "save_password_reset",
+		reset.TokenHash,
+		reset.UserId,
+		reset.CreatedOn,
+		reset.ExpiresOn)
+	return err
+}
+
+func (r *passwordResetRepositoryPostgres) Find(tokenHash string) (*PasswordReset, error) {
+	reset := &PasswordReset{TokenHash: tokenHash}
+	err := util.QueryRow(r.statements, "find_password_reset", tokenHash).Scan(
+		&reset.UserId, &reset.CreatedOn, &reset.ExpiresOn)
+	if err != nil {
+		return nil, err
+	}
+	return reset, nil
+}
+
+func (r *passwordResetRepositoryPostgres) CountPending(userId uint64) (int, error) {
+	var count int
+	err := util.QueryRow(r.statements, "count_password_resets", userId).Scan(&count)
+	return count, err
+}
+
+func (r *passwordResetRepositoryPostgres) Reset(
+	tokenHash, password string, newEvents ...*events.Event) (*PasswordReset, error) {
+
+	salt, err := r.TokenGenerator.GenerateHex(saltLength)
+	if err != nil {
+		return nil, err
+	}
+	passwordHash := encodePasswordHash(r.Hasher, password, salt)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	reset := &PasswordReset{TokenHash: tokenHash}
+	err = tx.Stmt(r.statements["take_password_reset"]).QueryRow(tokenHash).Scan(
+		&reset.UserId, &reset.CreatedOn, &reset.ExpiresOn)
+	if err != nil {
+		return nil, tryRollback(tx, err)
+	}
+	_, err = tx.Stmt(r.statements["set_password"]).Exec(reset.UserId, passwordHash, salt)
+	if err != nil {
+		return nil, tryRollback(tx, err)
+	}
+	// Anyone who knew the old password or took over a session is logged out.
+	for _, name := range []string{"delete_password_resets", "delete_user_sessions"} {
+		_, err = tx.Stmt(r.statements[name]).Exec(reset.UserId)
+		if err != nil {
+			return nil, tryRollback(tx, err)
+		}
+	}
+	clientIds, err := deleteUserAccessTokens(tx, r.statements["delete_user_access_tokens"], reset.UserId)
+	if err != nil {
+		return nil, tryRollback(tx, err)
+	}
+	for _, clientId := range clientIds {
+		newEvents = append(newEvents, events.NewTokenRevoked(reset.UserId, clientId))
+	}
+	err = recordEvents(tx, r.statements["insert_outbox_event"], newEvents)
+	if err != nil {
+		return nil, tryRollback(tx, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return reset, nil
+}
+
+// deleteUserAccessTokens deletes the access tokens of the user and returns the
+// ids of the clients they were issued to, every id once.
+func deleteUserAccessTokens(tx *sql.Tx, deleteStmt *sql.Stmt, userId uint64) ([]string, error) {
+	stmt := tx.Stmt(deleteStmt)
+	defer stmt.Close()
+	rows, err := stmt.Query(userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	clientIds := make([]string, 0)
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var clientId sql.NullString
+		if err := rows.Scan(&clientId); err != nil {
+			return nil, err
+		}
+		if !seen[clientId.String] {
+			seen[clientId.String] = true
+			clientIds = append(clientIds, clientId.String)
+		}
+	}
+	return clientIds, rows.Err()
+}
+
+func (r *passwordResetRepositoryPostgres) Close() {
+	for name, stmt := range r.statements {
+		err := stmt.Close()
+		if err != nil {
+			log.Printf("Error closing statement '%s': %s", name, err)
+		}
+	}
+}
@@ -5,12 +5,15 @@ import (
 	"fmt"
 	"os/exec"
 	"testing"
+	"time"
 
 	"code.google.com/p/gogoprotobuf/proto"
 	_ "github.com/lib/pq"
 
 	"github.com/opentarock/service-api/go/proto_oauth2"
 	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/events"
+	"github.com/opentarock/service-user-management/nnservice"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -106,6 +109,95 @@ func (s *PostgresRepositoryTestSuite) TestUserWithWrongPasswordIsNotFound() {
 	assert.NotNil(s.T(), err)
 }
 
+func (s *PostgresRepositoryTestSuite) TestEmailIsFoundCaseInsensitively() {
+	user := NewUser()
+	user.Email = proto.String(" Email@Example.com")
+	err := s.userRepository.Save(user)
+	assert.Nil(s.T(), err)
+	found, err := s.userRepository.FindByEmail("email@EXAMPLE.com")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), user.GetId(), found.GetId())
+	assert.Equal(s.T(), "Email@Example.com", found.GetEmail())
+}
+
+func (s *PostgresRepositoryTestSuite) TestEmailCanBeRegisteredOnlyOnce() {
+	err := s.userRepository.Save(NewUser())
+	assert.Nil(s.T(), err)
+	user := NewUser()
+	user.Email = proto.String("EMAIL@example.com")
+	err = s.userRepository.Save(user)
+	assert.Equal(s.T(), ErrEmailTaken, err)
+	assert.Nil(s.T(), user.Id)
+
+	duplicates, err := FindDuplicateEmails(s.db)
+	assert.Nil(s.T(), err)
+	assert.Empty(s.T(), duplicates)
+}
+
+func (s *PostgresRepositoryTestSuite) TestInternationalizedDomainIsTheSameAsItsASCIIForm() {
+	user := NewUser()
+	user.Email = proto.String("user@bücher.de")
+	err := s.userRepository.Save(user)
+	assert.Nil(s.T(), err)
+	found, err := s.userRepository.FindByEmail("user@xn--bcher-kva.de")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), user.GetId(), found.GetId())
+
+	user = NewUser()
+	user.Email = proto.String("user@xn--bcher-kva.de")
+	err = s.userRepository.Save(user)
+	assert.Equal(s.T(), ErrEmailTaken, err)
+}
+
+func (s *PostgresRepositoryTestSuite) TestNormalizedEmailsAreBackfilled() {
+	// Addresses as normalized by the migration.
+	insertUserQuery := `INSERT INTO users (display_name, email, email_normalized, password, salt)
+		VALUES ('name', $1, lower(trim($1)), 'password', 'salt')`
+	_, err := s.db.Exec(insertUserQuery, " Old@Example.com")
+	assert.Nil(s.T(), err)
+	_, err = s.userRepository.FindByEmail("old@example.com")
+	assert.Nil(s.T(), err)
+	_, err = s.db.Exec(insertUserQuery, "old@bücher.de")
+	assert.Nil(s.T(), err)
+	_, err = s.userRepository.FindByEmail("old@bücher.de")
+	assert.Equal(s.T(), sql.ErrNoRows, err)
+
+	updated, err := BackfillNormalizedEmails(s.db)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 1, updated)
+	_, err = s.userRepository.FindByEmail("old@bücher.de")
+	assert.Nil(s.T(), err)
+
+	_, err = s.db.Exec(insertUserQuery, "OLD@Bücher.de")
+	assert.Nil(s.T(), err)
+	duplicates, err := FindDuplicateEmails(s.db)
+	assert.Nil(s.T(), err)
+	if assert.Len(s.T(), duplicates, 1) {
+		assert.Equal(s.T(), "old@xn--bcher-kva.de", duplicates[0].EmailNormalized)
+		assert.Len(s.T(), duplicates[0].Users, 2)
+	}
+	_, err = BackfillNormalizedEmails(s.db)
+	assert.NotNil(s.T(), err)
+}
+
+func (s *PostgresRepositoryTestSuite) TestUnknownEmailIsIndistinguishableByTiming() {
+	user := NewUser()
+	err := s.userRepository.Save(user)
+	assert.Nil(s.T(), err)
+	assertIndistinguishableTiming(s.T(),
+		func() { s.userRepository.FindByEmailAndPassword("email@example.com", "wrong") },
+		func() { s.userRepository.FindByEmailAndPassword("unknown@example.com", "wrong") })
+}
+
+func (s *PostgresRepositoryTestSuite) TestUserIsFoundById() {
+	user := NewUser()
+	err := s.userRepository.Save(user)
+	assert.Nil(s.T(), err)
+	found, err := s.userRepository.FindById(user.GetId())
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), user.GetEmail(), found.GetEmail())
+}
+
 func (s *PostgresRepositoryTestSuite) TestClientIsSaved() {
 	user := NewUser()
 	s.userRepository.Save(user)
@@ -204,6 +296,376 @@ func (s *PostgresRepositoryTestSuite) TestCanRetrieveUserForAccessToken() {
 	assert.NotEmpty(s.T(), user.GetPassword())
 }
 
+func (s *PostgresRepositoryTestSuite) TestEventsAreRecordedWithUser() {
+	outbox := NewOutboxRepositoryPostgres(s.db)
+	defer outbox.Close()
+	user := NewUser()
+	err := s.userRepository.Save(user, events.NewUserRegistered(user))
+	assert.Nil(s.T(), err)
+
+	pending, err := outbox.Pending(10)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 1, len(pending))
+	assert.Equal(s.T(), events.TopicUserRegistered, pending[0].Topic)
+
+	err = outbox.Delete(pending[0].Id)
+	assert.Nil(s.T(), err)
+	pending, err = outbox.Pending(10)
+	assert.Nil(s.T(), err)
+	assert.Empty(s.T(), pending)
+}
+
+func (s *PostgresRepositoryTestSuite) TestRateLimiterSharesBucketsThroughDatabase() {
+	limit := nnservice.RateLimit{Rate: 0.0001, Burst: 2}
+	first := NewRateLimiterPostgres(s.db)
+	defer first.Close()
+	second := NewRateLimiterPostgres(s.db)
+	defer second.Close()
+
+	allowed, err := first.Allow("key", limit)
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), allowed)
+	allowed, err = second.Allow("key", limit)
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), allowed)
+	allowed, err = first.Allow("key", limit)
+	assert.Nil(s.T(), err)
+	assert.False(s.T(), allowed)
+	allowed, err = second.Allow("other", limit)
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), allowed)
+}
+
+func (s *PostgresRepositoryTestSuite) TestIdleRateLimitBucketsAreDeleted() {
+	limiter := NewRateLimiterPostgres(s.db)
+	defer limiter.Close()
+	limit := nnservice.RateLimit{Rate: 0.0001, Burst: 2}
+	_, err := limiter.Allow("key", limit)
+	assert.Nil(s.T(), err)
+
+	deleted, err := limiter.DeleteIdle(time.Hour)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), int64(0), deleted)
+	time.Sleep(10 * time.Millisecond)
+	deleted, err = limiter.DeleteIdle(time.Millisecond)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), int64(1), deleted)
+}
+
+func (s *PostgresRepositoryTestSuite) TestDatabaseHealthCheckReportsMigrationVersion() {
+	check := NewDatabaseHealthCheck(s.db)
+	defer check.Close()
+	detail, err := check.Check()
+	assert.Nil(s.T(), err)
+	assert.Contains(s.T(), detail, "migration version")
+	version, err := check.MigrationVersion()
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), version >= 20140821173923)
+}
+
+func (s *PostgresRepositoryTestSuite) TestSessionLifecycle() {
+	sessions := NewSessionRepositoryPostgres(s.db)
+	defer sessions.Close()
+	user := NewUser()
+	err := s.userRepository.Save(user)
+	assert.Nil(s.T(), err)
+
+	now := time.Now()
+	err = sessions.Save(&Session{
+		SidHash:    "sid",
+		UserId:     user.GetId(),
+		CreatedOn:  now,
+		LastSeenOn: now,
+		ExpiresOn:  now.Add(time.Hour),
+		UserAgent:  "agent",
+	})
+	assert.Nil(s.T(), err)
+	session, err := sessions.FindBySidHash("sid")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), user.GetId(), session.UserId)
+	assert.Equal(s.T(), "agent", session.UserAgent)
+	assert.Empty(s.T(), session.ClientAddress)
+
+	err = sessions.Touch("sid", now, now.Add(-time.Second))
+	assert.Nil(s.T(), err)
+	_, err = sessions.FindBySidHash("sid")
+	assert.Equal(s.T(), sql.ErrNoRows, err)
+	err = sessions.Touch("sid", now, now.Add(time.Hour))
+	assert.Equal(s.T(), sql.ErrNoRows, err)
+
+	deleted, err := sessions.Delete("sid")
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), deleted)
+	deleted, err = sessions.Delete("sid")
+	assert.Nil(s.T(), err)
+	assert.False(s.T(), deleted)
+}
+
+func (s *PostgresRepositoryTestSuite) TestExpiredSessionsAreDeleted() {
+	sessions := NewSessionRepositoryPostgres(s.db)
+	defer sessions.Close()
+	user := NewUser()
+	err := s.userRepository.Save(user)
+	assert.Nil(s.T(), err)
+
+	now := time.Now()
+	for sidHash, expiresOn := range map[string]time.Time{
+		"expired": now.Add(-time.Second),
+		"active":  now.Add(time.Hour),
+	} {
+		err = sessions.Save(&Session{
+			SidHash:    sidHash,
+			UserId:     user.GetId(),
+			CreatedOn:  now,
+			LastSeenOn: now,
+			ExpiresOn:  expiresOn,
+		})
+		assert.Nil(s.T(), err)
+	}
+	deleted, err := sessions.DeleteExpired()
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), int64(1), deleted)
+	_, err = sessions.FindBySidHash("active")
+	assert.Nil(s.T(), err)
+}
+
+func (s *PostgresRepositoryTestSuite) TestRedirectUrisAreRegisteredForClient() {
+	redirectUris := NewRedirectUriRepositoryPostgres(s.db)
+	defer redirectUris.Close()
+	user := NewUser()
+	s.userRepository.Save(user)
+	client := NewClient()
+	err := s.clientRepository.Save(user, client)
+	assert.Nil(s.T(), err)
+
+	err = redirectUris.Add(client.GetId(), "https://example.com/a")
+	assert.Nil(s.T(), err)
+	err = redirectUris.Add(client.GetId(), "https://example.com/b")
+	assert.Nil(s.T(), err)
+	err = redirectUris.Add(client.GetId(), "https://example.com/a")
+	assert.Nil(s.T(), err)
+	found, err := redirectUris.FindByClientId(client.GetId())
+	assert.Nil(s.T(), err)
+	assert.Len(s.T(), found, 2)
+
+	removed, err := redirectUris.Remove(client.GetId(), "https://example.com/a")
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), removed)
+	found, err = redirectUris.FindByClientId(client.GetId())
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), []string{"https://example.com/b"}, found)
+
+	found, err = redirectUris.FindByClientId("unknown")
+	assert.Nil(s.T(), err)
+	assert.Empty(s.T(), found)
+}
+
+func (s *PostgresRepositoryTestSuite) TestLoginFailuresAreCounted() {
+	attempts := NewLoginAttemptRepositoryPostgres(s.db)
+	defer attempts.Close()
+	key := AccountLoginKey("Email@Example.com")
+	assert.Equal(s.T(), "account:email@example.com", key)
+
+	_, err := attempts.Find(key)
+	assert.Equal(s.T(), sql.ErrNoRows, err)
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		recorded, err := attempts.RecordFailure(key, now, now.Add(-time.Hour))
+		assert.Nil(s.T(), err)
+		assert.Equal(s.T(), i, recorded.Failures)
+	}
+	found, err := attempts.Find(key)
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 3, found.Failures)
+
+	// Failures before since are forgotten.
+	recorded, err := attempts.RecordFailure(key, now.Add(time.Minute), now.Add(time.Second))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 1, recorded.Failures)
+
+	reset, err := attempts.Reset(key)
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), reset)
+	_, err = attempts.Find(key)
+	assert.Equal(s.T(), sql.ErrNoRows, err)
+}
+
+func (s *PostgresRepositoryTestSuite) TestLoginFailureTimeDoesNotDependOnTimeZone() {
+	attempts := NewLoginAttemptRepositoryPostgres(s.db)
+	defer attempts.Close()
+	key := SourceLoginKey("192.0.2.1")
+	at := time.Now().In(time.FixedZone("UTC+5", 5*60*60))
+	_, err := attempts.RecordFailure(key, at, at.Add(-time.Hour))
+	assert.Nil(s.T(), err)
+
+	found, err := attempts.Find(key)
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), found.LastFailureOn.Sub(at) < time.Second && at.Sub(found.LastFailureOn) < time.Second,
+		"recorded at %s, found %s", at, found.LastFailureOn)
+}
+
+func (s *PostgresRepositoryTestSuite) TestEmailIsVerifiedOnceWithToken() {
+	verifications := NewEmailVerificationRepositoryPostgres(s.db)
+	defer verifications.Close()
+	outbox := NewOutboxRepositoryPostgres(s.db)
+	defer outbox.Close()
+	user := NewUser()
+	err := s.userRepository.Save(user)
+	assert.Nil(s.T(), err)
+	verified, err := verifications.IsVerified(user.GetId())
+	assert.Nil(s.T(), err)
+	assert.False(s.T(), verified)
+
+	now := time.Now()
+	for _, verification := range []*EmailVerification{
+		{TokenHash: "expired", UserId: user.GetId(), Email: "Email@example.com",
+			CreatedOn: now.Add(-2 * time.Hour), ExpiresOn: now.Add(-time.Hour)},
+		{TokenHash: "valid", UserId: user.GetId(), Email: "Email@example.com",
+			CreatedOn: now, ExpiresOn: now.Add(time.Hour)},
+	} {
+		err = verifications.Save(verification)
+		assert.Nil(s.T(), err)
+	}
+	_, err = verifications.Verify("expired")
+	assert.Equal(s.T(), sql.ErrNoRows, err)
+	verification, err := verifications.Verify("valid")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), user.GetId(), verification.UserId)
+	_, err = verifications.Verify("valid")
+	assert.Equal(s.T(), sql.ErrNoRows, err)
+
+	verified, err = verifications.IsVerified(user.GetId())
+	assert.Nil(s.T(), err)
+	assert.True(s.T(), verified)
+	assert.Equal(s.T(), 0, countRows(s.T(), s.db, "email_verifications"))
+	pending, err := outbox.Pending(10)
+	assert.Nil(s.T(), err)
+	if assert.Len(s.T(), pending, 1) {
+		assert.Equal(s.T(), events.TopicEmailVerified, pending[0].Topic)
+	}
+}
+
+func (s *PostgresRepositoryTestSuite) TestVerificationOfPreviousEmailIsRejected() {
+	verifications := NewEmailVerificationRepositoryPostgres(s.db)
+	defer verifications.Close()
+	user := NewUser()
+	err := s.userRepository.Save(user)
+	assert.Nil(s.T(), err)
+	now := time.Now()
+	err = verifications.Save(&EmailVerification{
+		TokenHash: "previous",
+		UserId:    user.GetId(),
+		Email:     "previous@example.com",
+		CreatedOn: now,
+		ExpiresOn: now.Add(time.Hour),
+	})
+	assert.Nil(s.T(), err)
+	_, err = verifications.Verify("previous")
+	assert.Equal(s.T(), sql.ErrNoRows, err)
+	verified, err := verifications.IsVerified(user.GetId())
+	assert.Nil(s.T(), err)
+	assert.False(s.T(), verified)
+}
+
+func (s *PostgresRepositoryTestSuite) TestPasswordIsResetOnceAndRevokesLogins() {
+	resets := NewPasswordResetRepositoryPostgres(s.db)
+	defer resets.Close()
+	sessions := NewSessionRepositoryPostgres(s.db)
+	defer sessions.Close()
+	user := NewUser()
+	err := s.userRepository.Save(user)
+	assert.Nil(s.T(), err)
+	client := NewClient()
+	s.clientRepository.Save(user, client)
+	err = s.accessTokenRepository.Save(user, client, NewAccessToken(), nil)
+	assert.Nil(s.T(), err)
+	now := time.Now()
+	err = sessions.Save(&Session{
+		SidHash:    "sid",
+		UserId:     user.GetId(),
+		CreatedOn:  now,
+		LastSeenOn: now,
+		ExpiresOn:  now.Add(time.Hour),
+	})
+	assert.Nil(s.T(), err)
+	err = resets.Save(&PasswordReset{
+		TokenHash: "reset",
+		UserId:    user.GetId(),
+		CreatedOn: now,
+		ExpiresOn: now.Add(time.Hour),
+	})
+	assert.Nil(s.T(), err)
+
+	found, err := resets.Find("reset")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), user.GetId(), found.UserId)
+	reset, err := resets.Reset("reset", "new password", events.NewPasswordReset(user.GetId()))
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), user.GetId(), reset.UserId)
+	_, err = resets.Reset("reset", "other password")
+	assert.Equal(s.T(), sql.ErrNoRows, err)
+	_, err = resets.Find("reset")
+	assert.Equal(s.T(), sql.ErrNoRows, err)
+
+	_, err = s.userRepository.FindByEmailAndPassword("email@example.com", "password")
+	assert.Equal(s.T(), ErrCredentialsMismatch, err)
+	_, err = s.userRepository.FindByEmailAndPassword("email@example.com", "new password")
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 0, countRows(s.T(), s.db, "access_tokens"))
+	assert.Equal(s.T(), 0, countRows(s.T(), s.db, "sessions"))
+
+	outbox := NewOutboxRepositoryPostgres(s.db)
+	defer outbox.Close()
+	pending, err := outbox.Pending(10)
+	assert.Nil(s.T(), err)
+	topics := make([]string, 0)
+	for _, event := range pending {
+		topics = append(topics, event.Topic)
+	}
+	assert.Equal(s.T(), []string{events.TopicPasswordReset, events.TopicTokenRevoked}, topics)
+}
+
+func (s *PostgresRepositoryTestSuite) TestOnlyUnexpiredPasswordResetsArePending() {
+	resets := NewPasswordResetRepositoryPostgres(s.db)
+	defer resets.Close()
+	user := NewUser()
+	err := s.userRepository.Save(user)
+	assert.Nil(s.T(), err)
+	now := time.Now()
+	for i, expiresOn := range []time.Time{now.Add(-time.Hour), now.Add(time.Hour), now.Add(2 * time.Hour)} {
+		err = resets.Save(&PasswordReset{
+			TokenHash: fmt.Sprintf("reset%d", i),
+			UserId:    user.GetId(),
+			CreatedOn: now.Add(-2 * time.Hour),
+			ExpiresOn: expiresOn,
+		})
+		assert.Nil(s.T(), err)
+	}
+	pending, err := resets.CountPending(user.GetId())
+	assert.Nil(s.T(), err)
+	assert.Equal(s.T(), 2, pending)
+}
+
+func (s *PostgresRepositoryTestSuite) TestExpiredPasswordResetIsRejected() {
+	resets := NewPasswordResetRepositoryPostgres(s.db)
+	defer resets.Close()
+	user := NewUser()
+	err := s.userRepository.Save(user)
+	assert.Nil(s.T(), err)
+	now := time.Now()
+	err = resets.Save(&PasswordReset{
+		TokenHash: "expired",
+		UserId:    user.GetId(),
+		CreatedOn: now.Add(-2 * time.Hour),
+		ExpiresOn: now.Add(-time.Hour),
+	})
+	assert.Nil(s.T(), err)
+	_, err = resets.Find("expired")
+	assert.Equal(s.T(), sql.ErrNoRows, err)
+	_, err = resets.Reset("expired", "new password")
+	assert.Equal(s.T(), sql.ErrNoRows, err)
+}
+
 func TestPostgresRepositoryTestSuite(t *testing.T) {
 	suite.Run(t, new(PostgresRepositoryTestSuite))
 }
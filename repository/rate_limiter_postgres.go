@@ -0,0 +1,92 @@
+package repository
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/opentarock/service-user-management/nnservice"
+	"github.com/opentarock/service-user-management/util"
+)
+
+// Error code of unique constraint violations.
+const uniqueViolation = "23505"
+
+type rateLimiterPostgres struct {
+	db         *sql.DB
+	statements map[string]*sql.Stmt
+}
+
+// NewRateLimiterPostgres returns a rate limiter that keeps the buckets in the
+// database so they are shared by all the instances of the service.
+func NewRateLimiterPostgres(db *sql.DB) *rateLimiterPostgres {
+	limiter := &rateLimiterPostgres{
+		db:         db,
+		statements: make(map[string]*sql.Stmt),
+	}
+	// Bucket is refilled and a token is taken in a single statement so
+	// concurrent requests can not take the same token.
+	util.Prepare(db, limiter.statements, "take_token",
+		`UPDATE rate_limit_buckets
+		 SET tokens = LEAST($3::double precision, tokens + EXTRACT(EPOCH FROM (clock_timestamp() - updated_on)) * $2::double precision) - 1,
+		     updated_on = clock_timestamp()
+		 WHERE key = $1
+		   AND LEAST($3::double precision, tokens + EXTRACT(EPOCH FROM (clock_timestamp() - updated_on)) * $2::double precision) >= 1`)
+	util.Prepare(db, limiter.statements, "insert_bucket",
+		`INSERT INTO rate_limit_buckets (key, tokens, updated_on)
+		 SELECT $1::text, $2::double precision - 1, clock_timestamp()
+		 WHERE NOT EXISTS (SELECT 1 FROM rate_limit_buckets WHERE key = $1::text)`)
+	util.Prepare(db, limiter.statements, "delete_idle_buckets",
+		`DELETE FROM rate_limit_buckets
+		 WHERE updated_on < clock_timestamp() - $1 * INTERVAL '1 millisecond'`)
+	return limiter
+}
+
+func (l *rateLimiterPostgres) Allow(key string, limit nnservice.RateLimit) (bool, error) {
+	taken, err := l.exec("take_token", key, limit.Rate, limit.Burst)
+	if err != nil || taken {
+		return taken, err
+	}
+	// Either the bucket is empty or it does not exist yet.
+	inserted, err := l.exec("insert_bucket", key, limit.Burst)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation {
+		// Bucket was created by a concurrent request.
+		return l.exec("take_token", key, limit.Rate, limit.Burst)
+	}
+	return inserted, err
+}
+
+// DeleteIdle deletes the buckets that were not used for the given time. They
+// are full if the time is at least the refill time of their limit, which is
+// the same as if they did not exist.
+func (l *rateLimiterPostgres) DeleteIdle(idle time.Duration) (int64, error) {
+	result, err := util.Exec(l.statements, "delete_idle_buckets", int64(idle/time.Millisecond))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// exec executes the statement and reports whether a row was changed.
+func (l *rateLimiterPostgres) exec(name string, args ...interface{}) (bool, error) {
+	result, err := util.Exec(l.statements, name, args...)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows == 1, nil
+}
+
+func (l *rateLimiterPostgres) Close() {
+	for name, stmt := range l.statements {
+		err := stmt.Close()
+		if err != nil {
+			log.Printf("Error closing statement '%s': %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package repository
+
+// RedirectUriRepository keeps the redirect URIs registered for clients.
+type RedirectUriRepository interface {
+	// Add registers the redirect URI for the client. Adding a URI that is
+	// already registered has no effect.
+	Add(clientId, redirectUri string) error
+	// Remove reports whether the redirect URI was registered for the client.
+	Remove(clientId, redirectUri string) (bool, error)
+	// FindByClientId returns the redirect URIs of the client in the order they
+	// were registered.
+	FindByClientId(clientId string) ([]string, error)
+}
@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/opentarock/service-user-management/util"
+)
+
+type redirectUriRepositoryPostgres struct {
+	db         *sql.DB
+	statements map[string]*sql.Stmt
+}
+
+func NewRedirectUriRepositoryPostgres(db *sql.DB) *redirectUriRepositoryPostgres {
+	repo := &redirectUriRepositoryPostgres{
+		db:         db,
+		statements: make(map[string]*sql.Stmt),
+	}
+	util.Prepare(db, repo.statements, "add_redirect_uri",
+		`INSERT INTO redirect_uris (client_id, redirect_uri)
+		 SELECT $1, $2
+		 WHERE NOT EXISTS (
+		     SELECT 1 FROM redirect_uris WHERE client_id = $1 AND redirect_uri = $2)`)
+	util.Prepare(db, repo.statements, "remove_redirect_uri",
+		`DELETE FROM redirect_uris
+		 WHERE client_id = $1 AND redirect_uri = $2`)
+	util.Prepare(db, repo.statements, "find_redirect_uris",
+		`SELECT redirect_uri
+		 FROM redirect_uris
+		 WHERE client_id = $1
+		 ORDER BY created_on, redirect_uri`)
+	return repo
+}
+
+func (r *redirectUriRepositoryPostgres) Add(clientId, redirectUri string) error {
+	_, err := util.Exec(r.statements, "add_redirect_uri", clientId, redirectUri)
+	return err
+}
+
+func (r *redirectUriRepositoryPostgres) Remove(clientId, redirectUri string) (bool, error) {
+	result, err := util.Exec(r.statements, "remove_redirect_uri", clientId, redirectUri)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return removed > 0, nil
+}
+
+func (r *redirectUriRepositoryPostgres) FindByClientId(clientId string) ([]string, error) {
+	rows, err := util.Query(r.statements, "find_redirect_uris", clientId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	redirectUris := make([]string, 0)
+	for rows.Next() {
+		var redirectUri string
+		if err := rows.Scan(&redirectUri); err != nil {
+			return nil, err
+		}
+		redirectUris = append(redirectUris, redirectUri)
+	}
+	return redirectUris, rows.Err()
+}
+
+func (r *redirectUriRepositoryPostgres) Close() {
+	for name, stmt := range r.statements {
+		err := stmt.Close()
+		if err != nil {
+			log.Printf("Error closing statement '%s': %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package repository
+
+import "time"
+
+// Session is a session of an authenticated user.
+type Session struct {
+	// SidHash is the hash of the session id, see util.HashToken. Session ids
+	// are not stored so that they can not be taken from the database.
+	SidHash    string
+	UserId     uint64
+	CreatedOn  time.Time
+	LastSeenOn time.Time
+	ExpiresOn  time.Time
+	// Address of the client the user logged in from.
+	ClientAddress string
+	UserAgent     string
+}
+
+// SessionRepository keeps sessions. Expired sessions are never returned.
+type SessionRepository interface {
+	Save(session *Session) error
+	// FindBySidHash returns sql.ErrNoRows if the session does not exist or is
+	// expired.
+	FindBySidHash(sidHash string) (*Session, error)
+	// Touch updates the time the session was last seen and its expiry. It
+	// returns sql.ErrNoRows if the session does not exist or is expired.
+	Touch(sidHash string, lastSeenOn, expiresOn time.Time) error
+	// Delete ends the session and reports whether it existed.
+	Delete(sidHash string) (bool, error)
+	// DeleteExpired deletes the expired sessions and returns their number.
+	DeleteExpired() (int64, error)
+}
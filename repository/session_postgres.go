@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/opentarock/service-user-management/util"
+)
+
+type sessionRepositoryPostgres struct {
+	db         *sql.DB
+	statements map[string]*sql.Stmt
+}
+
+func NewSessionRepositoryPostgres(db *sql.DB) *sessionRepositoryPostgres {
+	repo := &sessionRepositoryPostgres{
+		db:         db,
+		statements: make(map[string]*sql.Stmt),
+	}
+	util.Prepare(db, repo.statements, "save_session",
+		`INSERT INTO sessions (sid_hash, user_id, created_on, last_seen_on, expires_on, client_address, user_agent)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)`)
+	util.Prepare(db, repo.statements, "find_session",
+		`SELECT user_id, created_on, last_seen_on, expires_on, client_address, user_agent
+		 FROM sessions
+		 WHERE sid_hash = $1 AND expires_on > NOW()`)
+	util.Prepare(db, repo.statements, "touch_session",
+		`UPDATE sessions
+		 SET last_seen_on = $2, expires_on = $3
+		 WHERE sid_hash = $1 AND expires_on > NOW()`)
+	util.Prepare(db, repo.statements, "delete_session",
+		`DELETE FROM sessions
+		 WHERE sid_hash = $1`)
+	util.Prepare(db, repo.statements, "delete_expired_sessions",
+		`DELETE FROM sessions
+		 WHERE expires_on <= NOW()`)
+	return repo
+}
+
+func (r *sessionRepositoryPostgres) Save(session *Session) error {
+	_, err := util.Exec(r.statements, "save_session",
+		session.SidHash,
+		session.UserId,
+		session.CreatedOn,
+		session.LastSeenOn,
+		session.ExpiresOn,
+		nullString(session.ClientAddress),
+		nullString(session.UserAgent))
+	return err
+}
+
+func (r *sessionRepositoryPostgres) FindBySidHash(sidHash string) (*Session, error) {
+	session := &Session{SidHash: sidHash}
+	var clientAddress, userAgent sql.NullString
+	err := util.QueryRow(r.statements, "find_session", sidHash).Scan(
+		&session.UserId, &session.CreatedOn, &session.LastSeenOn, &session.ExpiresOn,
+		&clientAddress, &userAgent)
+	if err != nil {
+		return nil, err
+	}
+	session.ClientAddress = clientAddress.String
+	session.UserAgent = userAgent.String
+	return session, nil
+}
+
+func (r *sessionRepositoryPostgres) Touch(sidHash string, lastSeenOn, expiresOn time.Time) error {
+	result, err := util.Exec(r.statements, "touch_session", sidHash, lastSeenOn, expiresOn)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *sessionRepositoryPostgres) Delete(sidHash string) (bool, error) {
+	result, err := util.Exec(r.statements, "delete_session", sidHash)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return deleted > 0, nil
+}
+
+func (r *sessionRepositoryPostgres) DeleteExpired() (int64, error) {
+	result, err := util.Exec(r.statements, "delete_expired_sessions")
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (r *sessionRepositoryPostgres) Close() {
+	for name, stmt := range r.statements {
+		err := stmt.Close()
+		if err != nil {
+			log.Printf("Error closing statement '%s': %s", name, err)
+		}
+	}
+}
+
+// nullString stores empty strings as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -2,6 +2,7 @@ package repository
 
 import (
 	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/events"
 )
 
 type UserRaw struct {
@@ -10,7 +11,8 @@ type UserRaw struct {
 }
 
 type UserRepository interface {
-	Save(user *proto_user.User) error
+	// Save inserts the user and records the events in the same transaction.
+	Save(user *proto_user.User, newEvents ...*events.Event) error
 	FindById(id uint64) (*proto_user.User, error)
 	FindByEmail(email string) (*proto_user.User, error)
 	FindByEmailAndPassword(emailAddress, passwordPlain string) (*proto_user.User, error)
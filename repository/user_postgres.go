@@ -5,12 +5,15 @@ import (
 	"encoding/hex"
 	"errors"
 	"log"
+	"strings"
 
 	"crypto/subtle"
 
 	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/lib/pq"
 
 	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/events"
 	"github.com/opentarock/service-user-management/util"
 )
 
@@ -18,7 +21,24 @@ const (
 	saltLength = 60
 )
 
-var ErrCredentialsMismatch = errors.New("userRepository: credentials_mismatch")
+var (
+	ErrCredentialsMismatch = errors.New("userRepository: credentials_mismatch")
+	// ErrEmailTaken is returned when saving a user with an email address that
+	// is already registered.
+	ErrEmailTaken = errors.New("userRepository: email_taken")
+)
+
+// dummyUser has a salt and a password hash of the same length as registered
+// users. No password matches it.
+var dummyUser = &UserRaw{
+	User: &proto_user.User{
+		Password: proto.String(strings.Repeat("0", 2*util.PBKDF2KeyLength)),
+	},
+	Salt: strings.Repeat("0", 2*saltLength),
+}
+
+// Name of the unique index on normalized email addresses.
+const emailNormalizedKey = "users_email_normalized_key"
 
 type userRepositoryPostgres struct {
 	db             *sql.DB
@@ -33,8 +53,8 @@ func NewUserRepositoryPostgres(db *sql.DB) *userRepositoryPostgres {
 		statements: make(map[string]*sql.Stmt),
 	}
 	util.Prepare(db, repo.statements, "save_user",
-		`INSERT INTO users (display_name, email, password, salt)
-		 VALUES ($1, $2, $3, $4)
+		`INSERT INTO users (display_name, email, email_normalized, password, salt)
+		 VALUES ($1, $2, $3, $4, $5)
 		 RETURNING id`)
 	util.Prepare(db, repo.statements, "find_user_by_id",
 		`SELECT id, display_name, email, password, salt
@@ -43,7 +63,8 @@ func NewUserRepositoryPostgres(db *sql.DB) *userRepositoryPostgres {
 	util.Prepare(db, repo.statements, "find_user_by_email",
 		`SELECT id, display_name, email, password, salt
 		 FROM users
-		 WHERE email = $1`)
+		 WHERE email_normalized = $1`)
+	util.Prepare(db, repo.statements, "insert_outbox_event", insertOutboxEventQuery)
 	util.Prepare(db, repo.statements, "count",
 		`SELECT COUNT(*)
 		 FROM users`)
@@ -53,18 +74,36 @@ func NewUserRepositoryPostgres(db *sql.DB) *userRepositoryPostgres {
 	return repo
 }
 
-func (r *userRepositoryPostgres) Save(user *proto_user.User) error {
+func (r *userRepositoryPostgres) Save(user *proto_user.User, newEvents ...*events.Event) error {
 	token, err := r.TokenGenerator.GenerateHex(saltLength)
 	if err != nil {
 		return err
 	}
 	passwordHash := r.hashPassword(user.GetPassword(), token)
-	var id uint64
-	err = util.QueryRow(r.statements, "save_user", user.GetDisplayName(), user.GetEmail(), passwordHash, token).Scan(&id)
+	tx, err := r.db.Begin()
 	if err != nil {
 		return err
 	}
+	var id uint64
+	email := strings.TrimSpace(user.GetEmail())
+	err = tx.Stmt(r.statements["save_user"]).QueryRow(
+		user.GetDisplayName(), email, NormalizeEmail(email), passwordHash, token).Scan(&id)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation && pqErr.Constraint == emailNormalizedKey {
+		return tryRollback(tx, ErrEmailTaken)
+	} else if err != nil {
+		return tryRollback(tx, err)
+	}
 	user.Id = proto.Uint64(id)
+	err = recordEvents(tx, r.statements["insert_outbox_event"], newEvents)
+	if err != nil {
+		user.Id = nil
+		return tryRollback(tx, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		user.Id = nil
+		return err
+	}
 	return nil
 }
 
@@ -77,7 +116,7 @@ func (r *userRepositoryPostgres) FindById(id uint64) (*proto_user.User, error) {
 }
 
 func (r *userRepositoryPostgres) FindByEmail(emailAddress string) (*proto_user.User, error) {
-	userRaw, err := r.findRaw("find_user_by_email", emailAddress)
+	userRaw, err := r.findRaw("find_user_by_email", NormalizeEmail(emailAddress))
 	if err != nil {
 		return nil, err
 	}
@@ -87,7 +126,7 @@ func (r *userRepositoryPostgres) FindByEmail(emailAddress string) (*proto_user.U
 func (r *userRepositoryPostgres) findRaw(query string, args ...interface{}) (*UserRaw, error) {
 	var id uint64
 	var displayName, email, password, salt string
-	err := util.QueryRow(r.statements, "find_user_by_email", args...).Scan(
+	err := util.QueryRow(r.statements, query, args...).Scan(
 		&id, &displayName, &email, &password, &salt)
 	if err != nil {
 		return nil, err
@@ -106,23 +145,37 @@ func (r *userRepositoryPostgres) findRaw(query string, args ...interface{}) (*Us
 }
 
 func (r *userRepositoryPostgres) FindByEmailAndPassword(emailAddress, passwordPlain string) (*proto_user.User, error) {
-	userRaw, err := r.findRaw("find_user_by_email", emailAddress)
+	userRaw, err := r.findRaw("find_user_by_email", NormalizeEmail(emailAddress))
+	return r.checkPassword(userRaw, err, passwordPlain)
+}
+
+// checkPassword returns the user found by the query if the password matches.
+// If the user was not found the password is checked against a dummy user, so
+// that the time it takes does not reveal whether the email address is
+// registered.
+func (r *userRepositoryPostgres) checkPassword(userRaw *UserRaw, err error, passwordPlain string) (*proto_user.User, error) {
+	found := err == nil
 	if err == sql.ErrNoRows {
-		return nil, ErrCredentialsMismatch
+		userRaw = dummyUser
 	} else if err != nil {
 		return nil, err
 	}
 	password := r.hashPassword(passwordPlain, userRaw.Salt)
-	if subtle.ConstantTimeCompare([]byte(password), []byte(userRaw.User.GetPassword())) == 1 {
+	matches := subtle.ConstantTimeCompare([]byte(password), []byte(userRaw.User.GetPassword())) == 1
+	if matches && found {
 		return userRaw.User, nil
 	}
 	return nil, ErrCredentialsMismatch
-
 }
 
 func (r *userRepositoryPostgres) hashPassword(password, salt string) string {
-	passwordHashRaw := r.Hasher.Hash(password, salt)
-	return hex.EncodeToString(passwordHashRaw)
+	return encodePasswordHash(r.Hasher, password, salt)
+}
+
+// encodePasswordHash returns the hex encoded hash of the password as stored in
+// the users table.
+func encodePasswordHash(hasher util.PasswordHasher, password, salt string) string {
+	return hex.EncodeToString(hasher.Hash(password, salt))
 }
 
 func (r *userRepositoryPostgres) Count() (uint64, error) {
@@ -0,0 +1,178 @@
+package repository
+
+import (
+	"database/sql"
+	"math"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/util"
+)
+
+const (
+	// Number of times each function is measured by timing tests.
+	timingSamples = 500
+	// Significance level at which timing tests fail when the run times of the
+	// functions differ.
+	timingSignificance = 0.001
+)
+
+// assertIndistinguishableTiming runs the functions alternately and fails if
+// Welch's t-test shows that their mean run times differ at the
+// timingSignificance level.
+func assertIndistinguishableTiming(t *testing.T, a, b func()) {
+	timesA := make([]float64, timingSamples)
+	timesB := make([]float64, timingSamples)
+	for i := 0; i < timingSamples; i++ {
+		timesA[i] = measure(a)
+		timesB[i] = measure(b)
+	}
+	p := welchTTest(timesA, timesB)
+	assert.True(t, p >= timingSignificance,
+		"mean times differ (p=%.2g): %s and %s", p, meanDuration(timesA), meanDuration(timesB))
+}
+
+// measure returns the run time of f in seconds.
+func measure(f func()) float64 {
+	start := time.Now()
+	f()
+	return time.Since(start).Seconds()
+}
+
+func meanDuration(times []float64) time.Duration {
+	m, _ := meanVariance(times)
+	return time.Duration(m * float64(time.Second))
+}
+
+// meanVariance returns the mean and the unbiased sample variance.
+func meanVariance(x []float64) (float64, float64) {
+	n := float64(len(x))
+	mean := 0.0
+	for _, v := range x {
+		mean += v
+	}
+	mean /= n
+	variance := 0.0
+	for _, v := range x {
+		variance += (v - mean) * (v - mean)
+	}
+	return mean, variance / (n - 1)
+}
+
+// welchTTest returns the two-sided p-value of Welch's t-test of the hypothesis
+// that the samples come from distributions with equal means.
+func welchTTest(a, b []float64) float64 {
+	meanA, varA := meanVariance(a)
+	meanB, varB := meanVariance(b)
+	seA, seB := varA/float64(len(a)), varB/float64(len(b))
+	if seA+seB == 0 {
+		if meanA == meanB {
+			return 1
+		}
+		return 0
+	}
+	tStat := (meanA - meanB) / math.Sqrt(seA+seB)
+	df := (seA + seB) * (seA + seB) /
+		(seA*seA/float64(len(a)-1) + seB*seB/float64(len(b)-1))
+	return regularizedBeta(df/(df+tStat*tStat), df/2, 0.5)
+}
+
+// regularizedBeta returns the regularized incomplete beta function I_x(a, b),
+// evaluated with a continued fraction (Numerical Recipes 6.4).
+func regularizedBeta(x, a, b float64) float64 {
+	if x <= 0 {
+		return 0
+	} else if x >= 1 {
+		return 1
+	}
+	lgammaAB, _ := math.Lgamma(a + b)
+	lgammaA, _ := math.Lgamma(a)
+	lgammaB, _ := math.Lgamma(b)
+	front := math.Exp(lgammaAB - lgammaA - lgammaB + a*math.Log(x) + b*math.Log(1-x))
+	if x < (a+1)/(a+b+2) {
+		return front * betaContinuedFraction(x, a, b) / a
+	}
+	return 1 - front*betaContinuedFraction(1-x, b, a)/b
+}
+
+func betaContinuedFraction(x, a, b float64) float64 {
+	const (
+		maxIterations = 300
+		epsilon       = 1e-14
+		tiny          = 1e-300
+	)
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	result := d
+	for m := 1.0; m <= maxIterations; m++ {
+		for _, numerator := range []float64{
+			m * (b - m) * x / ((a + 2*m - 1) * (a + 2*m)),
+			-(a + m) * (a + b + m) * x / ((a + 2*m) * (a + 2*m + 1)),
+		} {
+			d = 1 + numerator*d
+			if math.Abs(d) < tiny {
+				d = tiny
+			}
+			c = 1 + numerator/c
+			if math.Abs(c) < tiny {
+				c = tiny
+			}
+			d = 1 / d
+			result *= d * c
+		}
+		if math.Abs(d*c-1) < epsilon {
+			break
+		}
+	}
+	return result
+}
+
+func newTimingTestRepository() (*userRepositoryPostgres, *UserRaw) {
+	repo := &userRepositoryPostgres{Hasher: util.NewPBKDF2PasswordHasher()}
+	salt, _ := util.NewRandTokenGenerator().GenerateHex(saltLength)
+	registered := &UserRaw{
+		User: &proto_user.User{
+			Id:       proto.Uint64(1),
+			Password: proto.String(repo.hashPassword("password", salt)),
+		},
+		Salt: salt,
+	}
+	return repo, registered
+}
+
+func TestUnknownEmailNeverMatches(t *testing.T) {
+	repo, registered := newTimingTestRepository()
+	user, err := repo.checkPassword(registered, nil, "password")
+	assert.Nil(t, err)
+	assert.Equal(t, registered.User, user)
+	for _, password := range []string{"", "password", dummyUser.User.GetPassword()} {
+		_, err = repo.checkPassword(nil, sql.ErrNoRows, password)
+		assert.Equal(t, ErrCredentialsMismatch, err)
+	}
+}
+
+func TestWelchTTest(t *testing.T) {
+	// t = -3 with 8 degrees of freedom, two-sided p-value is 0.01707.
+	a := []float64{1, 2, 3, 4, 5}
+	b := []float64{4, 5, 6, 7, 8}
+	assert.InDelta(t, 0.01707, welchTTest(a, b), 0.00001)
+	assert.Equal(t, 1.0, welchTTest(a, a))
+	assert.InDelta(t, 0.5, regularizedBeta(0.5, 2, 2), 1e-12)
+}
+
+func TestUnknownEmailTakesAsLongAsWrongPassword(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Timing test skipped in short mode")
+	}
+	repo, registered := newTimingTestRepository()
+	assertIndistinguishableTiming(t,
+		func() { repo.checkPassword(registered, nil, "wrong") },
+		func() { repo.checkPassword(nil, sql.ErrNoRows, "wrong") })
+}
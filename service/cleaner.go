@@ -0,0 +1,55 @@
+package service
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Cleaner periodically deletes data that is no longer used.
+type Cleaner struct {
+	Interval time.Duration
+	name     string
+	clean    func() (int64, error)
+	stopping chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func newCleaner(name string, interval time.Duration, clean func() (int64, error)) *Cleaner {
+	return &Cleaner{
+		Interval: interval,
+		name:     name,
+		clean:    clean,
+		stopping: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start deletes the data until the cleaner is stopped.
+func (c *Cleaner) Start() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		deleted, err := c.clean()
+		if err != nil {
+			log.Printf("Error deleting %s: %s", c.name, err)
+		} else if deleted > 0 {
+			log.Printf("Deleted %d %s", deleted, c.name)
+		}
+		select {
+		case <-ticker.C:
+		case <-c.stopping:
+			return
+		}
+	}
+}
+
+// Stop stops the cleaner started with Start and waits for it to finish.
+func (c *Cleaner) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopping)
+	})
+	<-c.done
+}
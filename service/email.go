@@ -0,0 +1,189 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+
+	"code.google.com/p/go.net/idna"
+)
+
+const (
+	// Maximum length of an email address that can be used in SMTP (RFC 5321).
+	maxEmailLength     = 254
+	maxLocalPartLength = 64
+	maxDomainLength    = 253
+	maxLabelLength     = 63
+)
+
+var (
+	errInvalidEmail  = errors.New("email: invalid_address")
+	errInvalidDomain = errors.New("email: invalid_domain")
+)
+
+// Top level domains that are reserved and never used for real mailboxes
+// (RFC 2606 and 6761).
+var reservedTopLevelDomains = map[string]bool{
+	"example":   true,
+	"invalid":   true,
+	"local":     true,
+	"localhost": true,
+	"test":      true,
+}
+
+// parseEmail parses the address as specified by RFC 5322, with UTF-8 allowed
+// as in RFC 6531, and returns the domain in ASCII form. Display names and
+// address literals are not accepted.
+func parseEmail(email string) (string, error) {
+	if len(email) > maxEmailLength {
+		return "", errInvalidEmail
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Name != "" || strings.HasSuffix(email, ">") {
+		return "", errInvalidEmail
+	}
+	at := strings.LastIndex(address.Address, "@")
+	if at < 1 || at > maxLocalPartLength {
+		return "", errInvalidEmail
+	}
+	return normalizeDomain(address.Address[at+1:])
+}
+
+// normalizeDomain converts an internationalized domain to its ASCII form using
+// IDNA and checks that it is a valid host name in a public top level domain.
+func normalizeDomain(domain string) (string, error) {
+	if strings.HasPrefix(domain, "[") {
+		return "", errInvalidDomain
+	}
+	ascii, err := idna.ToASCII(strings.ToLower(domain))
+	if err != nil || len(ascii) > maxDomainLength {
+		return "", errInvalidDomain
+	}
+	labels := strings.Split(ascii, ".")
+	if len(labels) < 2 {
+		return "", errInvalidDomain
+	}
+	for _, label := range labels {
+		if !validLabel(label) {
+			return "", errInvalidDomain
+		}
+	}
+	tld := labels[len(labels)-1]
+	if len(tld) < 2 || isNumeric(tld) || reservedTopLevelDomains[tld] {
+		return "", errInvalidDomain
+	}
+	return ascii, nil
+}
+
+func validLabel(label string) bool {
+	if len(label) == 0 || len(label) > maxLabelLength ||
+		strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+		return false
+	}
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func isNumeric(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// EmailDomainPolicy decides which domains of email addresses are accepted at
+// registration. A domain also matches all of its subdomains.
+type EmailDomainPolicy struct {
+	allowed    map[string]bool
+	denied     map[string]bool
+	disposable map[string]bool
+}
+
+// NewEmailDomainPolicy returns a policy that accepts only the allowed domains
+// if there are any and rejects the denied and disposable domains. Domains can
+// be given in Unicode or ASCII form.
+func NewEmailDomainPolicy(allowed, denied, disposable []string) (*EmailDomainPolicy, error) {
+	policy := &EmailDomainPolicy{}
+	var err error
+	if policy.allowed, err = domainSet(allowed); err != nil {
+		return nil, err
+	}
+	if policy.denied, err = domainSet(denied); err != nil {
+		return nil, err
+	}
+	if policy.disposable, err = domainSet(disposable); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func domainSet(domains []string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	for _, domain := range domains {
+		ascii, err := idna.ToASCII(strings.ToLower(strings.TrimSpace(domain)))
+		if err != nil || ascii == "" {
+			return nil, fmt.Errorf("Invalid domain: %s", domain)
+		}
+		set[ascii] = true
+	}
+	return set, nil
+}
+
+// Accepts reports whether addresses in the domain, in ASCII form, are
+// accepted. All domains are accepted by a nil policy.
+func (p *EmailDomainPolicy) Accepts(domain string) bool {
+	if p == nil {
+		return true
+	}
+	if len(p.allowed) != 0 && !matchesDomain(p.allowed, domain) {
+		return false
+	}
+	return !matchesDomain(p.denied, domain) && !matchesDomain(p.disposable, domain)
+}
+
+// matchesDomain reports whether the domain or any of its parent domains is in
+// the set.
+func matchesDomain(set map[string]bool, domain string) bool {
+	for {
+		if set[domain] {
+			return true
+		}
+		dot := strings.Index(domain, ".")
+		if dot < 0 {
+			return false
+		}
+		domain = domain[dot+1:]
+	}
+}
+
+// LoadDomainList reads a list of domains with one domain per line. Empty lines
+// and lines starting with # are ignored.
+func LoadDomainList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	domains := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
@@ -0,0 +1,92 @@
+package service_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/service"
+)
+
+// registrationEmailErrors returns the validation errors of the email field when
+// registering a user with the email address.
+func registrationEmailErrors(t *testing.T, policy *service.EmailDomainPolicy, email string) []string {
+	handlers := service.NewUserServiceHandlers(nil, nil)
+	handlers.EmailDomains = policy
+	registerUser := &proto_user.RegisterUser{
+		User: NewValidUser(),
+	}
+	registerUser.User.Email = proto.String(email)
+	registerUser.User.Password = proto.String("pass")
+	result := handleMessage(t, registerUser, handlers.RegisterUserMessageHandler())
+	var registerResponse proto_user.RegisterResponse
+	err := proto.Unmarshal(result, &registerResponse)
+	assert.Nil(t, err)
+	errors := []string{}
+	for _, e := range registerResponse.GetErrors() {
+		if e.GetName() == "email" {
+			errors = append(errors, e.GetErrorMessage())
+		}
+	}
+	return errors
+}
+
+func TestValidEmailAddressesAreAccepted(t *testing.T) {
+	for _, email := range []string{
+		"user@example.com",
+		"first.last+tag@mail.example.co.uk",
+		"\"quoted name\"@example.com",
+		"user@bücher.de",
+		"user@xn--bcher-kva.de",
+	} {
+		assert.Empty(t, registrationEmailErrors(t, nil, email), email)
+	}
+}
+
+func TestInvalidEmailAddressesAreRejected(t *testing.T) {
+	for _, email := range []string{
+		"user@",
+		"@example.com",
+		"user@@example.com",
+		"Name <user@example.com>",
+		"user@localhost",
+		"user@example.test",
+		"user@127.0.0.1",
+		"user@[127.0.0.1]",
+		"user@-example.com",
+		"user@example..com",
+		"user@exa_mple.com",
+	} {
+		assert.Equal(t, 1, len(registrationEmailErrors(t, nil, email)), email)
+	}
+}
+
+func TestEmailDomainPolicyIsApplied(t *testing.T) {
+	policy, err := service.NewEmailDomainPolicy(
+		[]string{"example.com", "bücher.de"}, []string{"spam.example.com"}, []string{"trash.example.com"})
+	assert.Nil(t, err)
+
+	assert.Empty(t, registrationEmailErrors(t, policy, "user@example.com"))
+	assert.Empty(t, registrationEmailErrors(t, policy, "user@mail.example.com"))
+	assert.Empty(t, registrationEmailErrors(t, policy, "user@BÜCHER.de"))
+	assert.NotEmpty(t, registrationEmailErrors(t, policy, "user@example.org"))
+	assert.NotEmpty(t, registrationEmailErrors(t, policy, "user@spam.example.com"))
+	assert.NotEmpty(t, registrationEmailErrors(t, policy, "user@a.trash.example.com"))
+}
+
+func TestDomainListIsLoadedFromFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "domains")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("# disposable\nmailinator.com\n\n  trash.example.com \n")
+	assert.Nil(t, err)
+	f.Close()
+
+	domains, err := service.LoadDomainList(f.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"mailinator.com", "trash.example.com"}, domains)
+}
@@ -0,0 +1,21 @@
+package service
+
+import (
+	"github.com/opentarock/service-user-management/events"
+	"github.com/opentarock/service-user-management/repository"
+	"github.com/opentarock/service-user-management/trace"
+)
+
+// recordEvent records an event that is not part of any change in the outbox.
+// Request does not fail if the event can not be recorded.
+func recordEvent(span *trace.Span, outbox repository.OutboxRepository, event *events.Event) {
+	if outbox == nil {
+		return
+	}
+	done := traceRepository(span, "Outbox.Add")
+	err := outbox.Add(event)
+	done(err)
+	if err != nil {
+		span.Logf("Error recording %s event: %s", event.Topic, err)
+	}
+}
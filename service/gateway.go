@@ -0,0 +1,82 @@
+package service
+
+import (
+	"code.google.com/p/gogoprotobuf/proto"
+
+	"github.com/opentarock/service-api/go/proto_oauth2"
+	"github.com/opentarock/service-api/go/proto_password"
+	"github.com/opentarock/service-api/go/proto_session"
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-api/go/proto_verification"
+	"github.com/opentarock/service-user-management/nnservice"
+)
+
+// AddUserRoutes exposes the user service handlers on the gateway.
+func AddUserRoutes(gateway *nnservice.Gateway, userService *nnservice.RepService) {
+	gateway.AddRoute("/api/user/register", userService,
+		proto_user.RegisterUserMessage, newRegisterUser, newRegisterResponse)
+	gateway.AddRoute("/api/user/authenticate", userService,
+		proto_user.AuthenticateUserMessage, newAuthenticateUser, newAuthenticateResult)
+	gateway.AddRoute("/api/user/session/validate", userService,
+		proto_session.ValidateSessionMessage, newValidateSession, newSessionResponse)
+	gateway.AddRoute("/api/user/session/touch", userService,
+		proto_session.TouchSessionMessage, newTouchSession, newSessionResponse)
+	gateway.AddRoute("/api/user/logout", userService,
+		proto_session.LogoutMessage, newLogout, newLogoutResponse)
+	gateway.AddRoute("/api/user/email/verify", userService,
+		proto_verification.VerifyEmailMessage, newVerifyEmail, newVerifyEmailResponse)
+	gateway.AddRoute("/api/user/email/resend", userService,
+		proto_verification.ResendVerificationMessage, newResendVerification, newResendVerificationResponse)
+	gateway.AddRoute("/api/user/password/request_reset", userService,
+		proto_password.RequestPasswordResetMessage, newRequestPasswordReset, newRequestPasswordResetResponse)
+	gateway.AddRoute("/api/user/password/reset", userService,
+		proto_password.ResetPasswordMessage, newResetPassword, newResetPasswordResponse)
+}
+
+// AddOauth2Routes exposes the oauth2 service handlers on the gateway.
+func AddOauth2Routes(gateway *nnservice.Gateway, oauth2Service *nnservice.RepService) {
+	gateway.AddRoute("/api/oauth2/access_token", oauth2Service,
+		proto_oauth2.AccessTokenAuthenticationMessage, newAccessTokenAuthentication, newAccessTokenResponse)
+	gateway.AddRoute("/api/oauth2/validate", oauth2Service,
+		proto_oauth2.ValidateMessage, newValidateTokenRequest, newValidateTokenResponse)
+}
+
+func newRegisterResponse() proto.Message {
+	return &proto_user.RegisterResponse{}
+}
+
+func newAuthenticateResult() proto.Message {
+	return &proto_user.AuthenticateResult{}
+}
+
+func newSessionResponse() proto.Message {
+	return &proto_session.SessionResponse{}
+}
+
+func newLogoutResponse() proto.Message {
+	return &proto_session.LogoutResponse{}
+}
+
+func newVerifyEmailResponse() proto.Message {
+	return &proto_verification.VerifyEmailResponse{}
+}
+
+func newResendVerificationResponse() proto.Message {
+	return &proto_verification.ResendVerificationResponse{}
+}
+
+func newRequestPasswordResetResponse() proto.Message {
+	return &proto_password.RequestPasswordResetResponse{}
+}
+
+func newResetPasswordResponse() proto.Message {
+	return &proto_password.ResetPasswordResponse{}
+}
+
+func newAccessTokenResponse() proto.Message {
+	return &proto_oauth2.AccessTokenResponse{}
+}
+
+func newValidateTokenResponse() proto.Message {
+	return &proto_oauth2.ValidateTokenResponse{}
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/opentarock/service-user-management/trace"
+)
+
+const (
+	// DefaultJobWorkers is the number of jobs a job queue runs concurrently by
+	// default.
+	DefaultJobWorkers = 2
+	// DefaultJobQueueSize is the number of jobs that can wait in a job queue by
+	// default.
+	DefaultJobQueueSize = 100
+)
+
+var errJobQueueTimeout = errors.New("jobs: stop_timeout")
+
+// JobQueue runs work that is done after responding to a request, e.g. sending
+// emails, so that the response time does not depend on it. Every job is traced
+// by its own span in the trace of the request. All methods can be called on
+// nil, which runs the jobs immediately.
+type JobQueue struct {
+	jobs    chan *job
+	running sync.WaitGroup
+	// mu guards stopped so that no job is queued after the queue is closed.
+	mu      sync.RWMutex
+	stopped bool
+}
+
+type job struct {
+	span *trace.Span
+	run  func(span *trace.Span) error
+}
+
+// NewJobQueue starts the workers of a queue that holds at most size jobs.
+func NewJobQueue(workers, size int) *JobQueue {
+	q := &JobQueue{
+		jobs: make(chan *job, size),
+	}
+	q.running.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+func (q *JobQueue) work() {
+	defer q.running.Done()
+	for j := range q.jobs {
+		j.execute()
+	}
+}
+
+func (j *job) execute() {
+	err := j.run(j.span)
+	if err != nil {
+		j.span.Logf("%s", err)
+	}
+	j.span.SetError(err)
+	j.span.Finish()
+}
+
+// Add queues the job named name of the request traced by span. It reports
+// whether the job was queued, which is not the case if the queue is full or
+// stopped.
+func (q *JobQueue) Add(span *trace.Span, name string, run func(span *trace.Span) error) bool {
+	j := &job{
+		span: span.Child(name, trace.SpanKindInternal),
+		run:  run,
+	}
+	if q == nil {
+		j.execute()
+		return true
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.stopped {
+		span.Logf("Job queue stopped, %s dropped", name)
+		return false
+	}
+	select {
+	case q.jobs <- j:
+		return true
+	default:
+		span.Logf("Job queue full, %s dropped", name)
+		jobsDroppedTotal.Inc()
+		return false
+	}
+}
+
+// Stop stops accepting new jobs and waits at most timeout for the queued jobs
+// to finish.
+func (q *JobQueue) Stop(timeout time.Duration) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	if !q.stopped {
+		q.stopped = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return errJobQueueTimeout
+	}
+}
@@ -0,0 +1,68 @@
+package service_test
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-user-management/service"
+	"github.com/opentarock/service-user-management/trace"
+)
+
+func TestStopWaitsForQueuedJobs(t *testing.T) {
+	jobs := service.NewJobQueue(2, 10)
+	var finished int32
+	for i := 0; i < 5; i++ {
+		queued := jobs.Add(nil, "Job", func(span *trace.Span) error {
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&finished, 1)
+			return nil
+		})
+		assert.True(t, queued)
+	}
+	assert.Nil(t, jobs.Stop(time.Second))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&finished))
+}
+
+func TestJobsAreNotQueuedAfterStop(t *testing.T) {
+	jobs := service.NewJobQueue(1, 10)
+	assert.Nil(t, jobs.Stop(time.Second))
+	queued := jobs.Add(nil, "Job", func(span *trace.Span) error {
+		t.Error("job was run after stop")
+		return nil
+	})
+	assert.False(t, queued)
+}
+
+func TestJobsAreDroppedWhenQueueIsFull(t *testing.T) {
+	jobs := service.NewJobQueue(1, 1)
+	release := make(chan struct{})
+	block := func(span *trace.Span) error {
+		<-release
+		return nil
+	}
+	queued := 0
+	for i := 0; i < 3; i++ {
+		if jobs.Add(nil, "Job", block) {
+			queued++
+		}
+	}
+	close(release)
+	assert.Nil(t, jobs.Stop(time.Second))
+	assert.True(t, queued < 3, "jobs beyond the queue size are dropped")
+}
+
+func TestJobsRunImmediatelyWithoutQueue(t *testing.T) {
+	var jobs *service.JobQueue
+	ran := false
+	queued := jobs.Add(nil, "Job", func(span *trace.Span) error {
+		ran = true
+		return errors.New("failed")
+	})
+	assert.True(t, queued)
+	assert.True(t, ran)
+	assert.Nil(t, jobs.Stop(time.Second))
+}
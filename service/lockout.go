@@ -0,0 +1,168 @@
+package service
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/opentarock/service-user-management/repository"
+	"github.com/opentarock/service-user-management/trace"
+)
+
+// LockoutPolicy decides how long logins are blocked after consecutive failed
+// logins.
+type LockoutPolicy struct {
+	// FreeAttempts is the number of failures before logins are delayed.
+	FreeAttempts int
+	// Delay is the time logins are blocked after the first failure past the
+	// free attempts. It is doubled with every further failure up to MaxDelay.
+	Delay    time.Duration
+	MaxDelay time.Duration
+	// Threshold is the number of failures after which logins are locked for
+	// LockoutDuration. Logins are never locked if it is zero.
+	Threshold       int
+	LockoutDuration time.Duration
+	// Window is the time after the last failure when failures are forgotten.
+	Window time.Duration
+}
+
+// Default policies for failed logins of an account and from a source. Sources
+// are allowed more failures because many users can share an address.
+var (
+	DefaultAccountLockout = LockoutPolicy{
+		FreeAttempts:    3,
+		Delay:           time.Second,
+		MaxDelay:        30 * time.Second,
+		Threshold:       10,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	}
+	DefaultSourceLockout = LockoutPolicy{
+		FreeAttempts:    20,
+		Delay:           time.Second,
+		MaxDelay:        30 * time.Second,
+		Threshold:       100,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	}
+)
+
+// BlockedFor returns for how long logins are blocked after the failed
+// attempts.
+func (p LockoutPolicy) BlockedFor(attempts *repository.LoginAttempts, now time.Time) time.Duration {
+	if attempts == nil || now.Sub(attempts.LastFailureOn) >= p.Window {
+		return 0
+	}
+	var blocked time.Duration
+	if p.Threshold > 0 && attempts.Failures >= p.Threshold {
+		blocked = p.LockoutDuration
+	} else if attempts.Failures > p.FreeAttempts && p.Delay > 0 {
+		blocked = p.Delay
+		for i := p.FreeAttempts + 1; i < attempts.Failures && blocked < p.MaxDelay; i++ {
+			blocked *= 2
+		}
+		if blocked > p.MaxDelay {
+			blocked = p.MaxDelay
+		}
+	}
+	if remaining := attempts.LastFailureOn.Add(blocked).Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// LoginLockout tracks failed logins per account and per source and blocks
+// logins after too many failures. Logins are allowed if the failed logins can
+// not be retrieved so that a broken database does not stop logins. All
+// methods can be called on nil, which does not block any logins.
+type LoginLockout struct {
+	attempts repository.LoginAttemptRepository
+	Account  LockoutPolicy
+	Source   LockoutPolicy
+}
+
+func NewLoginLockout(attempts repository.LoginAttemptRepository) *LoginLockout {
+	return &LoginLockout{
+		attempts: attempts,
+		Account:  DefaultAccountLockout,
+		Source:   DefaultSourceLockout,
+	}
+}
+
+// BlockedFor returns for how long logins to the account from the source are
+// blocked. Source is not checked if it is empty.
+func (l *LoginLockout) BlockedFor(span *trace.Span, email, source string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	now := time.Now()
+	blocked := l.Account.BlockedFor(l.find(span, repository.AccountLoginKey(email)), now)
+	if source != "" {
+		if b := l.Source.BlockedFor(l.find(span, repository.SourceLoginKey(source)), now); b > blocked {
+			blocked = b
+		}
+	}
+	return blocked
+}
+
+func (l *LoginLockout) find(span *trace.Span, key string) *repository.LoginAttempts {
+	done := traceRepository(span, "LoginAttempt.Find")
+	attempts, err := l.attempts.Find(key)
+	done(err)
+	if err != nil && err != sql.ErrNoRows {
+		span.Logf("Error retrieving failed logins: %s", err)
+	}
+	return attempts
+}
+
+// Failed records a failed login to the account from the source.
+func (l *LoginLockout) Failed(span *trace.Span, email, source string) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	l.recordFailure(span, repository.AccountLoginKey(email), l.Account, now)
+	if source != "" {
+		l.recordFailure(span, repository.SourceLoginKey(source), l.Source, now)
+	}
+}
+
+func (l *LoginLockout) recordFailure(span *trace.Span, key string, policy LockoutPolicy, now time.Time) {
+	done := traceRepository(span, "LoginAttempt.RecordFailure")
+	attempts, err := l.attempts.RecordFailure(key, now, now.Add(-policy.Window))
+	done(err)
+	if err != nil {
+		span.Logf("Error recording failed login: %s", err)
+	} else if policy.Threshold > 0 && attempts.Failures == policy.Threshold {
+		span.Logf("Logins locked after %d failures: %s", attempts.Failures, key)
+		loginLockoutsTotal.Inc()
+	}
+}
+
+// Succeeded forgets the failed logins to the account. Failures from the source
+// are kept so that an attacker can not reset them with an account of their own.
+func (l *LoginLockout) Succeeded(span *trace.Span, email string) {
+	if l == nil {
+		return
+	}
+	l.Unlock(span, repository.AccountLoginKey(email))
+}
+
+// Unlock forgets the failed logins of the key, see repository.AccountLoginKey
+// and repository.SourceLoginKey.
+func (l *LoginLockout) Unlock(span *trace.Span, key string) (bool, error) {
+	if l == nil {
+		return false, nil
+	}
+	done := traceRepository(span, "LoginAttempt.Reset")
+	unlocked, err := l.attempts.Reset(key)
+	done(err)
+	if err != nil {
+		span.Logf("Error resetting failed logins: %s", err)
+	}
+	return unlocked, err
+}
+
+// secondsCeil returns the duration in whole seconds, rounded up.
+func secondsCeil(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,169 @@
+package service_test
+
+import (
+	"database/sql"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/nnservice"
+	"github.com/opentarock/service-user-management/repository"
+	"github.com/opentarock/service-user-management/service"
+)
+
+type LoginAttemptRepositoryMock struct {
+	mock.Mock
+}
+
+func NewLoginAttemptRepositoryMock() *LoginAttemptRepositoryMock {
+	return &LoginAttemptRepositoryMock{}
+}
+
+func (r *LoginAttemptRepositoryMock) Find(key string) (*repository.LoginAttempts, error) {
+	args := r.Mock.Called(key)
+	attempts, _ := args.Get(0).(*repository.LoginAttempts)
+	return attempts, args.Error(1)
+}
+
+func (r *LoginAttemptRepositoryMock) RecordFailure(key string, at, since time.Time) (*repository.LoginAttempts, error) {
+	args := r.Mock.Called(key)
+	attempts, _ := args.Get(0).(*repository.LoginAttempts)
+	return attempts, args.Error(1)
+}
+
+func (r *LoginAttemptRepositoryMock) Reset(key string) (bool, error) {
+	args := r.Mock.Called(key)
+	return args.Bool(0), args.Error(1)
+}
+
+func attemptsAgo(failures int, ago time.Duration) *repository.LoginAttempts {
+	return &repository.LoginAttempts{
+		Failures:      failures,
+		LastFailureOn: time.Now().Add(-ago),
+	}
+}
+
+func TestLoginsAreDelayedProgressively(t *testing.T) {
+	policy := service.LockoutPolicy{
+		FreeAttempts:    2,
+		Delay:           time.Second,
+		MaxDelay:        5 * time.Second,
+		Threshold:       10,
+		LockoutDuration: time.Minute,
+		Window:          time.Hour,
+	}
+	now := time.Now()
+	at := func(failures int) *repository.LoginAttempts {
+		return &repository.LoginAttempts{Failures: failures, LastFailureOn: now}
+	}
+	assert.Equal(t, time.Duration(0), policy.BlockedFor(nil, now))
+	assert.Equal(t, time.Duration(0), policy.BlockedFor(at(2), now))
+	assert.Equal(t, time.Second, policy.BlockedFor(at(3), now))
+	assert.Equal(t, 2*time.Second, policy.BlockedFor(at(4), now))
+	assert.Equal(t, 4*time.Second, policy.BlockedFor(at(5), now))
+	assert.Equal(t, 5*time.Second, policy.BlockedFor(at(9), now))
+	assert.Equal(t, time.Minute, policy.BlockedFor(at(10), now))
+
+	// Blocked time counts from the last failure.
+	assert.Equal(t, 30*time.Second, policy.BlockedFor(at(10), now.Add(30*time.Second)))
+	// Logins are unlocked automatically.
+	assert.Equal(t, time.Duration(0), policy.BlockedFor(at(10), now.Add(time.Minute)))
+	assert.Equal(t, time.Duration(0), policy.BlockedFor(at(50), now.Add(time.Hour)))
+}
+
+func TestLockedAccountIsNotAuthenticated(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	attempts := NewLoginAttemptRepositoryMock()
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+	handlers.Lockout = service.NewLoginLockout(attempts)
+
+	user := NewValidUser()
+	authUser := &proto_user.AuthenticateUser{
+		Email:    proto.String("Mail@Example.com"),
+		Password: user.Password,
+	}
+	// Password is not checked while the account is locked, so the user
+	// repository is not expected to be called.
+	attempts.On("Find", "account:mail@example.com").Return(attemptsAgo(10, time.Minute), nil)
+
+	result := handleMessage(t, authUser, handlers.AuthenticateUserMessageHandler(nil))
+	var authResult proto_user.AuthenticateResult
+	err := proto.Unmarshal(result, &authResult)
+	assert.Nil(t, err)
+	assert.Empty(t, authResult.GetSid())
+}
+
+func TestLoginIsBlockedForLockedClientAddress(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	attempts := NewLoginAttemptRepositoryMock()
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+	handlers.Lockout = service.NewLoginLockout(attempts)
+
+	authUser := &proto_user.AuthenticateUser{
+		Email:    proto.String("mail@example.com"),
+		Password: proto.String("password"),
+	}
+	attempts.On("Find", "account:mail@example.com").Return(nil, sql.ErrNoRows)
+	attempts.On("Find", "source:192.0.2.1").Return(attemptsAgo(100, 5*time.Minute), nil)
+
+	messageData, err := proto.Marshal(authUser)
+	assert.Nil(t, err)
+	header := &nnservice.Header{}
+	header.Set(nnservice.HeaderCaller, "frontend")
+	header.Set(nnservice.HeaderClientAddress, "192.0.2.1")
+	result, err := handlers.AuthenticateUserMessageHandler(nil).HandleMessage(header, messageData)
+	assert.Nil(t, err)
+	var authResult proto_user.AuthenticateResult
+	err = proto.Unmarshal(result, &authResult)
+	assert.Nil(t, err)
+	assert.Empty(t, authResult.GetSid())
+}
+
+func TestFailedLoginIsRecorded(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	attempts := NewLoginAttemptRepositoryMock()
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+	handlers.Lockout = service.NewLoginLockout(attempts)
+
+	authUser := &proto_user.AuthenticateUser{
+		Email:    proto.String("mail@example.com"),
+		Password: proto.String("wrong"),
+	}
+	attempts.On("Find", "account:mail@example.com").Return(nil, sql.ErrNoRows)
+	attempts.On("RecordFailure", "account:mail@example.com").Return(attemptsAgo(1, 0), nil)
+	userRepository.On("FindByEmailAndPassword", "mail@example.com", "wrong").
+		Return(nil, repository.ErrCredentialsMismatch)
+
+	handleMessage(t, authUser, handlers.AuthenticateUserMessageHandler(nil))
+	attempts.AssertExpectations(t)
+}
+
+func TestPasswordGrantIsRejectedWhenSourceIsLocked(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	clientRepository := &ClientRepositoryMock{}
+	attempts := NewLoginAttemptRepositoryMock()
+	handlers := service.NewOauth2ServiceHandlers(userRepository, clientRepository, nil)
+	handlers.Lockout = service.NewLoginLockout(attempts)
+
+	clientRepository.On("FindById", "client").Return(newTestClient(), nil)
+	attempts.On("Find", "account:mail@example.com").Return(nil, sql.ErrNoRows)
+	attempts.On("Find", "source:192.0.2.1").Return(attemptsAgo(100, 5*time.Minute), nil)
+
+	form := url.Values{
+		"grant_type": {"password"},
+		"username":   {"mail@example.com"},
+		"password":   {"password"},
+	}
+	request := tokenRequest(form, "client", "secret")
+	request.RemoteAddr = "192.0.2.1:4321"
+	recorder, body := serveToken(handlers.TokenEndpoint(nil), request)
+	assert.Equal(t, 400, recorder.Code)
+	assert.Equal(t, "invalid_grant", body["error"])
+	assert.True(t, strings.HasPrefix(body["error_description"].(string), "Too many failed login attempts"))
+}
@@ -0,0 +1,95 @@
+package service
+
+import "github.com/opentarock/service-user-management/i18n"
+
+// DefaultLocale is the locale of the built-in messages.
+const DefaultLocale = "en"
+
+// DefaultMessages returns a catalog with the built-in English messages.
+// Translations to other locales can be added to it.
+func DefaultMessages() *i18n.Catalog {
+	return i18n.NewCatalog(DefaultLocale, i18n.Messages{
+		"display_name.empty": {
+			i18n.PluralOther: "Display Name must not be empty.",
+		},
+		"display_name.length": {
+			i18n.PluralOther: "Display Name length must be between %d and %d characters.",
+		},
+		"email.empty": {
+			i18n.PluralOther: "Email must not be empty.",
+		},
+		"email.missing_at": {
+			i18n.PluralOther: "Email must contain an at sign (@).",
+		},
+		"email.invalid_domain": {
+			i18n.PluralOther: "Email domain is not valid.",
+		},
+		"email.invalid": {
+			i18n.PluralOther: "Email is not a valid email address.",
+		},
+		"email.domain_not_accepted": {
+			i18n.PluralOther: "Email addresses from this domain are not accepted.",
+		},
+		"email.taken": {
+			i18n.PluralOther: "Email address is already registered.",
+		},
+		"password.empty": {
+			i18n.PluralOther: "Password must not be empty.",
+		},
+		"password.too_short": {
+			i18n.PluralOne:   "Password must be at least %d character long.",
+			i18n.PluralOther: "Password must be at least %d characters long.",
+		},
+		"password.too_long": {
+			i18n.PluralOne:   "Password length must not exceed %d character.",
+			i18n.PluralOther: "Password length must not exceed %d characters.",
+		},
+		"password.character_classes": {
+			i18n.PluralOther: "Password must contain at least %d of: lowercase letters, " +
+				"uppercase letters, digits and symbols.",
+		},
+		"password.user_data": {
+			i18n.PluralOther: "Password must not contain your email address or display name.",
+		},
+		"password.weak": {
+			i18n.PluralOther: "Password is too easy to guess.",
+		},
+		"password.breached": {
+			i18n.PluralOther: "Password has appeared in a data breach and can not be used.",
+		},
+		"redirect_uri.invalid": {
+			i18n.PluralOther: "Redirect URI is not valid.",
+		},
+		"redirect_uri.not_registered": {
+			i18n.PluralOther: "Redirect URI is not registered for this application.",
+		},
+		"redirect_uri.missing": {
+			i18n.PluralOther: "Redirect URI must be given.",
+		},
+		"verification_email.subject": {
+			i18n.PluralOther: "Verify your email address",
+		},
+		"verification_email.body": {
+			i18n.PluralOther: "Hello %[3]s,\n\nplease verify your email address by opening this link:\n\n%[2]s\n\n" +
+				"The link expires in %[1]s. If you did not register, you can ignore this email.\n",
+		},
+		"duration.hours": {
+			i18n.PluralOne:   "%d hour",
+			i18n.PluralOther: "%d hours",
+		},
+		"duration.minutes": {
+			i18n.PluralOne:   "%d minute",
+			i18n.PluralOther: "%d minutes",
+		},
+		"password_reset_email.subject": {
+			i18n.PluralOther: "Reset your password",
+		},
+		"password_reset_email.body": {
+			i18n.PluralOther: "Hello %[3]s,\n\nyou can set a new password by opening this link:\n\n%[2]s\n\n" +
+				"The link expires in %[1]s. If you did not ask to reset your password, you can ignore this email.\n",
+		},
+		"password_reset.invalid_token": {
+			i18n.PluralOther: "Password reset link is not valid or has expired.",
+		},
+	})
+}
@@ -0,0 +1,80 @@
+package service_test
+
+import (
+	"testing"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/nnservice"
+	"github.com/opentarock/service-user-management/service"
+)
+
+func TestTranslationsHaveAllMessages(t *testing.T) {
+	catalog := service.DefaultMessages()
+	err := catalog.LoadDir("../locales")
+	assert.Nil(t, err)
+	en := catalog.Localizer("en")
+	for _, locale := range catalog.Locales() {
+		tr := catalog.Localizer(locale)
+		assert.Equal(t, locale, tr.Locale())
+		assert.NotEqual(t, "email.empty", tr.T("email.empty"), locale)
+		if locale != "en" {
+			assert.NotEqual(t, en.T("password.weak"), tr.T("password.weak"), locale)
+		}
+	}
+}
+
+func TestValidationErrorsAreTranslated(t *testing.T) {
+	handlers := service.NewUserServiceHandlers(nil, nil)
+	err := handlers.Messages.LoadDir("../locales")
+	assert.Nil(t, err)
+
+	registerUser := &proto_user.RegisterUser{
+		User: NewValidUser(),
+	}
+	registerUser.User.Password = proto.String("pass")
+	header := &nnservice.Header{}
+	header.Set(nnservice.HeaderAcceptLanguage, "fr-CH, de-AT;q=0.8, en;q=0.5")
+	messageData, err := proto.Marshal(registerUser)
+	assert.Nil(t, err)
+	result, err := handlers.RegisterUserMessageHandler().HandleMessage(header, messageData)
+	assert.Nil(t, err)
+
+	var registerResponse proto_user.RegisterResponse
+	err = proto.Unmarshal(result, &registerResponse)
+	assert.Nil(t, err)
+	assert.Equal(t, "de", registerResponse.GetLocale())
+	if assert.Len(t, registerResponse.GetErrors(), 1) {
+		assert.Equal(t, "Das Passwort muss mindestens 6 Zeichen lang sein.",
+			registerResponse.GetErrors()[0].GetErrorMessage())
+	}
+}
+
+func TestLocaleOfMessageTakesPrecedence(t *testing.T) {
+	handlers := service.NewUserServiceHandlers(nil, nil)
+	err := handlers.Messages.LoadDir("../locales")
+	assert.Nil(t, err)
+
+	registerUser := &proto_user.RegisterUser{
+		User:   NewValidUser(),
+		Locale: proto.String("en_US"),
+	}
+	registerUser.User.Password = proto.String("pass")
+	header := &nnservice.Header{}
+	header.Set(nnservice.HeaderAcceptLanguage, "de")
+	messageData, err := proto.Marshal(registerUser)
+	assert.Nil(t, err)
+	result, err := handlers.RegisterUserMessageHandler().HandleMessage(header, messageData)
+	assert.Nil(t, err)
+
+	var registerResponse proto_user.RegisterResponse
+	err = proto.Unmarshal(result, &registerResponse)
+	assert.Nil(t, err)
+	assert.Equal(t, "en", registerResponse.GetLocale())
+	if assert.Len(t, registerResponse.GetErrors(), 1) {
+		assert.Equal(t, "Password must be at least 6 characters long.",
+			registerResponse.GetErrors()[0].GetErrorMessage())
+	}
+}
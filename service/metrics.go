@@ -0,0 +1,99 @@
+package service
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Values of the method label of failed logins.
+const (
+	loginMethodSession       = "session"
+	loginMethodPasswordGrant = "password_grant"
+)
+
+var (
+	registrationsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "user_management",
+		Name:      "registrations_total",
+		Help:      "Number of registered users.",
+	})
+
+	loginFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "user_management",
+		Name:      "login_failures_total",
+		Help:      "Number of failed logins because of wrong user credentials.",
+	}, []string{"method"})
+
+	loginsBlockedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "user_management",
+		Name:      "logins_blocked_total",
+		Help:      "Number of logins rejected without checking credentials because of previous failures.",
+	}, []string{"method"})
+
+	loginLockoutsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "user_management",
+		Name:      "login_lockouts_total",
+		Help:      "Number of accounts and sources locked because of failed logins.",
+	})
+
+	loginsUnverifiedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "user_management",
+		Name:      "logins_unverified_total",
+		Help:      "Number of logins with valid credentials denied because the email address is not verified.",
+	}, []string{"method"})
+
+	verificationEmailsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "user_management",
+		Name:      "verification_emails_total",
+		Help:      "Number of sent email verification links.",
+	})
+
+	passwordResetEmailsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "user_management",
+		Name:      "password_reset_emails_total",
+		Help:      "Number of sent password reset links.",
+	})
+
+	passwordResetsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "user_management",
+		Name:      "password_resets_total",
+		Help:      "Number of passwords changed with a reset link.",
+	})
+
+	jobsDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "user_management",
+		Name:      "jobs_dropped_total",
+		Help:      "Number of background jobs, e.g. sending emails, dropped because the job queue was full.",
+	})
+
+	tokensIssuedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "user_management",
+		Name:      "tokens_issued_total",
+		Help:      "Number of access tokens issued for owner credentials.",
+	})
+
+	tokensRefreshedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "user_management",
+		Name:      "tokens_refreshed_total",
+		Help:      "Number of access tokens issued for refresh tokens.",
+	})
+
+	tokensValidatedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "user_management",
+		Name:      "tokens_validated_total",
+		Help:      "Number of validated access tokens.",
+	}, []string{"valid"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		registrationsTotal,
+		loginFailuresTotal,
+		loginsBlockedTotal,
+		loginLockoutsTotal,
+		loginsUnverifiedTotal,
+		verificationEmailsTotal,
+		passwordResetEmailsTotal,
+		passwordResetsTotal,
+		jobsDroppedTotal,
+		tokensIssuedTotal,
+		tokensRefreshedTotal,
+		tokensValidatedTotal)
+}
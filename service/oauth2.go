@@ -1,19 +1,18 @@
 package service
 
 import (
+	"crypto/subtle"
 	"database/sql"
 	"fmt"
-	"log"
-
-	"crypto/subtle"
 
 	"code.google.com/p/gogoprotobuf/proto"
 	"github.com/arjantop/oauth2-util"
 	"github.com/opentarock/service-api/go/proto_oauth2"
+	"github.com/opentarock/service-user-management/events"
 	"github.com/opentarock/service-user-management/nnservice"
 	"github.com/opentarock/service-user-management/repository"
+	"github.com/opentarock/service-user-management/trace"
 	"github.com/opentarock/service-user-management/util"
-	"github.com/opentarock/service-user-management/util/logutil"
 )
 
 const (
@@ -25,6 +24,21 @@ type oauth2ServiceHandlers struct {
 	userRepository        repository.UserRepository
 	clientRepository      repository.ClientRepository
 	accessTokenRepository repository.AccessTokenRepository
+	// Outbox is used for failed authentication events, which are optional.
+	Outbox repository.OutboxRepository
+	// Lockout blocks password grants after failed logins. Logins are not
+	// blocked if it is not set.
+	Lockout *LoginLockout
+	// Verifier denies password grants of users who did not verify their email
+	// address if verified addresses are required.
+	Verifier *EmailVerifier
+	// TrustedProxies are used by the token endpoint to find the address of the
+	// end user when it is behind reverse proxies.
+	TrustedProxies nnservice.TrustedProxies
+	// TokenEndpointMiddleware is applied to the requests of the token endpoint
+	// like to access token messages, e.g. to limit their rate. Only the
+	// errors of the middleware are used, the reply is created by the endpoint.
+	TokenEndpointMiddleware []nnservice.Middleware
 }
 
 func NewOauth2ServiceHandlers(
@@ -40,58 +54,66 @@ func NewOauth2ServiceHandlers(
 }
 
 func (s *oauth2ServiceHandlers) AccessTokenRequestHandler(tokenGenerator util.TokenGenerator) nnservice.MessageHandler {
-	return nnservice.MessageHandlerFunc(func(data []byte) []byte {
-		accessTokenRequest := &proto_oauth2.AccessTokenAuthentication{}
-		err := proto.Unmarshal(data, accessTokenRequest)
+	return nnservice.WithMessageTypes(nnservice.ProtoHandler(newAccessTokenAuthentication, func(header *nnservice.Header, message proto.Message) (proto.Message, error) {
+		accessTokenRequest := message.(*proto_oauth2.AccessTokenAuthentication)
+		accessTokenResponse, err := s.accessToken(
+			header.Span, header.Get(nnservice.HeaderClientAddress), tokenGenerator, accessTokenRequest.GetClient(), accessTokenRequest.GetRequest())
 		if err != nil {
-			logutil.ErrorNormal("Error unmarshalling AccessTokenRequest", err)
-			return nil
+			return nil, err
 		}
-		accessTokenResponse := &proto_oauth2.AccessTokenResponse{}
-
-		if accessTokenRequest.Client == nil {
-			accessTokenResponse.Error = proto_oauth2.NewInvalidClientError("Missing client authentication.")
-			log.Println(accessTokenResponse.Error.GetErrorDescription())
-		} else if accessTokenRequest.GetClient().GetId() == "" {
-			accessTokenResponse.Error = proto_oauth2.NewInvalidClientError("Empty client id.")
-			log.Println(accessTokenResponse.Error.GetErrorDescription())
+		// response is successful only if error was not set
+		accessTokenResponse.Success = proto.Bool(accessTokenResponse.Error == nil)
+		return accessTokenResponse, nil
+	}), newAccessTokenAuthentication(), newAccessTokenResponse())
+}
+
+// accessToken authenticates the client and issues an access token for the
+// grant in the request. Source identifies where the request comes from for
+// tracking failed logins. Errors defined by the OAuth2 specification are
+// returned in the response, the returned error is set only on internal errors.
+func (s *oauth2ServiceHandlers) accessToken(
+	span *trace.Span,
+	source string,
+	tokenGenerator util.TokenGenerator,
+	clientCredentials *proto_oauth2.Client,
+	request *proto_oauth2.AccessTokenRequest) (*proto_oauth2.AccessTokenResponse, error) {
+
+	accessTokenResponse := &proto_oauth2.AccessTokenResponse{}
+
+	if clientCredentials == nil {
+		accessTokenResponse.Error = proto_oauth2.NewInvalidClientError("Missing client authentication.")
+		span.Logf("%s", accessTokenResponse.Error.GetErrorDescription())
+	} else if clientCredentials.GetId() == "" {
+		accessTokenResponse.Error = proto_oauth2.NewInvalidClientError("Empty client id.")
+		span.Logf("%s", accessTokenResponse.Error.GetErrorDescription())
+	} else {
+		done := traceRepository(span, "Client.FindById")
+		client, err := s.clientRepository.FindById(clientCredentials.GetId())
+		done(err)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("Error retrieving client: %s", err)
+		} else if err == sql.ErrNoRows || !clientEquals(client, clientCredentials) {
+			accessTokenResponse.Error = proto_oauth2.NewInvalidClientError("Client not found.")
+			span.Logf("Unknown client: %s", clientCredentials.GetId())
 		} else {
-			request := accessTokenRequest.GetRequest()
-			client, err := s.clientRepository.FindById(accessTokenRequest.GetClient().GetId())
-			if err == sql.ErrNoRows || !clientEquals(client, accessTokenRequest.GetClient()) {
-				accessTokenResponse.Error = proto_oauth2.NewInvalidClientError("Client not found.")
-				log.Printf("Unknown client: %s", accessTokenRequest.GetClient().GetId())
-			} else if err != nil {
-				logutil.ErrorNormal("Error retrieving client", err)
-				return nil
-			} else {
-				var err error
-				switch request.GetGrantType() {
-				case oauth2.GrantTypePassword:
-					accessTokenResponse, err = s.handleGrantTypePassword(tokenGenerator, client, request)
-				case oauth2.GrantTypeRefreshToken:
-					accessTokenResponse, err = s.handleGrantTypeRefreshToken(tokenGenerator, client, request)
-				default:
-					accessTokenResponse = &proto_oauth2.AccessTokenResponse{
-						Error: &proto_oauth2.ErrorResponse{
-							Error:            proto.String(oauth2.ErrorUnsupportedGrantType),
-							ErrorDescription: proto.String(fmt.Sprintf("Unsupported grant type: %s.", request.GetGrantType())),
-						},
-					}
-				}
-				if err != nil {
-					log.Println(err)
-					return nil
+			switch request.GetGrantType() {
+			case oauth2.GrantTypePassword:
+				return s.handleGrantTypePassword(span, source, tokenGenerator, client, request)
+			case oauth2.GrantTypeRefreshToken:
+				return s.handleGrantTypeRefreshToken(span, tokenGenerator, client, request)
+			default:
+				accessTokenResponse.Error = &proto_oauth2.ErrorResponse{
+					Error:            proto.String(oauth2.ErrorUnsupportedGrantType),
+					ErrorDescription: proto.String(fmt.Sprintf("Unsupported grant type: %s.", request.GetGrantType())),
 				}
 			}
 		}
+	}
+	return accessTokenResponse, nil
+}
 
-		// response is successful only if error was not set
-		accessTokenResponse.Success = proto.Bool(accessTokenResponse.Error == nil)
-		responseData, err := proto.Marshal(accessTokenResponse)
-		logutil.ErrorFatal("Error marshalling AccessTokenResponse", err)
-		return responseData
-	})
+func newAccessTokenAuthentication() proto.Message {
+	return &proto_oauth2.AccessTokenAuthentication{}
 }
 
 func clientEquals(client, clientOther *proto_oauth2.Client) bool {
@@ -100,15 +122,33 @@ func clientEquals(client, clientOther *proto_oauth2.Client) bool {
 }
 
 func (s *oauth2ServiceHandlers) handleGrantTypePassword(
+	span *trace.Span,
+	source string,
 	tokenGenerator util.TokenGenerator,
 	client *proto_oauth2.Client,
 	request *proto_oauth2.AccessTokenRequest) (*proto_oauth2.AccessTokenResponse, error) {
 
 	accessTokenResponse := &proto_oauth2.AccessTokenResponse{}
 
+	if blocked := s.Lockout.BlockedFor(span, request.GetUsername(), source); blocked > 0 {
+		span.Logf("Login blocked for %s: username=%s", blocked, request.GetUsername())
+		loginsBlockedTotal.WithLabelValues(loginMethodPasswordGrant).Inc()
+		accessTokenResponse.Error = &proto_oauth2.ErrorResponse{
+			Error: proto.String(oauth2.ErrorInvalidGrant),
+			ErrorDescription: proto.String(fmt.Sprintf(
+				"Too many failed login attempts, try again in %d seconds.", secondsCeil(blocked))),
+		}
+		return accessTokenResponse, nil
+	}
+
+	done := traceRepository(span, "User.FindByEmailAndPassword")
 	user, err := s.userRepository.FindByEmailAndPassword(request.GetUsername(), request.GetPassword())
+	done(err)
 	if err != nil {
 		if err == repository.ErrCredentialsMismatch {
+			loginFailuresTotal.WithLabelValues(loginMethodPasswordGrant).Inc()
+			s.Lockout.Failed(span, request.GetUsername(), source)
+			recordEvent(span, s.Outbox, events.NewAuthenticationFailed(request.GetUsername(), loginMethodPasswordGrant))
 			accessTokenResponse = &proto_oauth2.AccessTokenResponse{
 				Error: &proto_oauth2.ErrorResponse{
 					Error:            proto.String(oauth2.ErrorInvalidGrant),
@@ -119,21 +159,39 @@ func (s *oauth2ServiceHandlers) handleGrantTypePassword(
 			return nil, fmt.Errorf("Error retrieving user: %s", err)
 		}
 	} else {
+		s.Lockout.Succeeded(span, request.GetUsername())
+		allowed, err := s.Verifier.AllowsLogin(span, user)
+		if err != nil {
+			return nil, err
+		} else if !allowed {
+			span.Logf("Login denied, email not verified: id=%d", user.GetId())
+			loginsUnverifiedTotal.WithLabelValues(loginMethodPasswordGrant).Inc()
+			accessTokenResponse.Error = &proto_oauth2.ErrorResponse{
+				Error:            proto.String(oauth2.ErrorInvalidGrant),
+				ErrorDescription: proto.String("Email address is not verified."),
+			}
+			return accessTokenResponse, nil
+		}
 		token, err := generateToken(tokenGenerator)
 		if err != nil {
 			return nil, fmt.Errorf("Error generating new token: %s", err)
 		}
 		accessTokenResponse.Token = token
-		err = s.accessTokenRepository.Save(user, client, accessTokenResponse.Token, nil)
+		done := traceRepository(span, "AccessToken.Save")
+		err = s.accessTokenRepository.Save(user, client, accessTokenResponse.Token, nil,
+			events.NewTokenIssued(user, client))
+		done(err)
 		if err != nil {
 			return nil, fmt.Errorf("Error persisting token: %s", err)
 		}
-		log.Printf("Authenticated client: %s", client.GetId())
+		span.Logf("Authenticated client: %s", client.GetId())
+		tokensIssuedTotal.Inc()
 	}
 	return accessTokenResponse, nil
 }
 
 func (s *oauth2ServiceHandlers) handleGrantTypeRefreshToken(
+	span *trace.Span,
 	tokenGenerator util.TokenGenerator,
 	client *proto_oauth2.Client,
 	request *proto_oauth2.AccessTokenRequest) (*proto_oauth2.AccessTokenResponse, error) {
@@ -148,13 +206,15 @@ func (s *oauth2ServiceHandlers) handleGrantTypeRefreshToken(
 		return accessTokenResponse, nil
 	}
 
+	done := traceRepository(span, "AccessToken.FindByRefreshToken")
 	currentToken, err := s.accessTokenRepository.FindByRefreshToken(client, request.GetRefreshToken())
+	done(err)
 	if err == sql.ErrNoRows {
 		accessTokenResponse.Error = &proto_oauth2.ErrorResponse{
 			Error:            proto.String(oauth2.ErrorInvalidGrant),
 			ErrorDescription: proto.String("Invalid refresh token"),
 		}
-		log.Printf("Refresh token %s not found", request.GetRefreshToken())
+		span.Logf("Refresh token not found: client_id=%s", client.GetId())
 		return accessTokenResponse, nil
 	} else if err != nil {
 		return nil, fmt.Errorf("Error retrieving token: %s", err)
@@ -164,16 +224,22 @@ func (s *oauth2ServiceHandlers) handleGrantTypeRefreshToken(
 	if err != nil {
 		return nil, fmt.Errorf("Error generating refreshed token: %s", err)
 	}
+	done = traceRepository(span, "AccessToken.FindUserForToken")
 	user, err := s.accessTokenRepository.FindUserForToken(currentToken)
+	done(err)
 	if err != nil {
 		return nil, fmt.Errorf("Error retrieving user: %s", err)
 	}
-	err = s.accessTokenRepository.Save(user, client, newToken, currentToken)
+	done = traceRepository(span, "AccessToken.Save")
+	err = s.accessTokenRepository.Save(user, client, newToken, currentToken,
+		events.NewTokenRefreshed(user, client))
+	done(err)
 	if err != nil {
-		return nil, fmt.Errorf("Error persisting token", err)
+		return nil, fmt.Errorf("Error persisting token: %s", err)
 	}
 
 	accessTokenResponse.Token = newToken
+	tokensRefreshedTotal.Inc()
 
 	return accessTokenResponse, nil
 }
@@ -196,50 +262,47 @@ func generateToken(tokenGenerator util.TokenGenerator) (*proto_oauth2.AccessToke
 }
 
 func (s *oauth2ServiceHandlers) ValidateHandler() nnservice.MessageHandler {
-	return nnservice.MessageHandlerFunc(func(data []byte) []byte {
-		validateRequest := &proto_oauth2.ValidateTokenRequest{}
-		err := proto.Unmarshal(data, validateRequest)
-		if err != nil {
-			logutil.ErrorNormal("Error unmarshalling ValidateRequest", err)
-			return nil
-		}
+	return nnservice.WithMessageTypes(nnservice.ProtoHandler(newValidateTokenRequest, func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+		return s.validateToken(header.Span, request.(*proto_oauth2.ValidateTokenRequest))
+	}), newValidateTokenRequest(), newValidateTokenResponse())
+}
 
-		validateResponse, err := s.validateToken(validateRequest)
-		if err != nil {
-			log.Println(err)
-			return []byte{}
-		}
-		responseData, err := proto.Marshal(validateResponse)
-		logutil.ErrorFatal("Error marshalling ResponseData", err)
-		return responseData
-	})
+func newValidateTokenRequest() proto.Message {
+	return &proto_oauth2.ValidateTokenRequest{}
 }
 
 func (s *oauth2ServiceHandlers) validateToken(
+	span *trace.Span,
 	validateRequest *proto_oauth2.ValidateTokenRequest) (*proto_oauth2.ValidateTokenResponse, error) {
 
 	// TODO: Implement scope functionality.
 	validateResponse := &proto_oauth2.ValidateTokenResponse{}
 	validateResponse.Scope = validateRequest.Scope
 
+	done := traceRepository(span, "AccessToken.FindByTokenRaw")
 	accessToken, err := s.accessTokenRepository.FindByTokenRaw(validateRequest.GetAccessToken())
-
+	done(err)
 	if err == sql.ErrNoRows {
-		log.Printf("Token not found or expired")
+		span.Logf("Token not found or expired")
+		tokensValidatedTotal.WithLabelValues("false").Inc()
 		validateResponse.Valid = proto.Bool(false)
 		return validateResponse, nil
 	} else if err != nil {
 		return nil, fmt.Errorf("Invalid access token: %s", err)
 	}
 	if accessToken.ParentToken != nil {
-		err := s.accessTokenRepository.DeleteParents(accessToken)
+		done := traceRepository(span, "AccessToken.DeleteParents")
+		err := s.accessTokenRepository.DeleteParents(accessToken,
+			events.NewTokenRevoked(accessToken.UserId, accessToken.ClientId))
+		done(err)
 		if err != nil {
 			return nil, fmt.Errorf("Error deleting token parents: %s", err)
 		}
 	}
 
-	log.Printf("Success validating token of type %s", accessToken.Token.GetTokenType())
+	span.Logf("Success validating token of type %s", accessToken.Token.GetTokenType())
 
+	tokensValidatedTotal.WithLabelValues("true").Inc()
 	validateResponse.Valid = proto.Bool(true)
 	return validateResponse, nil
 }
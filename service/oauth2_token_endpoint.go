@@ -0,0 +1,236 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/arjantop/oauth2-util"
+	"github.com/opentarock/service-api/go/proto_oauth2"
+	"github.com/opentarock/service-user-management/nnservice"
+	"github.com/opentarock/service-user-management/trace"
+	"github.com/opentarock/service-user-management/util"
+)
+
+// Realm sent in the WWW-Authenticate header when client authentication fails.
+const tokenEndpointRealm = "oauth2"
+
+var errMalformedBasicAuth = errors.New("tokenEndpoint: malformed_basic_auth")
+
+// Request parameters of the token endpoint (RFC 6749 section 4.3.2 and 6).
+const (
+	parameterGrantType    = "grant_type"
+	parameterUsername     = "username"
+	parameterPassword     = "password"
+	parameterScope        = "scope"
+	parameterRefreshToken = "refresh_token"
+	parameterClientId     = "client_id"
+	parameterClientSecret = "client_secret"
+)
+
+// TokenEndpoint returns the OAuth2 token endpoint as defined by RFC 6749. It
+// accepts form encoded requests and authenticates clients with HTTP Basic
+// authentication or client credentials in the request body.
+func (s *oauth2ServiceHandlers) TokenEndpoint(tokenGenerator util.TokenGenerator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := trace.NewSpan("", r.Header.Get("X-Request-Id"), "POST "+r.URL.Path)
+		defer span.Finish()
+		w.Header().Set("X-Request-Id", span.RequestId)
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			writeTokenError(w, http.StatusMethodNotAllowed, oauth2.ErrorInvalidRequest,
+				"Token endpoint only accepts POST requests.")
+			return
+		}
+		clientCredentials, request, errorDescription := parseTokenRequest(r)
+		if errorDescription != "" {
+			span.Logf("Invalid token request: %s", errorDescription)
+			writeTokenError(w, http.StatusBadRequest, oauth2.ErrorInvalidRequest, errorDescription)
+			return
+		}
+
+		source := s.TrustedProxies.ClientAddress(r)
+		if err := s.tokenEndpointMiddleware(span, source, clientCredentials, request); err != nil {
+			if e, ok := err.(*nnservice.Error); ok && e.Code == nnservice.ErrorCodeRateLimited {
+				writeTokenError(w, http.StatusTooManyRequests, oauth2.ErrorInvalidRequest,
+					"Too many requests, try again later.")
+				return
+			}
+			span.SetError(err)
+			span.Logf("Error checking token request: %s", err)
+			writeTokenResponse(w, http.StatusInternalServerError, &proto_oauth2.ErrorResponse{
+				Error: proto.String("server_error"),
+			})
+			return
+		}
+		accessTokenResponse, err := s.accessToken(span, source, tokenGenerator, clientCredentials, request)
+		if err != nil {
+			span.SetError(err)
+			span.Logf("Error issuing access token: %s", err)
+			writeTokenResponse(w, http.StatusInternalServerError, &proto_oauth2.ErrorResponse{
+				Error: proto.String("server_error"),
+			})
+			return
+		}
+		if accessTokenResponse.Error != nil {
+			status := http.StatusBadRequest
+			if accessTokenResponse.Error.GetError() == oauth2.ErrorInvalidClient {
+				status = http.StatusUnauthorized
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+tokenEndpointRealm+`"`)
+			}
+			writeTokenResponse(w, status, accessTokenResponse.Error)
+			return
+		}
+		writeTokenResponse(w, http.StatusOK, accessTokenResponse.GetToken())
+	})
+}
+
+// tokenEndpointMiddleware passes the request through TokenEndpointMiddleware as
+// an access token message and returns the error of the middleware.
+func (s *oauth2ServiceHandlers) tokenEndpointMiddleware(
+	span *trace.Span,
+	source string,
+	clientCredentials *proto_oauth2.Client,
+	request *proto_oauth2.AccessTokenRequest) error {
+
+	if len(s.TokenEndpointMiddleware) == 0 {
+		return nil
+	}
+	header := &nnservice.Header{
+		MessageId: proto_oauth2.AccessTokenAuthenticationMessage,
+		RequestId: span.RequestId,
+		Span:      span,
+	}
+	if source != "" {
+		header.Set(nnservice.HeaderClientAddress, source)
+	}
+	data, err := proto.Marshal(&proto_oauth2.AccessTokenAuthentication{
+		Client:  clientCredentials,
+		Request: request,
+	})
+	if err != nil {
+		return err
+	}
+	pass := nnservice.MessageHandlerFunc(func(header *nnservice.Header, data []byte) ([]byte, error) {
+		return nil, nil
+	})
+	handler := nnservice.Chain(header.MessageId, pass, s.TokenEndpointMiddleware...)
+	_, err = handler.HandleMessage(header, data)
+	return err
+}
+
+// parseTokenRequest parses the form encoded token request. If the request is
+// invalid the description of the problem is returned.
+func parseTokenRequest(r *http.Request) (*proto_oauth2.Client, *proto_oauth2.AccessTokenRequest, string) {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		return nil, nil, "Content type must be application/x-www-form-urlencoded."
+	}
+	err := r.ParseForm()
+	if err != nil {
+		return nil, nil, "Malformed request body."
+	}
+	form := r.PostForm
+	for name, values := range form {
+		if len(values) > 1 {
+			return nil, nil, "Parameter must not be repeated: " + name
+		}
+	}
+	if form.Get(parameterGrantType) == "" {
+		return nil, nil, "Required parameter is missing: " + parameterGrantType
+	}
+
+	request := &proto_oauth2.AccessTokenRequest{
+		GrantType:    proto.String(form.Get(parameterGrantType)),
+		Username:     optionalString(form.Get(parameterUsername)),
+		Password:     optionalString(form.Get(parameterPassword)),
+		Scope:        optionalString(form.Get(parameterScope)),
+		RefreshToken: optionalString(form.Get(parameterRefreshToken)),
+	}
+
+	clientId, clientSecret, hasBasicAuth, err := basicAuth(r)
+	if err != nil {
+		return nil, nil, "Malformed Authorization header."
+	}
+	hasFormAuth := form.Get(parameterClientId) != ""
+	if hasBasicAuth && hasFormAuth {
+		return nil, nil, "Client must use only one authentication method."
+	}
+	if hasFormAuth {
+		clientId, clientSecret = form.Get(parameterClientId), form.Get(parameterClientSecret)
+	}
+	var client *proto_oauth2.Client
+	if hasBasicAuth || hasFormAuth {
+		client = &proto_oauth2.Client{
+			Id:     proto.String(clientId),
+			Secret: proto.String(clientSecret),
+		}
+	}
+	return client, request, ""
+}
+
+// basicAuth returns client credentials from the Authorization header. Client id
+// and secret are form encoded before they are Base64 encoded (RFC 6749 section
+// 2.3.1).
+func basicAuth(r *http.Request) (string, string, bool, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", "", false, nil
+	}
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false, err
+	}
+	credentials := strings.SplitN(string(decoded), ":", 2)
+	if len(credentials) != 2 {
+		return "", "", false, errMalformedBasicAuth
+	}
+	clientId, err := url.QueryUnescape(credentials[0])
+	if err != nil {
+		return "", "", false, err
+	}
+	clientSecret, err := url.QueryUnescape(credentials[1])
+	if err != nil {
+		return "", "", false, err
+	}
+	return clientId, clientSecret, true, nil
+}
+
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return proto.String(value)
+}
+
+func writeTokenError(w http.ResponseWriter, status int, errorCode, description string) {
+	writeTokenResponse(w, status, &proto_oauth2.ErrorResponse{
+		Error:            proto.String(errorCode),
+		ErrorDescription: proto.String(description),
+	})
+}
+
+// writeTokenResponse writes the JSON response. Token responses must never be
+// cached (RFC 6749 section 5.1).
+func writeTokenResponse(w http.ResponseWriter, status int, response proto.Message) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Error encoding token response: %s", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+	w.Write(body)
+}
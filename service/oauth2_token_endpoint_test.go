@@ -0,0 +1,257 @@
+package service_test
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/opentarock/service-api/go/proto_oauth2"
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/events"
+	"github.com/opentarock/service-user-management/nnservice"
+	"github.com/opentarock/service-user-management/repository"
+	"github.com/opentarock/service-user-management/service"
+)
+
+type ClientRepositoryMock struct {
+	mock.Mock
+}
+
+func (r *ClientRepositoryMock) FindById(clientId string) (*proto_oauth2.Client, error) {
+	args := r.Mock.Called(clientId)
+	client, _ := args.Get(0).(*proto_oauth2.Client)
+	return client, args.Error(1)
+}
+
+type AccessTokenRepositoryMock struct {
+	mock.Mock
+}
+
+func (r *AccessTokenRepositoryMock) Save(
+	user *proto_user.User,
+	client *proto_oauth2.Client,
+	accessToken *proto_oauth2.AccessToken,
+	parentToken *proto_oauth2.AccessToken,
+	newEvents ...*events.Event) error {
+
+	args := r.Mock.Called(user, client, accessToken, parentToken)
+	return args.Error(0)
+}
+
+func (r *AccessTokenRepositoryMock) DeleteParents(
+	accessToken *repository.AccessTokenRaw, newEvents ...*events.Event) error {
+
+	args := r.Mock.Called(accessToken)
+	return args.Error(0)
+}
+
+func (r *AccessTokenRepositoryMock) FindByTokenRaw(accessTokenRaw string) (*repository.AccessTokenRaw, error) {
+	args := r.Mock.Called(accessTokenRaw)
+	accessToken, _ := args.Get(0).(*repository.AccessTokenRaw)
+	return accessToken, args.Error(1)
+}
+
+func (r *AccessTokenRepositoryMock) FindUserForToken(accessToken *proto_oauth2.AccessToken) (*proto_user.User, error) {
+	args := r.Mock.Called(accessToken)
+	user, _ := args.Get(0).(*proto_user.User)
+	return user, args.Error(1)
+}
+
+func (r *AccessTokenRepositoryMock) FindByRefreshToken(
+	client *proto_oauth2.Client, refreshToken string) (*proto_oauth2.AccessToken, error) {
+
+	args := r.Mock.Called(client, refreshToken)
+	accessToken, _ := args.Get(0).(*proto_oauth2.AccessToken)
+	return accessToken, args.Error(1)
+}
+
+func newTestClient() *proto_oauth2.Client {
+	return &proto_oauth2.Client{
+		Id:     proto.String("client"),
+		Secret: proto.String("secret"),
+	}
+}
+
+func tokenRequest(form url.Values, clientId, clientSecret string) *http.Request {
+	request, _ := http.NewRequest("POST", "/oauth2/token", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientId != "" {
+		credentials := url.QueryEscape(clientId) + ":" + url.QueryEscape(clientSecret)
+		request.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	return request
+}
+
+func serveToken(handler http.Handler, request *http.Request) (*httptest.ResponseRecorder, map[string]interface{}) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	var body map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	return recorder, body
+}
+
+func TestTokenEndpointIssuesTokenForPasswordGrant(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	clientRepository := &ClientRepositoryMock{}
+	accessTokenRepository := &AccessTokenRepositoryMock{}
+	tokenGenerator := NewTokenGeneratorMock()
+	handlers := service.NewOauth2ServiceHandlers(userRepository, clientRepository, accessTokenRepository)
+
+	user := NewValidUser()
+	client := newTestClient()
+	clientRepository.On("FindById", "client").Return(client, nil)
+	userRepository.On("FindByEmailAndPassword", user.GetEmail(), user.GetPassword()).Return(user, nil)
+	tokenGenerator.On("GenerateHex", uint(32)).Return("token", nil)
+	accessTokenRepository.On("Save", user, client, mock.Anything, (*proto_oauth2.AccessToken)(nil)).Return(nil)
+
+	form := url.Values{
+		"grant_type": {"password"},
+		"username":   {user.GetEmail()},
+		"password":   {user.GetPassword()},
+	}
+	recorder, body := serveToken(handlers.TokenEndpoint(tokenGenerator), tokenRequest(form, "client", "secret"))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "no-store", recorder.Header().Get("Cache-Control"))
+	assert.Equal(t, "application/json;charset=UTF-8", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "token", body["access_token"])
+	assert.Equal(t, "Bearer", body["token_type"])
+	assert.Equal(t, "token", body["refresh_token"])
+	assert.NotNil(t, body["expires_in"])
+}
+
+func TestTokenEndpointAcceptsClientCredentialsInBody(t *testing.T) {
+	clientRepository := &ClientRepositoryMock{}
+	accessTokenRepository := &AccessTokenRepositoryMock{}
+	handlers := service.NewOauth2ServiceHandlers(nil, clientRepository, accessTokenRepository)
+
+	client := newTestClient()
+	clientRepository.On("FindById", "client").Return(client, nil)
+	accessTokenRepository.On("FindByRefreshToken", client, "refresh").Return(nil, sql.ErrNoRows)
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {"refresh"},
+		"client_id":     {"client"},
+		"client_secret": {"secret"},
+	}
+	recorder, body := serveToken(handlers.TokenEndpoint(nil), tokenRequest(form, "", ""))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "invalid_grant", body["error"])
+}
+
+func TestTokenEndpointRejectsUnknownClient(t *testing.T) {
+	clientRepository := &ClientRepositoryMock{}
+	handlers := service.NewOauth2ServiceHandlers(nil, clientRepository, nil)
+
+	clientRepository.On("FindById", "client").Return(nil, sql.ErrNoRows)
+
+	form := url.Values{"grant_type": {"password"}}
+	recorder, body := serveToken(handlers.TokenEndpoint(nil), tokenRequest(form, "client", "secret"))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, `Basic realm="oauth2"`, recorder.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, "invalid_client", body["error"])
+}
+
+func TestTokenEndpointFailsWhenClientCanNotBeRetrieved(t *testing.T) {
+	clientRepository := &ClientRepositoryMock{}
+	handlers := service.NewOauth2ServiceHandlers(nil, clientRepository, nil)
+
+	clientRepository.On("FindById", "client").Return(nil, sql.ErrConnDone)
+
+	form := url.Values{"grant_type": {"password"}}
+	recorder, body := serveToken(handlers.TokenEndpoint(nil), tokenRequest(form, "client", "secret"))
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Equal(t, "server_error", body["error"])
+}
+
+func TestTokenEndpointIsRateLimited(t *testing.T) {
+	clientRepository := &ClientRepositoryMock{}
+	handlers := service.NewOauth2ServiceHandlers(nil, clientRepository, nil)
+	endUserKey, err := service.EndUserKey(service.RateLimitKeyClientAddress)
+	assert.Nil(t, err)
+	handlers.TokenEndpointMiddleware = []nnservice.Middleware{
+		nnservice.RateLimited(nnservice.NewMemoryRateLimiter(), nnservice.RateLimit{Rate: 0.001, Burst: 1},
+			service.AccessTokenKey(endUserKey)),
+	}
+
+	clientRepository.On("FindById", "client").Return(nil, sql.ErrNoRows)
+
+	form := url.Values{"grant_type": {"password"}}
+	for _, status := range []int{http.StatusUnauthorized, http.StatusTooManyRequests} {
+		request := tokenRequest(form, "client", "secret")
+		request.RemoteAddr = "192.0.2.1:4321"
+		recorder, body := serveToken(handlers.TokenEndpoint(nil), request)
+		assert.Equal(t, status, recorder.Code)
+		if status == http.StatusTooManyRequests {
+			assert.Equal(t, "invalid_request", body["error"])
+		}
+	}
+}
+
+func TestTokenEndpointRejectsMissingClientAuthentication(t *testing.T) {
+	handlers := service.NewOauth2ServiceHandlers(nil, nil, nil)
+
+	form := url.Values{"grant_type": {"password"}}
+	recorder, body := serveToken(handlers.TokenEndpoint(nil), tokenRequest(form, "", ""))
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, "invalid_client", body["error"])
+}
+
+func TestTokenEndpointRejectsWrongOwnerCredentials(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	clientRepository := &ClientRepositoryMock{}
+	handlers := service.NewOauth2ServiceHandlers(userRepository, clientRepository, nil)
+
+	clientRepository.On("FindById", "client").Return(newTestClient(), nil)
+	userRepository.On("FindByEmailAndPassword", "mail@example.com", "wrong").
+		Return(nil, repository.ErrCredentialsMismatch)
+
+	form := url.Values{
+		"grant_type": {"password"},
+		"username":   {"mail@example.com"},
+		"password":   {"wrong"},
+	}
+	recorder, body := serveToken(handlers.TokenEndpoint(nil), tokenRequest(form, "client", "secret"))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "invalid_grant", body["error"])
+	assert.Equal(t, "no-store", recorder.Header().Get("Cache-Control"))
+}
+
+func TestTokenEndpointRejectsMissingGrantType(t *testing.T) {
+	handlers := service.NewOauth2ServiceHandlers(nil, nil, nil)
+
+	recorder, body := serveToken(handlers.TokenEndpoint(nil), tokenRequest(url.Values{}, "client", "secret"))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "invalid_request", body["error"])
+}
+
+func TestTokenEndpointRejectsUnsupportedGrantType(t *testing.T) {
+	clientRepository := &ClientRepositoryMock{}
+	handlers := service.NewOauth2ServiceHandlers(nil, clientRepository, nil)
+
+	clientRepository.On("FindById", "client").Return(newTestClient(), nil)
+
+	form := url.Values{"grant_type": {"authorization_code"}}
+	recorder, body := serveToken(handlers.TokenEndpoint(nil), tokenRequest(form, "client", "secret"))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "unsupported_grant_type", body["error"])
+}
+
+func TestTokenEndpointRejectsJsonRequests(t *testing.T) {
+	handlers := service.NewOauth2ServiceHandlers(nil, nil, nil)
+
+	request, _ := http.NewRequest("POST", "/oauth2/token", strings.NewReader(`{"grant_type": "password"}`))
+	request.Header.Set("Content-Type", "application/json")
+	recorder, body := serveToken(handlers.TokenEndpoint(nil), request)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "invalid_request", body["error"])
+}
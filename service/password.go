@@ -0,0 +1,317 @@
+package service
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/i18n"
+)
+
+const (
+	defaultMinPasswordLength = 6
+	// MaxPasswordLength limits the work done hashing the password.
+	MaxPasswordLength = 1024
+	// Length of the SHA-1 hash prefix used to name the files of the breached
+	// password list.
+	breachedHashPrefixLength = 5
+	// Shortest part of the email address or display name that is not allowed
+	// in the password.
+	minUserDataLength = 3
+)
+
+// PasswordRule checks the password of a user that is being registered. It
+// returns the description of the problem translated by the localizer or an
+// empty string if the password is accepted.
+type PasswordRule interface {
+	Check(tr *i18n.Localizer, password string, user *proto_user.User) string
+}
+
+type PasswordRuleFunc func(tr *i18n.Localizer, password string, user *proto_user.User) string
+
+func (f PasswordRuleFunc) Check(tr *i18n.Localizer, password string, user *proto_user.User) string {
+	return f(tr, password, user)
+}
+
+// PasswordPolicy is a list of rules a password must pass. Only the problem
+// found by the first failing rule is reported.
+type PasswordPolicy []PasswordRule
+
+func (p PasswordPolicy) Check(tr *i18n.Localizer, password string, user *proto_user.User) string {
+	for _, rule := range p {
+		if problem := rule.Check(tr, password, user); problem != "" {
+			return problem
+		}
+	}
+	return ""
+}
+
+// DefaultPasswordPolicy only checks the length of the password.
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{PasswordLength(defaultMinPasswordLength, MaxPasswordLength)}
+}
+
+// PasswordLength accepts passwords with the number of characters between min
+// and max.
+func PasswordLength(min, max int) PasswordRule {
+	return PasswordRuleFunc(func(tr *i18n.Localizer, password string, user *proto_user.User) string {
+		if password == "" {
+			return tr.T("password.empty")
+		} else if strlen(password) < min {
+			return tr.N("password.too_short", min)
+		} else if strlen(password) > max {
+			return tr.N("password.too_long", max)
+		}
+		return ""
+	})
+}
+
+// PasswordCharacterClasses accepts passwords that contain characters from at
+// least the given number of classes: lowercase letters, uppercase letters,
+// digits and other characters.
+func PasswordCharacterClasses(required int) PasswordRule {
+	return PasswordRuleFunc(func(tr *i18n.Localizer, password string, user *proto_user.User) string {
+		var lower, upper, digit, other int
+		for _, c := range password {
+			switch {
+			case unicode.IsLower(c):
+				lower = 1
+			case unicode.IsUpper(c):
+				upper = 1
+			case unicode.IsDigit(c):
+				digit = 1
+			default:
+				other = 1
+			}
+		}
+		if lower+upper+digit+other < required {
+			return tr.N("password.character_classes", required)
+		}
+		return ""
+	})
+}
+
+// PasswordWithoutUserData rejects passwords that contain the email address,
+// the part of the email address before the at sign or the display name.
+func PasswordWithoutUserData() PasswordRule {
+	return PasswordRuleFunc(func(tr *i18n.Localizer, password string, user *proto_user.User) string {
+		password = strings.ToLower(password)
+		email := strings.ToLower(strings.TrimSpace(user.GetEmail()))
+		parts := []string{
+			email,
+			strings.ToLower(strings.TrimSpace(user.GetDisplayName())),
+		}
+		if at := strings.LastIndex(email, "@"); at >= 0 {
+			parts = append(parts, email[:at])
+		}
+		for _, part := range parts {
+			if strlen(part) >= minUserDataLength && strings.Contains(password, part) {
+				return tr.T("password.user_data")
+			}
+		}
+		return ""
+	})
+}
+
+// PasswordStrength rejects passwords with the estimated strength lower than
+// minScore, see EstimatePasswordStrength.
+func PasswordStrength(minScore int) PasswordRule {
+	return PasswordRuleFunc(func(tr *i18n.Localizer, password string, user *proto_user.User) string {
+		if EstimatePasswordStrength(password) < minScore {
+			return tr.T("password.weak")
+		}
+		return ""
+	})
+}
+
+// EstimatePasswordStrength returns the strength of the password on the scale
+// from 0 (too guessable) to 4 (very unguessable), similar to zxcvbn. The number
+// of guesses is estimated from the size of the character set used and patterns
+// that are guessed early: common passwords and words, repeated characters,
+// sequences like "abc" or "321" and runs of adjacent keys like "qwerty". The
+// score is based on the order of
+// magnitude of guesses with the same thresholds as zxcvbn.
+func EstimatePasswordStrength(password string) int {
+	runes := []rune(password)
+	charsetBits := math.Log2(float64(charsetSize(runes)))
+	bits := 0.0
+	for i := 0; i < len(runes); {
+		if n := commonWordLength(runes, i); n > 0 {
+			// Guessing the word requires guessing its position in the list
+			// and the capitalization.
+			bits += math.Log2(float64(2 * len(commonWords)))
+			i += n
+		} else if n := patternLength(runes, i); n >= 3 {
+			// Guessing the pattern requires guessing its first character and
+			// length.
+			bits += charsetBits + math.Log2(float64(n))
+			i += n
+		} else {
+			bits += charsetBits
+			i++
+		}
+	}
+	guessesLog10 := bits * math.Log10(2)
+	switch {
+	case guessesLog10 < 3:
+		return 0
+	case guessesLog10 < 6:
+		return 1
+	case guessesLog10 < 8:
+		return 2
+	case guessesLog10 < 10:
+		return 3
+	}
+	return 4
+}
+
+// charsetSize returns the number of characters in the classes used by the
+// password.
+func charsetSize(runes []rune) int {
+	var lower, upper, digit, symbol, other int
+	for _, c := range runes {
+		switch {
+		case c >= 'a' && c <= 'z':
+			lower = 26
+		case c >= 'A' && c <= 'Z':
+			upper = 26
+		case c >= '0' && c <= '9':
+			digit = 10
+		case c < unicode.MaxASCII:
+			symbol = 33
+		default:
+			other = 100
+		}
+	}
+	if size := lower + upper + digit + symbol + other; size > 1 {
+		return size
+	}
+	return 2
+}
+
+// The most common passwords and words used in passwords, which are guessed
+// first.
+var commonWords = []string{
+	"password", "passwort", "letmein", "welcome", "monkey", "dragon", "master",
+	"shadow", "sunshine", "princess", "football", "baseball", "soccer", "hockey",
+	"superman", "batman", "trustno1", "iloveyou", "love", "secret", "admin",
+	"login", "access", "hello", "freedom", "whatever", "qazwsx", "michael",
+	"charlie", "jordan", "jennifer", "hunter", "ranger", "buster", "thomas",
+	"tigger", "robert", "killer", "summer", "winter", "starwars", "pokemon",
+	"cheese", "computer", "internet", "google", "flower", "ninja", "mustang",
+}
+
+// commonWordLength returns the length of the longest common word starting at
+// i, or 0 if there is none.
+func commonWordLength(runes []rune, i int) int {
+	rest := strings.ToLower(string(runes[i:]))
+	longest := 0
+	for _, word := range commonWords {
+		if len(word) > longest && strings.HasPrefix(rest, word) {
+			longest = len(word)
+		}
+	}
+	return longest
+}
+
+// Rows of a QWERTY keyboard used to find runs of adjacent keys.
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+// patternLength returns the length of the longest run of repeated characters,
+// sequence or adjacent keys starting at i.
+func patternLength(runes []rune, i int) int {
+	longest := 1
+	for _, step := range []func(a, b rune) bool{sameRune, nextRune, previousRune, adjacentKey} {
+		n := 1
+		for i+n < len(runes) && step(unicode.ToLower(runes[i+n-1]), unicode.ToLower(runes[i+n])) {
+			n++
+		}
+		if n > longest {
+			longest = n
+		}
+	}
+	return longest
+}
+
+func sameRune(a, b rune) bool {
+	return a == b
+}
+
+func nextRune(a, b rune) bool {
+	return b == a+1
+}
+
+func previousRune(a, b rune) bool {
+	return b == a-1
+}
+
+func adjacentKey(a, b rune) bool {
+	for _, row := range keyboardRows {
+		i := strings.IndexRune(row, a)
+		if i >= 0 && i+1 < len(row) && rune(row[i+1]) == b {
+			return true
+		}
+	}
+	return false
+}
+
+// BreachedPasswords rejects passwords found in a local copy of a breached
+// password list split by hash prefix like the k-anonymity range API of Have I
+// Been Pwned. The directory contains a file for every prefix of 5 hex digits of
+// the uppercase SHA-1 hash of the password, named by the prefix with optional
+// .txt extension. Every line of the file contains the rest of the hash,
+// optionally followed by a colon and the number of occurrences. Only the file
+// for the prefix of the password is read. Passwords are accepted if the list
+// can not be read.
+func BreachedPasswords(dir string) PasswordRule {
+	return PasswordRuleFunc(func(tr *i18n.Localizer, password string, user *proto_user.User) string {
+		breached, err := isBreachedPassword(dir, password)
+		if err != nil {
+			log.Printf("Error checking breached passwords: %s", err)
+		} else if breached {
+			return tr.T("password.breached")
+		}
+		return ""
+	})
+}
+
+func isBreachedPassword(dir, password string) (bool, error) {
+	hash := sha1.Sum([]byte(password))
+	hashHex := strings.ToUpper(hex.EncodeToString(hash[:]))
+	prefix, suffix := hashHex[:breachedHashPrefixLength], hashHex[breachedHashPrefixLength:]
+
+	f, err := os.Open(filepath.Join(dir, prefix))
+	if os.IsNotExist(err) {
+		f, err = os.Open(filepath.Join(dir, prefix+".txt"))
+	}
+	if os.IsNotExist(err) {
+		// No breached passwords with the prefix.
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if colon := strings.Index(line, ":"); colon >= 0 {
+			line = line[:colon]
+		}
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,245 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+
+	"github.com/opentarock/service-api/go/proto_password"
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/events"
+	"github.com/opentarock/service-user-management/i18n"
+	"github.com/opentarock/service-user-management/mailer"
+	"github.com/opentarock/service-user-management/nnservice"
+	"github.com/opentarock/service-user-management/repository"
+	"github.com/opentarock/service-user-management/trace"
+	"github.com/opentarock/service-user-management/util"
+)
+
+const (
+	resetTokenLength = 32
+	// DefaultPasswordResetTokenLifetime is how long password reset links can
+	// be used by default.
+	DefaultPasswordResetTokenLifetime = time.Hour
+	// DefaultMaxPendingPasswordResets is how many unexpired password reset
+	// links a user can have by default.
+	DefaultMaxPendingPasswordResets = 3
+)
+
+// PasswordResetter emails links for setting a new password to users and
+// changes passwords with the tokens from the links. All methods can be called
+// on nil, which does not send any emails and rejects all tokens.
+type PasswordResetter struct {
+	resets         repository.PasswordResetRepository
+	mailer         mailer.Mailer
+	tokenGenerator util.TokenGenerator
+	// ResetUri is the page users open to set a new password. The token is
+	// added to it as the token query parameter.
+	ResetUri string
+	// TokenLifetime is how long the sent tokens can be used.
+	TokenLifetime time.Duration
+	// MaxPending is how many unexpired links a user can have. No more links
+	// are sent until one of them expires or the password is reset. The number
+	// of links is not limited if it is 0.
+	MaxPending int
+}
+
+func NewPasswordResetter(
+	resets repository.PasswordResetRepository,
+	mailer mailer.Mailer,
+	tokenGenerator util.TokenGenerator) *PasswordResetter {
+
+	return &PasswordResetter{
+		resets:         resets,
+		mailer:         mailer,
+		tokenGenerator: tokenGenerator,
+		TokenLifetime:  DefaultPasswordResetTokenLifetime,
+		MaxPending:     DefaultMaxPendingPasswordResets,
+	}
+}
+
+// Send emails a new password reset link to the address of the user. Links
+// sent earlier can still be used until they expire or the password is reset.
+// No link is sent if the user already has MaxPending unexpired links.
+func (p *PasswordResetter) Send(span *trace.Span, tr *i18n.Localizer, user *proto_user.User) error {
+	if p == nil {
+		return nil
+	}
+	if p.MaxPending > 0 {
+		done := traceRepository(span, "PasswordReset.CountPending")
+		pending, err := p.resets.CountPending(user.GetId())
+		done(err)
+		if err != nil {
+			return fmt.Errorf("Error counting pending password resets: %s", err)
+		} else if pending >= p.MaxPending {
+			span.Logf("Pending password resets limit reached: user_id=%d", user.GetId())
+			return nil
+		}
+	}
+	token, err := p.tokenGenerator.GenerateHex(resetTokenLength)
+	if err != nil {
+		return fmt.Errorf("Error generating password reset token: %s", err)
+	}
+	link, err := linkWithToken(p.ResetUri, token)
+	if err != nil {
+		return fmt.Errorf("Error creating password reset link: %s", err)
+	}
+	now := time.Now()
+	reset := &repository.PasswordReset{
+		TokenHash: util.HashToken(token),
+		UserId:    user.GetId(),
+		CreatedOn: now,
+		ExpiresOn: now.Add(p.TokenLifetime),
+	}
+	done := traceRepository(span, "PasswordReset.Save")
+	err = p.resets.Save(reset)
+	done(err)
+	if err != nil {
+		return fmt.Errorf("Error saving password reset: %s", err)
+	}
+
+	message := &mailer.Message{
+		To:      user.GetEmail(),
+		Subject: tr.T("password_reset_email.subject"),
+		Body:    tr.T("password_reset_email.body", localizeDuration(tr, p.TokenLifetime), link, user.GetDisplayName()),
+	}
+	if err := sendMail(span, p.mailer, message); err != nil {
+		return fmt.Errorf("Error sending password reset email: %s", err)
+	}
+	span.Logf("Password reset email sent: user_id=%d", user.GetId())
+	passwordResetEmailsTotal.Inc()
+	return nil
+}
+
+// Find returns the pending reset of the token or nil if the token is unknown,
+// expired or already used.
+func (p *PasswordResetter) Find(span *trace.Span, token string) (*repository.PasswordReset, error) {
+	if p == nil || token == "" {
+		return nil, nil
+	}
+	done := traceRepository(span, "PasswordReset.Find")
+	reset, err := p.resets.Find(util.HashToken(token))
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error retrieving password reset: %s", err)
+	}
+	return reset, nil
+}
+
+// Reset sets the password of the user the token was sent to and revokes all
+// sessions and access tokens of the user. It reports false if the token was
+// used or expired in the meantime.
+func (p *PasswordResetter) Reset(span *trace.Span, token, password string, userId uint64) (bool, error) {
+	if p == nil {
+		return false, nil
+	}
+	done := traceRepository(span, "PasswordReset.Reset")
+	_, err := p.resets.Reset(util.HashToken(token), password, events.NewPasswordReset(userId))
+	done(err)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("Error resetting password: %s", err)
+	}
+	return true, nil
+}
+
+// RequestPasswordResetHandler sends a password reset link if the address is
+// registered. The response is the same in every case so that it can not be
+// used to find out which addresses are registered.
+func (s *userServiceHandlers) RequestPasswordResetHandler() nnservice.MessageHandler {
+	return nnservice.WithMessageTypes(nnservice.ProtoHandler(newRequestPasswordReset, func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+		requestReset := request.(*proto_password.RequestPasswordReset)
+		response := &proto_password.RequestPasswordResetResponse{}
+		if s.PasswordResets == nil {
+			return response, nil
+		}
+
+		done := traceRepository(header.Span, "User.FindByEmail")
+		user, err := s.userRepository.FindByEmail(requestReset.GetEmail())
+		done(err)
+		if err == sql.ErrNoRows {
+			header.Span.Logf("User not found: email=%s", requestReset.GetEmail())
+			return response, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("Error retrieving user: %s", err)
+		}
+
+		tr := s.localizer(header, requestReset.GetLocale())
+		// The email is sent after responding, so that the response time does
+		// not reveal whether the address is registered.
+		s.Jobs.Add(header.Span, "RequestPasswordReset", func(span *trace.Span) error {
+			return s.PasswordResets.Send(span, tr, user)
+		})
+		return response, nil
+	}), newRequestPasswordReset(), newRequestPasswordResetResponse())
+}
+
+func newRequestPasswordReset() proto.Message {
+	return &proto_password.RequestPasswordReset{}
+}
+
+// ResetPasswordHandler sets the new password if the token is valid and the
+// password is accepted by the password policy. The token can be used again if
+// the password is rejected.
+func (s *userServiceHandlers) ResetPasswordHandler() nnservice.MessageHandler {
+	return nnservice.WithMessageTypes(nnservice.ProtoHandler(newResetPassword, func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+		resetPassword := request.(*proto_password.ResetPassword)
+		tr := s.localizer(header, resetPassword.GetLocale())
+		response := &proto_password.ResetPasswordResponse{
+			Changed: proto.Bool(false),
+			Locale:  proto.String(tr.Locale()),
+		}
+		invalidToken := []*proto_user.RegisterResponse_InputError{
+			proto_user.NewInputError("token", tr.T("password_reset.invalid_token")),
+		}
+
+		reset, err := s.PasswordResets.Find(header.Span, resetPassword.GetToken())
+		if err != nil {
+			return nil, err
+		} else if reset == nil {
+			header.Span.Logf("Password reset token rejected")
+			response.Errors = invalidToken
+			return response, nil
+		}
+		done := traceRepository(header.Span, "User.FindById")
+		user, err := s.userRepository.FindById(reset.UserId)
+		done(err)
+		if err == sql.ErrNoRows {
+			response.Errors = invalidToken
+			return response, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("Error retrieving user: %s", err)
+		}
+
+		// Password is checked against the user data of the account.
+		user.Password = proto.String(resetPassword.GetPassword())
+		if passwordError := s.validatePassword(tr, user); passwordError != nil {
+			response.Errors = []*proto_user.RegisterResponse_InputError{passwordError}
+			return response, nil
+		}
+		changed, err := s.PasswordResets.Reset(
+			header.Span, resetPassword.GetToken(), resetPassword.GetPassword(), user.GetId())
+		if err != nil {
+			return nil, err
+		} else if !changed {
+			header.Span.Logf("Password reset token used concurrently: user_id=%d", user.GetId())
+			response.Errors = invalidToken
+			return response, nil
+		}
+		header.Span.Logf("Password reset: user_id=%d", user.GetId())
+		passwordResetsTotal.Inc()
+		// Failed logins with the forgotten password do not lock out the user.
+		s.Lockout.Succeeded(header.Span, user.GetEmail())
+		response.Changed = proto.Bool(true)
+		return response, nil
+	}), newResetPassword(), newResetPasswordResponse())
+}
+
+func newResetPassword() proto.Message {
+	return &proto_password.ResetPassword{}
+}
@@ -0,0 +1,210 @@
+package service_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/opentarock/service-api/go/proto_password"
+	"github.com/opentarock/service-user-management/events"
+	"github.com/opentarock/service-user-management/mailer"
+	"github.com/opentarock/service-user-management/repository"
+	"github.com/opentarock/service-user-management/service"
+	"github.com/opentarock/service-user-management/util"
+)
+
+type PasswordResetRepositoryMock struct {
+	mock.Mock
+	resetEvents []*events.Event
+}
+
+func NewPasswordResetRepositoryMock() *PasswordResetRepositoryMock {
+	return &PasswordResetRepositoryMock{}
+}
+
+func (r *PasswordResetRepositoryMock) Save(reset *repository.PasswordReset) error {
+	args := r.Mock.Called(reset.TokenHash, reset.UserId)
+	return args.Error(0)
+}
+
+func (r *PasswordResetRepositoryMock) Find(tokenHash string) (*repository.PasswordReset, error) {
+	args := r.Mock.Called(tokenHash)
+	reset, _ := args.Get(0).(*repository.PasswordReset)
+	return reset, args.Error(1)
+}
+
+func (r *PasswordResetRepositoryMock) CountPending(userId uint64) (int, error) {
+	args := r.Mock.Called(userId)
+	return args.Int(0), args.Error(1)
+}
+
+func (r *PasswordResetRepositoryMock) Reset(
+	tokenHash, password string, newEvents ...*events.Event) (*repository.PasswordReset, error) {
+
+	r.resetEvents = newEvents
+	args := r.Mock.Called(tokenHash, password)
+	reset, _ := args.Get(0).(*repository.PasswordReset)
+	return reset, args.Error(1)
+}
+
+// newTestPasswordResetter returns a resetter writing emails to a temporary
+// directory, which is removed by the returned function.
+func newTestPasswordResetter(t *testing.T, resets repository.PasswordResetRepository) (
+	*service.PasswordResetter, func() ([]*mailer.Message, error), func()) {
+
+	dir, err := ioutil.TempDir("", "mail")
+	assert.Nil(t, err)
+	fileMailer := mailer.NewFileMailer(dir, "noreply@example.com")
+	tokenGenerator := NewTokenGeneratorMock()
+	tokenGenerator.On("GenerateHex", uint(32)).Return("token", nil)
+	resetter := service.NewPasswordResetter(resets, fileMailer, tokenGenerator)
+	resetter.ResetUri = "https://example.com/password"
+	return resetter, fileMailer.Messages, func() { os.RemoveAll(dir) }
+}
+
+func TestPasswordResetIsSentOnlyToRegisteredAddress(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	resets := NewPasswordResetRepositoryMock()
+	resetter, sent, cleanup := newTestPasswordResetter(t, resets)
+	defer cleanup()
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+	handlers.PasswordResets = resetter
+	handlers.Jobs = service.NewJobQueue(1, 10)
+
+	user := NewValidUser()
+	user.Id = proto.Uint64(1)
+	userRepository.On("FindByEmail", "unknown@example.com").Return(nil, sql.ErrNoRows)
+	userRepository.On("FindByEmail", "mail@example.com").Return(user, nil)
+	resets.On("CountPending", uint64(1)).Return(0, nil)
+	resets.On("Save", util.HashToken("token"), uint64(1)).Return(nil)
+
+	for _, email := range []string{"unknown@example.com", "mail@example.com"} {
+		requestReset := &proto_password.RequestPasswordReset{
+			Email: proto.String(email),
+		}
+		result := handleMessage(t, requestReset, handlers.RequestPasswordResetHandler())
+		assert.Empty(t, result, email)
+	}
+	assert.Nil(t, handlers.Jobs.Stop(time.Second))
+	messages, err := sent()
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "mail@example.com", messages[0].To)
+		assert.Equal(t, "Reset your password", messages[0].Subject)
+		assert.True(t, strings.Contains(messages[0].Body, "https://example.com/password?token=token\n"))
+		assert.True(t, strings.Contains(messages[0].Body, "expires in 1 hour"))
+	}
+}
+
+func TestPasswordResetIsNotSentWhenTooManyArePending(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	resets := NewPasswordResetRepositoryMock()
+	resetter, sent, cleanup := newTestPasswordResetter(t, resets)
+	defer cleanup()
+	resetter.MaxPending = 2
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+	handlers.PasswordResets = resetter
+
+	user := NewValidUser()
+	user.Id = proto.Uint64(1)
+	userRepository.On("FindByEmail", "mail@example.com").Return(user, nil)
+	resets.On("CountPending", uint64(1)).Return(2, nil)
+
+	requestReset := &proto_password.RequestPasswordReset{
+		Email: proto.String("mail@example.com"),
+	}
+	result := handleMessage(t, requestReset, handlers.RequestPasswordResetHandler())
+	assert.Empty(t, result)
+	messages, err := sent()
+	assert.Nil(t, err)
+	assert.Empty(t, messages)
+}
+
+func TestPasswordIsResetWithToken(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	resets := NewPasswordResetRepositoryMock()
+	resetter, _, cleanup := newTestPasswordResetter(t, resets)
+	defer cleanup()
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+	handlers.PasswordResets = resetter
+
+	user := NewValidUser()
+	user.Id = proto.Uint64(1)
+	reset := &repository.PasswordReset{UserId: 1}
+	resets.On("Find", util.HashToken("token")).Return(reset, nil)
+	userRepository.On("FindById", uint64(1)).Return(user, nil)
+	resets.On("Reset", util.HashToken("token"), "new password").Return(reset, nil)
+
+	resetPassword := &proto_password.ResetPassword{
+		Token:    proto.String("token"),
+		Password: proto.String("new password"),
+	}
+	result := handleMessage(t, resetPassword, handlers.ResetPasswordHandler())
+	var response proto_password.ResetPasswordResponse
+	err := proto.Unmarshal(result, &response)
+	assert.Nil(t, err)
+	assert.True(t, response.GetChanged())
+	assert.Empty(t, response.GetErrors())
+	if assert.Len(t, resets.resetEvents, 1) {
+		assert.Equal(t, events.TopicPasswordReset, resets.resetEvents[0].Topic)
+	}
+}
+
+func TestRejectedPasswordDoesNotUseResetToken(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	resets := NewPasswordResetRepositoryMock()
+	resetter, _, cleanup := newTestPasswordResetter(t, resets)
+	defer cleanup()
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+	handlers.PasswordResets = resetter
+
+	user := NewValidUser()
+	user.Id = proto.Uint64(1)
+	resets.On("Find", util.HashToken("token")).Return(&repository.PasswordReset{UserId: 1}, nil)
+	userRepository.On("FindById", uint64(1)).Return(user, nil)
+
+	resetPassword := &proto_password.ResetPassword{
+		Token:    proto.String("token"),
+		Password: proto.String("pass"),
+	}
+	result := handleMessage(t, resetPassword, handlers.ResetPasswordHandler())
+	var response proto_password.ResetPasswordResponse
+	err := proto.Unmarshal(result, &response)
+	assert.Nil(t, err)
+	assert.False(t, response.GetChanged())
+	if assert.Len(t, response.GetErrors(), 1) {
+		assert.Equal(t, "password", response.GetErrors()[0].GetName())
+		assert.Equal(t, "Password must be at least 6 characters long.", response.GetErrors()[0].GetErrorMessage())
+	}
+}
+
+func TestInvalidResetTokenIsRejected(t *testing.T) {
+	resets := NewPasswordResetRepositoryMock()
+	resetter, _, cleanup := newTestPasswordResetter(t, resets)
+	defer cleanup()
+	handlers := service.NewUserServiceHandlers(nil, nil)
+	handlers.PasswordResets = resetter
+
+	resets.On("Find", util.HashToken("used")).Return(nil, sql.ErrNoRows)
+
+	resetPassword := &proto_password.ResetPassword{
+		Token:    proto.String("used"),
+		Password: proto.String("new password"),
+	}
+	result := handleMessage(t, resetPassword, handlers.ResetPasswordHandler())
+	var response proto_password.ResetPasswordResponse
+	err := proto.Unmarshal(result, &response)
+	assert.Nil(t, err)
+	assert.False(t, response.GetChanged())
+	if assert.Len(t, response.GetErrors(), 1) {
+		assert.Equal(t, "token", response.GetErrors()[0].GetName())
+		assert.Equal(t, "Password reset link is not valid or has expired.", response.GetErrors()[0].GetErrorMessage())
+	}
+}
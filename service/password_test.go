@@ -0,0 +1,95 @@
+package service_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/service"
+)
+
+var en = service.DefaultMessages().Localizer()
+
+func TestPasswordOfRegisteredUserIsCheckedByPolicy(t *testing.T) {
+	handlers := service.NewUserServiceHandlers(nil, nil)
+	handlers.PasswordPolicy = service.PasswordPolicy{service.PasswordCharacterClasses(3)}
+	registerUser := &proto_user.RegisterUser{
+		User: NewValidUser(),
+	}
+	result := handleMessage(t, registerUser, handlers.RegisterUserMessageHandler())
+	var registerResponse proto_user.RegisterResponse
+	err := proto.Unmarshal(result, &registerResponse)
+	assert.Nil(t, err)
+	assert.False(t, registerResponse.GetValid())
+	if assert.Len(t, registerResponse.GetErrors(), 1) {
+		assert.Equal(t, "password", registerResponse.GetErrors()[0].GetName())
+		assert.Equal(t, "Password must contain at least 3 of: lowercase letters, "+
+			"uppercase letters, digits and symbols.", registerResponse.GetErrors()[0].GetErrorMessage())
+	}
+}
+
+func TestPasswordPolicyReportsFirstProblem(t *testing.T) {
+	policy := service.PasswordPolicy{
+		service.PasswordLength(8, 10),
+		service.PasswordCharacterClasses(2),
+	}
+	user := NewValidUser()
+	assert.Equal(t, "Password must not be empty.", policy.Check(en, "", user))
+	assert.Equal(t, "Password must be at least 8 characters long.", policy.Check(en, "pass", user))
+	assert.Equal(t, "Password length must not exceed 10 characters.", policy.Check(en, "passwordpassword", user))
+	assert.NotEmpty(t, policy.Check(en, "password", user))
+	assert.Empty(t, policy.Check(en, "passw0rd", user))
+}
+
+func TestPasswordWithUserDataIsRejected(t *testing.T) {
+	rule := service.PasswordWithoutUserData()
+	user := NewValidUser()
+	user.DisplayName = proto.String("Johnny")
+	user.Email = proto.String("jsmith@example.com")
+	for _, password := range []string{"myJohnny1", "JSMITH2014", "x jsmith@example.com"} {
+		assert.Equal(t, "Password must not contain your email address or display name.",
+			rule.Check(en, password, user), password)
+	}
+	assert.Empty(t, rule.Check(en, "correct horse", user))
+
+	user.DisplayName = proto.String("Al")
+	assert.Empty(t, rule.Check(en, "always", user), "short display names are allowed")
+}
+
+func TestPasswordStrengthIsEstimated(t *testing.T) {
+	assert.Equal(t, 0, service.EstimatePasswordStrength("aaaaaaaaaaaa"))
+	assert.Equal(t, 0, service.EstimatePasswordStrength("123456"))
+	assert.Equal(t, 1, service.EstimatePasswordStrength("qwertyuiop12"))
+	assert.Equal(t, 4, service.EstimatePasswordStrength("Tr0ub4dor&3x!"))
+	assert.True(t, service.EstimatePasswordStrength("password") <
+		service.EstimatePasswordStrength("pXs8wKrd"))
+
+	rule := service.PasswordStrength(3)
+	assert.Equal(t, "Password is too easy to guess.", rule.Check(en, "abcdef123", NewValidUser()))
+	assert.Empty(t, rule.Check(en, "kT7#pq2Lz", NewValidUser()))
+}
+
+func TestBreachedPasswordIsRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "breached")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8.
+	err = ioutil.WriteFile(filepath.Join(dir, "5BAA6"),
+		[]byte("003D68EB55068C33ACE09247EE4C639306B:3\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:3730471\n"), 0644)
+	assert.Nil(t, err)
+
+	rule := service.BreachedPasswords(dir)
+	assert.Equal(t, "Password has appeared in a data breach and can not be used.",
+		rule.Check(en, "password", NewValidUser()))
+	assert.Empty(t, rule.Check(en, "not in the list", NewValidUser()))
+}
+
+func TestPasswordIsAcceptedIfBreachedListIsMissing(t *testing.T) {
+	rule := service.BreachedPasswords("/nonexistent/breached")
+	assert.Empty(t, rule.Check(en, "password", NewValidUser()))
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+
+	"github.com/opentarock/service-api/go/proto_oauth2"
+	"github.com/opentarock/service-api/go/proto_password"
+	"github.com/opentarock/service-api/go/proto_verification"
+	"github.com/opentarock/service-user-management/nnservice"
+	"github.com/opentarock/service-user-management/repository"
+)
+
+// Names of the rate limited message types.
+const (
+	RateLimitAuthenticate         = "authenticate"
+	RateLimitAccessToken          = "access_token"
+	RateLimitResendVerification   = "resend_verification"
+	RateLimitRequestPasswordReset = "request_password_reset"
+	RateLimitResetPassword        = "reset_password"
+)
+
+// RateLimits are the limits of the message types by name. Message types
+// without a limit are not limited. It can be used as a flag that sets the
+// limits given as a comma separated list of name=rate/burst, where off
+// removes the limit, e.g. authenticate=1/10,reset_password=off.
+type RateLimits map[string]nnservice.RateLimit
+
+// DefaultRateLimits returns the limits per end user. Message types that check
+// credentials allow a few attempts per second and the ones that send emails
+// a few emails per address.
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		RateLimitAuthenticate:         {Rate: 1, Burst: 10},
+		RateLimitAccessToken:          {Rate: 5, Burst: 20},
+		RateLimitResendVerification:   {Rate: 0.01, Burst: 3},
+		RateLimitRequestPasswordReset: {Rate: 0.01, Burst: 3},
+		RateLimitResetPassword:        {Rate: 1, Burst: 10},
+	}
+}
+
+func (l RateLimits) String() string {
+	limits := make([]string, 0, len(l))
+	for name, limit := range l {
+		limits = append(limits, name+"="+limit.String())
+	}
+	sort.Strings(limits)
+	return strings.Join(limits, ",")
+}
+
+func (l RateLimits) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || !isRateLimitName(parts[0]) {
+			return fmt.Errorf("Invalid rate limit: %s", item)
+		}
+		if parts[1] == "off" {
+			delete(l, parts[0])
+			continue
+		}
+		limit, err := nnservice.ParseRateLimit(parts[1])
+		if err != nil {
+			return err
+		}
+		l[parts[0]] = limit
+	}
+	return nil
+}
+
+func isRateLimitName(name string) bool {
+	switch name {
+	case RateLimitAuthenticate, RateLimitAccessToken, RateLimitResendVerification,
+		RateLimitRequestPasswordReset, RateLimitResetPassword:
+		return true
+	}
+	return false
+}
+
+// Middleware returns the middleware that limits the message type, which is
+// none if the message type is not limited.
+func (l RateLimits) Middleware(
+	limiter nnservice.RateLimiter, name string, callerKey nnservice.CallerKey) []nnservice.Middleware {
+
+	limit, ok := l[name]
+	if !ok {
+		return nil
+	}
+	return []nnservice.Middleware{nnservice.RateLimited(limiter, limit, callerKey)}
+}
+
+// RefillTime returns how long the bucket of the limit that takes the longest
+// to refill takes to be full again.
+func (l RateLimits) RefillTime() time.Duration {
+	var refillTime time.Duration
+	for _, limit := range l {
+		if t := limit.RefillTime(); t > refillTime {
+			refillTime = t
+		}
+	}
+	return refillTime
+}
+
+// DefaultRateLimitCleanupInterval is how often refilled buckets are deleted by
+// default.
+const DefaultRateLimitCleanupInterval = time.Hour
+
+// RateLimitBuckets are the buckets of a rate limiter that keeps them until
+// they are deleted.
+type RateLimitBuckets interface {
+	// DeleteIdle deletes the buckets that were not used for the given time and
+	// returns the number of deleted buckets.
+	DeleteIdle(idle time.Duration) (int64, error)
+}
+
+// NewRateLimitCleaner returns a cleaner that deletes the buckets that are
+// refilled with the limits, which are the same as new buckets.
+func NewRateLimitCleaner(buckets RateLimitBuckets, limits RateLimits) *Cleaner {
+	idle := limits.RefillTime()
+	return newCleaner("refilled rate limit buckets", DefaultRateLimitCleanupInterval, func() (int64, error) {
+		return buckets.DeleteIdle(idle)
+	})
+}
+
+// Sources of the keys that identify end users in rate limits.
+const (
+	// Client id and the end user address set by the gateway or a frontend.
+	// Requests of a client without the address share one bucket.
+	RateLimitKeyClientAddress = "client-address"
+	// Caller header, for deployments where every caller is a single end user.
+	RateLimitKeyCaller = "caller"
+)
+
+// EndUserKey returns the key that identifies end users by the source.
+func EndUserKey(source string) (nnservice.CallerKey, error) {
+	switch source {
+	case RateLimitKeyClientAddress:
+		return clientAddressKey, nil
+	case RateLimitKeyCaller:
+		return nnservice.HeaderCallerKey(nnservice.HeaderCaller), nil
+	}
+	return nil, fmt.Errorf("Unknown rate limit key: %s", source)
+}
+
+// unknownClientAddress is used in keys of requests without the address.
+const unknownClientAddress = "unknown"
+
+func clientAddressKey(header *nnservice.Header, data []byte) string {
+	address := header.Get(nnservice.HeaderClientAddress)
+	if address == "" {
+		address = unknownClientAddress
+	}
+	return header.Get(nnservice.HeaderClientId) + "/" + address
+}
+
+// AccessTokenKey identifies end users of access token requests by the client
+// id in the request instead of the client id header.
+func AccessTokenKey(endUser nnservice.CallerKey) nnservice.CallerKey {
+	return func(header *nnservice.Header, data []byte) string {
+		key := endUser(header, data)
+		if key == "" {
+			return ""
+		}
+		request := newAccessTokenAuthentication()
+		if err := proto.Unmarshal(data, request); err != nil {
+			return key
+		}
+		return request.(*proto_oauth2.AccessTokenAuthentication).GetClient().GetId() + ":" + key
+	}
+}
+
+// ResendVerificationKey identifies requests by the address the email is sent
+// to, so that an address does not get more emails from all end users together.
+var ResendVerificationKey = nnservice.MessageCallerKey(newResendVerification,
+	func(request proto.Message) string {
+		return emailKey(request.(*proto_verification.ResendVerification).GetEmail())
+	}, nil)
+
+// RequestPasswordResetKey identifies requests by the address the email is
+// sent to, like ResendVerificationKey.
+var RequestPasswordResetKey = nnservice.MessageCallerKey(newRequestPasswordReset,
+	func(request proto.Message) string {
+		return emailKey(request.(*proto_password.RequestPasswordReset).GetEmail())
+	}, nil)
+
+func emailKey(email string) string {
+	if email = repository.NormalizeEmail(email); email == "" {
+		return ""
+	}
+	return "email:" + email
+}
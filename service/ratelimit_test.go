@@ -0,0 +1,79 @@
+package service_test
+
+import (
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/opentarock/service-api/go/proto_oauth2"
+	"github.com/opentarock/service-api/go/proto_password"
+	"github.com/opentarock/service-user-management/nnservice"
+	"github.com/opentarock/service-user-management/service"
+)
+
+func TestRateLimitsAreOverridden(t *testing.T) {
+	limits := service.DefaultRateLimits()
+	err := limits.Set("authenticate=2/5, reset_password=off")
+	assert.Nil(t, err)
+	assert.Equal(t, nnservice.RateLimit{Rate: 2, Burst: 5}, limits[service.RateLimitAuthenticate])
+	assert.Empty(t, limits.Middleware(nil, service.RateLimitResetPassword, nil))
+	assert.Len(t, limits.Middleware(nil, service.RateLimitAccessToken, nil), 1)
+
+	assert.NotNil(t, limits.Set("unknown=1/1"))
+	assert.NotNil(t, limits.Set("authenticate=1"))
+}
+
+func TestEndUsersAreIdentifiedByClientAddress(t *testing.T) {
+	key, err := service.EndUserKey(service.RateLimitKeyClientAddress)
+	assert.Nil(t, err)
+
+	header := &nnservice.Header{}
+	header.Set(nnservice.HeaderCaller, "frontend")
+	header.Set(nnservice.HeaderClientId, "client")
+	assert.Equal(t, "client/unknown", key(header, nil), "end users without address share a bucket")
+	header.Set(nnservice.HeaderClientAddress, "192.0.2.1")
+	assert.Equal(t, "client/192.0.2.1", key(header, nil))
+
+	request := &proto_oauth2.AccessTokenAuthentication{
+		Client:  &proto_oauth2.Client{Id: proto.String("other"), Secret: proto.String("secret")},
+		Request: &proto_oauth2.AccessTokenRequest{GrantType: proto.String("password")},
+	}
+	data, err := proto.Marshal(request)
+	assert.Nil(t, err)
+	assert.Equal(t, "other:client/192.0.2.1", service.AccessTokenKey(key)(header, data))
+}
+
+type RateLimitBucketsMock struct {
+	mock.Mock
+}
+
+func (b *RateLimitBucketsMock) DeleteIdle(idle time.Duration) (int64, error) {
+	args := b.Mock.Called(idle)
+	return int64(args.Int(0)), args.Error(1)
+}
+
+func TestRefilledRateLimitBucketsAreDeleted(t *testing.T) {
+	buckets := &RateLimitBucketsMock{}
+	buckets.On("DeleteIdle", 300*time.Second).Return(2, nil)
+	limits := service.RateLimits{
+		service.RateLimitAuthenticate:       {Rate: 1, Burst: 10},
+		service.RateLimitResendVerification: {Rate: 0.01, Burst: 3},
+	}
+
+	cleaner := service.NewRateLimitCleaner(buckets, limits)
+	go cleaner.Start()
+	cleaner.Stop()
+	buckets.AssertExpectations(t)
+}
+
+func TestPasswordResetRequestsAreIdentifiedByEmail(t *testing.T) {
+	request := &proto_password.RequestPasswordReset{
+		Email: proto.String(" Mail@Example.com"),
+	}
+	data, err := proto.Marshal(request)
+	assert.Nil(t, err)
+	assert.Equal(t, "email:mail@example.com", service.RequestPasswordResetKey(&nnservice.Header{}, data))
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/i18n"
+	"github.com/opentarock/service-user-management/nnservice"
+)
+
+var (
+	errInvalidRedirectUri       = errors.New("redirect_uri: invalid")
+	errRedirectUriNotRegistered = errors.New("redirect_uri: not_registered")
+	errRedirectUriMissing       = errors.New("redirect_uri: missing")
+)
+
+// redirectUri returns the URI the user is redirected to after registration.
+// The requested URI must be registered for the client identified by the
+// request header, or by DefaultClientId if the header is not set. If no URI
+// is requested the only URI registered for the client is used. An empty URI
+// is returned if nothing is requested and the client has no redirect URIs.
+func (s *userServiceHandlers) redirectUri(header *nnservice.Header, requested string) (string, error) {
+	clientId := header.Get(nnservice.HeaderClientId)
+	if clientId == "" {
+		clientId = s.DefaultClientId
+	}
+	if requested != "" && !validRedirectUri(requested) {
+		return "", errInvalidRedirectUri
+	}
+	var registered []string
+	if clientId != "" && s.RedirectUris != nil {
+		done := traceRepository(header.Span, "RedirectUri.FindByClientId")
+		var err error
+		registered, err = s.RedirectUris.FindByClientId(clientId)
+		done(err)
+		if err != nil {
+			return "", fmt.Errorf("Error retrieving redirect uris: %s", err)
+		}
+	}
+	if requested == "" {
+		switch len(registered) {
+		case 0:
+			return "", nil
+		case 1:
+			return registered[0], nil
+		}
+		return "", errRedirectUriMissing
+	}
+	for _, uri := range registered {
+		if matchesRedirectUri(uri, requested) {
+			return requested, nil
+		}
+	}
+	return "", errRedirectUriNotRegistered
+}
+
+// validRedirectUri reports whether the URI is absolute and has no fragment as
+// required by RFC 6749.
+func validRedirectUri(uri string) bool {
+	u, err := url.Parse(uri)
+	return err == nil && u.IsAbs() && u.Host != "" && u.Fragment == "" && !strings.Contains(uri, "#")
+}
+
+// matchesRedirectUri reports whether the requested URI is the same as the
+// registered one. Registered http URIs with a loopback IP address match any
+// port, because native apps listen on a port assigned by the operating system
+// (RFC 8252).
+func matchesRedirectUri(registered, requested string) bool {
+	if registered == requested {
+		return true
+	}
+	r, err := url.Parse(registered)
+	if err != nil || r.Scheme != "http" || !isLoopback(r.Host) {
+		return false
+	}
+	u, err := url.Parse(requested)
+	if err != nil || u.Scheme != r.Scheme || u.User != nil || !isLoopback(u.Host) {
+		return false
+	}
+	return hostname(u.Host) == hostname(r.Host) &&
+		u.Opaque == r.Opaque && u.Path == r.Path && u.RawQuery == r.RawQuery
+}
+
+func isLoopback(host string) bool {
+	ip := net.ParseIP(hostname(host))
+	return ip != nil && ip.IsLoopback()
+}
+
+// hostname returns the host without the port and IPv6 brackets.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// redirectUriInputError returns the input error for the error returned by
+// redirectUri or nil if the request can not be handled.
+func redirectUriInputError(tr *i18n.Localizer, err error) *proto_user.RegisterResponse_InputError {
+	switch err {
+	case errInvalidRedirectUri:
+		return proto_user.NewInputError("redirect_uri", tr.T("redirect_uri.invalid"))
+	case errRedirectUriNotRegistered:
+		return proto_user.NewInputError("redirect_uri", tr.T("redirect_uri.not_registered"))
+	case errRedirectUriMissing:
+		return proto_user.NewInputError("redirect_uri", tr.T("redirect_uri.missing"))
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package service_test
+
+import (
+	"testing"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/nnservice"
+	"github.com/opentarock/service-user-management/service"
+)
+
+type RedirectUriRepositoryMock struct {
+	mock.Mock
+}
+
+func NewRedirectUriRepositoryMock() *RedirectUriRepositoryMock {
+	return &RedirectUriRepositoryMock{}
+}
+
+func (r *RedirectUriRepositoryMock) Add(clientId, redirectUri string) error {
+	args := r.Mock.Called(clientId, redirectUri)
+	return args.Error(0)
+}
+
+func (r *RedirectUriRepositoryMock) Remove(clientId, redirectUri string) (bool, error) {
+	args := r.Mock.Called(clientId, redirectUri)
+	return args.Bool(0), args.Error(1)
+}
+
+func (r *RedirectUriRepositoryMock) FindByClientId(clientId string) ([]string, error) {
+	args := r.Mock.Called(clientId)
+	redirectUris, _ := args.Get(0).([]string)
+	return redirectUris, args.Error(1)
+}
+
+// registerWithRedirectUri registers a user through the client with the
+// registered redirect URIs.
+func registerWithRedirectUri(
+	t *testing.T, registered []string, clientId, redirectUri string) *proto_user.RegisterResponse {
+
+	userRepository := NewUserRepositoryMock()
+	redirectUriRepository := NewRedirectUriRepositoryMock()
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+	handlers.RedirectUris = redirectUriRepository
+	handlers.DefaultClientId = "default"
+
+	registerUser := &proto_user.RegisterUser{
+		User: NewValidUser(),
+	}
+	if redirectUri != "" {
+		registerUser.RedirectUri = proto.String(redirectUri)
+	}
+	userRepository.On("Save", registerUser.GetUser()).Return(1, nil)
+	redirectUriRepository.On("FindByClientId", clientId).Return(registered, nil)
+
+	header := &nnservice.Header{}
+	if clientId != "default" {
+		header.Set(nnservice.HeaderClientId, clientId)
+	}
+	messageData, err := proto.Marshal(registerUser)
+	assert.Nil(t, err)
+	result, err := handlers.RegisterUserMessageHandler().HandleMessage(header, messageData)
+	assert.Nil(t, err)
+	var registerResponse proto_user.RegisterResponse
+	err = proto.Unmarshal(result, &registerResponse)
+	assert.Nil(t, err)
+	return &registerResponse
+}
+
+func TestRegisteredRedirectUriIsReturned(t *testing.T) {
+	registered := []string{"https://a.example.com/welcome", "https://b.example.com/welcome"}
+	response := registerWithRedirectUri(t, registered, "frontend", "https://b.example.com/welcome")
+	assert.True(t, response.GetValid())
+	assert.Equal(t, "https://b.example.com/welcome", response.GetRedirectUri())
+}
+
+func TestDefaultClientIsUsedWithoutClientHeader(t *testing.T) {
+	response := registerWithRedirectUri(t, []string{"https://example.com/"}, "default", "")
+	assert.True(t, response.GetValid())
+	assert.Equal(t, "https://example.com/", response.GetRedirectUri())
+}
+
+func TestLoopbackRedirectUriMatchesAnyPort(t *testing.T) {
+	registered := []string{"http://127.0.0.1/callback", "http://[::1]:8000/callback"}
+	for _, uri := range []string{"http://127.0.0.1:51004/callback", "http://[::1]:9000/callback"} {
+		response := registerWithRedirectUri(t, registered, "native", uri)
+		assert.True(t, response.GetValid(), uri)
+		assert.Equal(t, uri, response.GetRedirectUri())
+	}
+}
+
+func assertRedirectUriError(t *testing.T, response *proto_user.RegisterResponse, message string) {
+	assert.False(t, response.GetValid())
+	assert.Empty(t, response.GetRedirectUri())
+	if assert.Len(t, response.GetErrors(), 1) {
+		assert.Equal(t, "redirect_uri", response.GetErrors()[0].GetName())
+		assert.Equal(t, message, response.GetErrors()[0].GetErrorMessage())
+	}
+}
+
+func TestUnregisteredRedirectUriIsRejected(t *testing.T) {
+	registered := []string{"https://example.com/welcome", "http://127.0.0.1/callback"}
+	for _, uri := range []string{
+		"https://example.com/welcome/",
+		"https://example.com/welcome?next=/",
+		"https://evil.example.com/welcome",
+		"http://localhost:8000/callback",
+		"http://127.0.0.1:8000/other",
+		"https://127.0.0.1:8000/callback",
+	} {
+		response := registerWithRedirectUri(t, registered, "frontend", uri)
+		assertRedirectUriError(t, response, "Redirect URI is not registered for this application.")
+	}
+	response := registerWithRedirectUri(t, []string{}, "other", "https://example.com/welcome")
+	assertRedirectUriError(t, response, "Redirect URI is not registered for this application.")
+}
+
+func TestInvalidRedirectUriIsRejected(t *testing.T) {
+	for _, uri := range []string{"/welcome", "https://example.com/#top", "not a uri"} {
+		response := registerWithRedirectUri(t, []string{uri}, "frontend", uri)
+		assertRedirectUriError(t, response, "Redirect URI is not valid.")
+	}
+}
+
+func TestRedirectUriMustBeGivenIfClientHasMany(t *testing.T) {
+	registered := []string{"https://a.example.com/", "https://b.example.com/"}
+	response := registerWithRedirectUri(t, registered, "frontend", "")
+	assertRedirectUriError(t, response, "Redirect URI must be given.")
+}
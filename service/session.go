@@ -0,0 +1,160 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+
+	"github.com/opentarock/service-api/go/proto_session"
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/nnservice"
+	"github.com/opentarock/service-user-management/repository"
+	"github.com/opentarock/service-user-management/util"
+)
+
+const (
+	// Sessions expire if they are not touched for this long.
+	sessionIdleTimeout = 24 * time.Hour
+	// Sessions can not be extended past this age.
+	sessionMaxAge = 30 * 24 * time.Hour
+)
+
+// createSession persists the session of the authenticated user together with
+// the metadata of the client from the request header. Only the hash of the
+// session id is stored.
+func (s *userServiceHandlers) createSession(header *nnservice.Header, sid string, user *proto_user.User) error {
+	now := time.Now()
+	session := &repository.Session{
+		SidHash:       util.HashToken(sid),
+		UserId:        user.GetId(),
+		CreatedOn:     now,
+		LastSeenOn:    now,
+		ExpiresOn:     now.Add(sessionIdleTimeout),
+		ClientAddress: header.Get(nnservice.HeaderClientAddress),
+		UserAgent:     header.Get(nnservice.HeaderUserAgent),
+	}
+	done := traceRepository(header.Span, "Session.Save")
+	err := s.sessionRepository.Save(session)
+	done(err)
+	return err
+}
+
+// findSession returns nil if the session does not exist or is expired.
+func (s *userServiceHandlers) findSession(header *nnservice.Header, sid string) (*repository.Session, error) {
+	if sid == "" {
+		return nil, nil
+	}
+	done := traceRepository(header.Span, "Session.FindBySidHash")
+	session, err := s.sessionRepository.FindBySidHash(util.HashToken(sid))
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error retrieving session: %s", err)
+	}
+	return session, nil
+}
+
+func (s *userServiceHandlers) ValidateSessionHandler() nnservice.MessageHandler {
+	return nnservice.WithMessageTypes(nnservice.ProtoHandler(newValidateSession, func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+		validateSession := request.(*proto_session.ValidateSession)
+		session, err := s.findSession(header, validateSession.GetSid())
+		if err != nil {
+			return nil, err
+		}
+		return sessionResponse(session), nil
+	}), newValidateSession(), newSessionResponse())
+}
+
+func newValidateSession() proto.Message {
+	return &proto_session.ValidateSession{}
+}
+
+// TouchSessionHandler extends the session by the idle timeout, but not past the
+// maximum session age.
+func (s *userServiceHandlers) TouchSessionHandler() nnservice.MessageHandler {
+	return nnservice.WithMessageTypes(nnservice.ProtoHandler(newTouchSession, func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+		touchSession := request.(*proto_session.TouchSession)
+		session, err := s.findSession(header, touchSession.GetSid())
+		if err != nil {
+			return nil, err
+		} else if session == nil {
+			return sessionResponse(nil), nil
+		}
+
+		now := time.Now()
+		expiresOn := now.Add(sessionIdleTimeout)
+		if maxExpiresOn := session.CreatedOn.Add(sessionMaxAge); expiresOn.After(maxExpiresOn) {
+			expiresOn = maxExpiresOn
+		}
+		done := traceRepository(header.Span, "Session.Touch")
+		err = s.sessionRepository.Touch(session.SidHash, now, expiresOn)
+		done(err)
+		if err == sql.ErrNoRows {
+			// Session expired in the meantime.
+			return sessionResponse(nil), nil
+		} else if err != nil {
+			return nil, fmt.Errorf("Error touching session: %s", err)
+		}
+		session.LastSeenOn = now
+		session.ExpiresOn = expiresOn
+		return sessionResponse(session), nil
+	}), newTouchSession(), newSessionResponse())
+}
+
+func newTouchSession() proto.Message {
+	return &proto_session.TouchSession{}
+}
+
+func (s *userServiceHandlers) LogoutHandler() nnservice.MessageHandler {
+	return nnservice.WithMessageTypes(nnservice.ProtoHandler(newLogout, func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+		logout := request.(*proto_session.Logout)
+		loggedOut := false
+		if logout.GetSid() != "" {
+			done := traceRepository(header.Span, "Session.Delete")
+			var err error
+			loggedOut, err = s.sessionRepository.Delete(util.HashToken(logout.GetSid()))
+			done(err)
+			if err != nil {
+				return nil, fmt.Errorf("Error deleting session: %s", err)
+			}
+		}
+		if loggedOut {
+			header.Span.Logf("Session ended")
+		}
+		return &proto_session.LogoutResponse{
+			LoggedOut: proto.Bool(loggedOut),
+		}, nil
+	}), newLogout(), newLogoutResponse())
+}
+
+func newLogout() proto.Message {
+	return &proto_session.Logout{}
+}
+
+// sessionResponse returns the response for the session, which is invalid if
+// the session is nil.
+func sessionResponse(session *repository.Session) *proto_session.SessionResponse {
+	if session == nil {
+		return &proto_session.SessionResponse{
+			Valid: proto.Bool(false),
+		}
+	}
+	return &proto_session.SessionResponse{
+		Valid:     proto.Bool(true),
+		UserId:    proto.Uint64(session.UserId),
+		ExpiresOn: proto.Int64(session.ExpiresOn.UnixNano() / int64(time.Millisecond)),
+	}
+}
+
+// DefaultSessionCleanupInterval is how often expired sessions are deleted by
+// default.
+const DefaultSessionCleanupInterval = time.Hour
+
+// NewSessionCleaner returns a cleaner that deletes expired sessions, which are
+// otherwise kept forever because they are never returned.
+func NewSessionCleaner(sessions repository.SessionRepository) *Cleaner {
+	return newCleaner("expired sessions", DefaultSessionCleanupInterval, sessions.DeleteExpired)
+}
@@ -0,0 +1,141 @@
+package service_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/opentarock/service-api/go/proto_session"
+	"github.com/opentarock/service-user-management/repository"
+	"github.com/opentarock/service-user-management/service"
+	"github.com/opentarock/service-user-management/util"
+)
+
+type SessionRepositoryMock struct {
+	mock.Mock
+}
+
+func NewSessionRepositoryMock() *SessionRepositoryMock {
+	return &SessionRepositoryMock{}
+}
+
+func (r *SessionRepositoryMock) Save(session *repository.Session) error {
+	args := r.Mock.Called(session.SidHash)
+	return args.Error(0)
+}
+
+func (r *SessionRepositoryMock) FindBySidHash(sidHash string) (*repository.Session, error) {
+	args := r.Mock.Called(sidHash)
+	session, _ := args.Get(0).(*repository.Session)
+	return session, args.Error(1)
+}
+
+func (r *SessionRepositoryMock) Touch(sidHash string, lastSeenOn, expiresOn time.Time) error {
+	args := r.Mock.Called(sidHash)
+	return args.Error(0)
+}
+
+func (r *SessionRepositoryMock) Delete(sidHash string) (bool, error) {
+	args := r.Mock.Called(sidHash)
+	return args.Bool(0), args.Error(1)
+}
+
+func (r *SessionRepositoryMock) DeleteExpired() (int64, error) {
+	args := r.Mock.Called()
+	return int64(args.Int(0)), args.Error(1)
+}
+
+func newTestSession(createdOn time.Time) *repository.Session {
+	return &repository.Session{
+		SidHash:    util.HashToken("session"),
+		UserId:     1,
+		CreatedOn:  createdOn,
+		LastSeenOn: createdOn,
+		ExpiresOn:  time.Now().Add(time.Hour),
+	}
+}
+
+func TestStoredSessionIsValid(t *testing.T) {
+	sessionRepository := NewSessionRepositoryMock()
+	handlers := service.NewUserServiceHandlers(nil, sessionRepository)
+	sessionRepository.On("FindBySidHash", util.HashToken("session")).Return(newTestSession(time.Now()), nil)
+
+	result := handleMessage(t, &proto_session.ValidateSession{Sid: proto.String("session")},
+		handlers.ValidateSessionHandler())
+	var response proto_session.SessionResponse
+	err := proto.Unmarshal(result, &response)
+	assert.Nil(t, err)
+	assert.True(t, response.GetValid())
+	assert.Equal(t, uint64(1), response.GetUserId())
+}
+
+func TestUnknownSessionIsNotValid(t *testing.T) {
+	sessionRepository := NewSessionRepositoryMock()
+	handlers := service.NewUserServiceHandlers(nil, sessionRepository)
+	sessionRepository.On("FindBySidHash", util.HashToken("session")).Return(nil, sql.ErrNoRows)
+
+	result := handleMessage(t, &proto_session.ValidateSession{Sid: proto.String("session")},
+		handlers.ValidateSessionHandler())
+	var response proto_session.SessionResponse
+	err := proto.Unmarshal(result, &response)
+	assert.Nil(t, err)
+	assert.False(t, response.GetValid())
+	assert.Zero(t, response.GetUserId())
+}
+
+func TestTouchedSessionIsExtended(t *testing.T) {
+	sessionRepository := NewSessionRepositoryMock()
+	handlers := service.NewUserServiceHandlers(nil, sessionRepository)
+	session := newTestSession(time.Now())
+	sessionRepository.On("FindBySidHash", util.HashToken("session")).Return(session, nil)
+	sessionRepository.On("Touch", util.HashToken("session")).Return(nil)
+
+	result := handleMessage(t, &proto_session.TouchSession{Sid: proto.String("session")},
+		handlers.TouchSessionHandler())
+	var response proto_session.SessionResponse
+	err := proto.Unmarshal(result, &response)
+	assert.Nil(t, err)
+	assert.True(t, response.GetValid())
+	assert.True(t, session.ExpiresOn.After(time.Now().Add(time.Hour)))
+}
+
+func TestSessionIsNotExtendedPastMaximumAge(t *testing.T) {
+	sessionRepository := NewSessionRepositoryMock()
+	handlers := service.NewUserServiceHandlers(nil, sessionRepository)
+	createdOn := time.Now().Add(-30*24*time.Hour + time.Minute)
+	session := newTestSession(createdOn)
+	sessionRepository.On("FindBySidHash", util.HashToken("session")).Return(session, nil)
+	sessionRepository.On("Touch", util.HashToken("session")).Return(nil)
+
+	handleMessage(t, &proto_session.TouchSession{Sid: proto.String("session")},
+		handlers.TouchSessionHandler())
+	assert.True(t, session.ExpiresOn.Before(time.Now().Add(time.Minute+time.Second)))
+}
+
+func TestLogoutDeletesSession(t *testing.T) {
+	sessionRepository := NewSessionRepositoryMock()
+	handlers := service.NewUserServiceHandlers(nil, sessionRepository)
+	sessionRepository.On("Delete", util.HashToken("session")).Return(true, nil)
+
+	result := handleMessage(t, &proto_session.Logout{Sid: proto.String("session")},
+		handlers.LogoutHandler())
+	var response proto_session.LogoutResponse
+	err := proto.Unmarshal(result, &response)
+	assert.Nil(t, err)
+	assert.True(t, response.GetLoggedOut())
+	sessionRepository.AssertExpectations(t)
+}
+
+func TestSessionCleanerDeletesExpiredSessions(t *testing.T) {
+	sessionRepository := NewSessionRepositoryMock()
+	sessionRepository.On("DeleteExpired").Return(2, nil)
+
+	cleaner := service.NewSessionCleaner(sessionRepository)
+	go cleaner.Start()
+	cleaner.Stop()
+	sessionRepository.AssertExpectations(t)
+}
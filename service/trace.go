@@ -0,0 +1,22 @@
+package service
+
+import (
+	"database/sql"
+
+	"github.com/opentarock/service-user-management/repository"
+	"github.com/opentarock/service-user-management/trace"
+)
+
+// traceRepository starts the span of a repository call so that the time spent
+// in the database is visible in the trace of the request. The returned
+// function finishes the span with the error returned by the call. Errors that
+// are expected answers, like a missing row, do not mark the span as failed.
+func traceRepository(span *trace.Span, operation string) func(err error) {
+	child := span.Child("repository."+operation, trace.SpanKindClient)
+	return func(err error) {
+		if err != sql.ErrNoRows && err != repository.ErrCredentialsMismatch && err != repository.ErrEmailTaken {
+			child.SetError(err)
+		}
+		child.Finish()
+	}
+}
@@ -2,93 +2,171 @@ package service
 
 import (
 	"database/sql"
-	"log"
+	"fmt"
 	"strings"
 	"unicode/utf8"
 
 	"code.google.com/p/gogoprotobuf/proto"
 
 	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/events"
+	"github.com/opentarock/service-user-management/i18n"
 	"github.com/opentarock/service-user-management/nnservice"
 	"github.com/opentarock/service-user-management/repository"
+	"github.com/opentarock/service-user-management/trace"
 	"github.com/opentarock/service-user-management/util"
-	"github.com/opentarock/service-user-management/util/logutil"
 )
 
-const sessionIdLength = 64
+const (
+	sessionIdLength      = 64
+	minDisplayNameLength = 3
+	maxDisplayNameLength = 20
+)
 
 type userServiceHandlers struct {
-	userRepository repository.UserRepository
+	userRepository    repository.UserRepository
+	sessionRepository repository.SessionRepository
+	// Outbox records events that are not part of any change. Events are not
+	// recorded if it is not set.
+	Outbox repository.OutboxRepository
+	// EmailDomains restricts the domains of registered email addresses. All
+	// valid domains are accepted if it is not set.
+	EmailDomains *EmailDomainPolicy
+	// PasswordPolicy decides which passwords are accepted at registration.
+	PasswordPolicy PasswordPolicy
+	// Messages translates the messages in responses.
+	Messages *i18n.Catalog
+	// RedirectUris are the URIs clients can redirect to after registration.
+	// Redirect URIs are not accepted if it is not set.
+	RedirectUris repository.RedirectUriRepository
+	// DefaultClientId identifies the client of requests without the client id
+	// header.
+	DefaultClientId string
+	// Lockout blocks logins after failed logins. Logins are not blocked if it
+	// is not set.
+	Lockout *LoginLockout
+	// Verifier sends verification emails to registered users and can deny
+	// logins of users who did not verify their address. Addresses are not
+	// verified if it is not set.
+	Verifier *EmailVerifier
+	// PasswordResets sends password reset links and changes passwords with
+	// them. Passwords can not be reset if it is not set.
+	PasswordResets *PasswordResetter
+	// Jobs runs work that is done after responding, e.g. sending emails. The
+	// work is done before responding if it is not set.
+	Jobs *JobQueue
 }
 
-func NewUserServiceHandlers(userRepository repository.UserRepository) *userServiceHandlers {
+func NewUserServiceHandlers(
+	userRepository repository.UserRepository,
+	sessionRepository repository.SessionRepository) *userServiceHandlers {
+
 	return &userServiceHandlers{
-		userRepository: userRepository,
+		userRepository:    userRepository,
+		sessionRepository: sessionRepository,
+		PasswordPolicy:    DefaultPasswordPolicy(),
+		Messages:          DefaultMessages(),
 	}
 }
 
 func (s *userServiceHandlers) RegisterUserMessageHandler() nnservice.MessageHandler {
-	return nnservice.MessageHandlerFunc(func(data []byte) []byte {
-		registerUser := &proto_user.RegisterUser{}
-		err := proto.Unmarshal(data, registerUser)
+	return nnservice.WithMessageTypes(nnservice.ProtoHandler(newRegisterUser, func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+		registerUser := request.(*proto_user.RegisterUser)
+		tr := s.localizer(header, registerUser.GetLocale())
+
+		errors := s.validateUser(tr, registerUser.GetUser())
+		redirectUri, err := s.redirectUri(header, registerUser.GetRedirectUri())
 		if err != nil {
-			logutil.ErrorNormal("Error unmarshalling RegisterUser", err)
-			return nil
+			redirectUriError := redirectUriInputError(tr, err)
+			if redirectUriError == nil {
+				return nil, err
+			}
+			header.Span.Logf("Redirect uri rejected: %s", registerUser.GetRedirectUri())
+			errors = append(errors, redirectUriError)
 		}
 
 		var registerResponse *proto_user.RegisterResponse
-		if errors := s.validateUser(registerUser.GetLocale(), registerUser.GetUser()); len(errors) != 0 {
+		if len(errors) != 0 {
 			registerResponse = &proto_user.RegisterResponse{
 				Valid:  proto.Bool(false),
 				Errors: errors,
 			}
 		} else {
-			err := s.userRepository.Save(registerUser.GetUser())
-			if err != nil {
-				logutil.ErrorNormal("Error inserting user", err)
-				return nil
-			}
-			log.Printf("Registered user: id=%d", registerUser.GetUser().GetId())
+			done := traceRepository(header.Span, "User.Save")
+			err := s.userRepository.Save(registerUser.GetUser(), events.NewUserRegistered(registerUser.GetUser()))
+			done(err)
+			if err == repository.ErrEmailTaken {
+				header.Span.Logf("Email already registered: %s", registerUser.GetUser().GetEmail())
+				registerResponse = &proto_user.RegisterResponse{
+					Valid: proto.Bool(false),
+					Errors: []*proto_user.RegisterResponse_InputError{
+						proto_user.NewInputError("email", tr.T("email.taken")),
+					},
+				}
+			} else if err != nil {
+				return nil, fmt.Errorf("Error inserting user: %s", err)
+			} else {
+				header.Span.Logf("Registered user: id=%d", registerUser.GetUser().GetId())
+				registrationsTotal.Inc()
+				// Registration succeeds even if the email is not sent, the
+				// user can ask for another one. The email is sent after
+				// responding, so that a slow mail server does not delay it.
+				if s.Verifier != nil {
+					user := registerUser.GetUser()
+					s.Jobs.Add(header.Span, "SendVerification", func(span *trace.Span) error {
+						return s.Verifier.Send(span, tr, user)
+					})
+				}
 
-			registerResponse = &proto_user.RegisterResponse{
-				Valid:       proto.Bool(true),
-				RedirectUri: proto.String("http://localhost:8080/user"), // TODO: implement redirect uri checking
+				registerResponse = &proto_user.RegisterResponse{
+					Valid: proto.Bool(true),
+				}
+				if redirectUri != "" {
+					registerResponse.RedirectUri = proto.String(redirectUri)
+				}
 			}
 		}
-		registerResponse.Locale = proto.String("en") // TODO: implement i18n
+		registerResponse.Locale = proto.String(tr.Locale())
+		return registerResponse, nil
+	}), newRegisterUser(), newRegisterResponse())
+}
 
-		responseData, err := proto.Marshal(registerResponse)
-		logutil.ErrorFatal("Error marshalling RegisterResponse", err)
-		return responseData
-	})
+func newRegisterUser() proto.Message {
+	return &proto_user.RegisterUser{}
+}
+
+// localizer translates the messages to the locale requested in the message
+// or, if it is not supported, by the end user.
+func (s *userServiceHandlers) localizer(header *nnservice.Header, locale string) *i18n.Localizer {
+	return s.Messages.Localizer(locale, header.Get(nnservice.HeaderAcceptLanguage))
 }
 
 func (s *userServiceHandlers) validateUser(
-	locale string, user *proto_user.User) []*proto_user.RegisterResponse_InputError {
+	tr *i18n.Localizer, user *proto_user.User) []*proto_user.RegisterResponse_InputError {
 
 	errors := make([]*proto_user.RegisterResponse_InputError, 0)
-	displayNameError := s.validateDisplayName(user.GetDisplayName())
+	displayNameError := s.validateDisplayName(tr, user.GetDisplayName())
 	if displayNameError != nil {
 		errors = append(errors, displayNameError)
 	}
-	emailError := s.validateEmail(user.GetEmail())
+	emailError := s.validateEmail(tr, user.GetEmail())
 	if emailError != nil {
 		errors = append(errors, emailError)
 	}
-	passwordError := s.validatePassword(user.GetPassword())
+	passwordError := s.validatePassword(tr, user)
 	if passwordError != nil {
 		errors = append(errors, passwordError)
 	}
 	return errors
 }
 
-func (s *userServiceHandlers) validateDisplayName(displayName string) *proto_user.RegisterResponse_InputError {
+func (s *userServiceHandlers) validateDisplayName(tr *i18n.Localizer, displayName string) *proto_user.RegisterResponse_InputError {
 	displayName = strings.TrimSpace(displayName)
 	var errorMessage string
 	if displayName == "" {
-		errorMessage = "Display Name must not be empty."
-	} else if strlen(displayName) < 3 || strlen(displayName) > 20 {
-		errorMessage = "Display Name length must be between 3 and 20 characters."
+		errorMessage = tr.T("display_name.empty")
+	} else if strlen(displayName) < minDisplayNameLength || strlen(displayName) > maxDisplayNameLength {
+		errorMessage = tr.T("display_name.length", minDisplayNameLength, maxDisplayNameLength)
 	}
 	if errorMessage != "" {
 		return proto_user.NewInputError("display_name", errorMessage)
@@ -96,13 +174,19 @@ func (s *userServiceHandlers) validateDisplayName(displayName string) *proto_use
 	return nil
 }
 
-func (s *userServiceHandlers) validateEmail(email string) *proto_user.RegisterResponse_InputError {
+func (s *userServiceHandlers) validateEmail(tr *i18n.Localizer, email string) *proto_user.RegisterResponse_InputError {
 	email = strings.TrimSpace(email)
 	var errorMessage string
 	if email == "" {
-		errorMessage = "Email must not be empty."
+		errorMessage = tr.T("email.empty")
 	} else if !strings.Contains(email, "@") {
-		errorMessage = "Email must contain an at sign (@)."
+		errorMessage = tr.T("email.missing_at")
+	} else if domain, err := parseEmail(email); err == errInvalidDomain {
+		errorMessage = tr.T("email.invalid_domain")
+	} else if err != nil {
+		errorMessage = tr.T("email.invalid")
+	} else if !s.EmailDomains.Accepts(domain) {
+		errorMessage = tr.T("email.domain_not_accepted")
 	}
 	if errorMessage != "" {
 		return proto_user.NewInputError("email", errorMessage)
@@ -110,53 +194,69 @@ func (s *userServiceHandlers) validateEmail(email string) *proto_user.RegisterRe
 	return nil
 }
 
-func (s *userServiceHandlers) validatePassword(password string) *proto_user.RegisterResponse_InputError {
-	var errorMessage string
-	if password == "" {
-		errorMessage = "Password must not be empty."
-	} else if strlen(password) < 6 {
-		errorMessage = "Password must be at least 6 characters long."
-	} else if strlen(password) > 1024 {
-		errorMessage = "Password length must not exceed 1024 characters."
-	}
-	if errorMessage != "" {
+func (s *userServiceHandlers) validatePassword(tr *i18n.Localizer, user *proto_user.User) *proto_user.RegisterResponse_InputError {
+	if errorMessage := s.PasswordPolicy.Check(tr, user.GetPassword(), user); errorMessage != "" {
 		return proto_user.NewInputError("password", errorMessage)
 	}
 	return nil
 }
 
 func (s *userServiceHandlers) AuthenticateUserMessageHandler(tokenGenerator util.TokenGenerator) nnservice.MessageHandler {
-	return nnservice.MessageHandlerFunc(func(data []byte) []byte {
-		authUser := &proto_user.AuthenticateUser{}
-		err := proto.Unmarshal(data, authUser)
-		if err != nil {
-			logutil.ErrorNormal("Error unmarshalling AuthenticateUser", err)
-			return nil
-		}
+	return nnservice.WithMessageTypes(nnservice.ProtoHandler(newAuthenticateUser, func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+		authUser := request.(*proto_user.AuthenticateUser)
 
 		authResult := &proto_user.AuthenticateResult{
-			Locale: proto.String("en"), // TODO: implement i18n
+			Locale: proto.String(s.localizer(header, authUser.GetLocale()).Locale()),
+		}
+
+		// Failures are not counted per source if the end user address is not
+		// known, rather than blocking everyone behind the calling service.
+		source := header.Get(nnservice.HeaderClientAddress)
+		if blocked := s.Lockout.BlockedFor(header.Span, authUser.GetEmail(), source); blocked > 0 {
+			header.Span.Logf("Login blocked for %s: email=%s", blocked, authUser.GetEmail())
+			loginsBlockedTotal.WithLabelValues(loginMethodSession).Inc()
+			return authResult, nil
 		}
 
+		done := traceRepository(header.Span, "User.FindByEmailAndPassword")
 		user, err := s.userRepository.FindByEmailAndPassword(authUser.GetEmail(), authUser.GetPassword())
+		done(err)
 		// If there are no rows returned from the query user authentication automatically fails.
-		if err != nil && err != sql.ErrNoRows {
-			logutil.ErrorNormal("Error retrieving user with given password", err)
+		if err != nil && err != sql.ErrNoRows && err != repository.ErrCredentialsMismatch {
+			return nil, fmt.Errorf("Error retrieving user with given password: %s", err)
 		} else if err == nil {
-			log.Printf("Authenticated user id=%d", user.GetId())
+			header.Span.Logf("Authenticated user id=%d", user.GetId())
+			s.Lockout.Succeeded(header.Span, authUser.GetEmail())
+			allowed, err := s.Verifier.AllowsLogin(header.Span, user)
+			if err != nil {
+				return nil, err
+			} else if !allowed {
+				header.Span.Logf("Login denied, email not verified: id=%d", user.GetId())
+				loginsUnverifiedTotal.WithLabelValues(loginMethodSession).Inc()
+				return authResult, nil
+			}
 			sessionId, err := tokenGenerator.GenerateHex(sessionIdLength)
 			if err != nil {
-				return nil
+				return nil, fmt.Errorf("Error generating session id: %s", err)
+			}
+			err = s.createSession(header, sessionId, user)
+			if err != nil {
+				return nil, fmt.Errorf("Error creating session: %s", err)
 			}
 			authResult.Sid = proto.String(sessionId)
+			recordEvent(header.Span, s.Outbox, events.NewUserAuthenticated(user))
 		} else {
-			log.Printf("User not found: email=%s", authUser.GetEmail())
+			header.Span.Logf("User not found: email=%s", authUser.GetEmail())
+			loginFailuresTotal.WithLabelValues(loginMethodSession).Inc()
+			s.Lockout.Failed(header.Span, authUser.GetEmail(), source)
+			recordEvent(header.Span, s.Outbox, events.NewAuthenticationFailed(authUser.GetEmail(), loginMethodSession))
 		}
+		return authResult, nil
+	}), newAuthenticateUser(), newAuthenticateResult())
+}
 
-		responseData, err := proto.Marshal(authResult)
-		logutil.ErrorFatal("Error marshalling AuthenticateResult", err)
-		return responseData
-	})
+func newAuthenticateUser() proto.Message {
+	return &proto_user.AuthenticateUser{}
 }
 
 func strlen(str string) int {
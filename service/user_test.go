@@ -2,27 +2,31 @@ package service_test
 
 import (
 	"database/sql"
-	"errors"
 	"testing"
 
 	"code.google.com/p/gogoprotobuf/proto"
 
 	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-user-management/events"
 	"github.com/opentarock/service-user-management/nnservice"
+	"github.com/opentarock/service-user-management/repository"
 	"github.com/opentarock/service-user-management/service"
+	"github.com/opentarock/service-user-management/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
 
 type UserRepositoryMock struct {
 	mock.Mock
+	savedEvents []*events.Event
 }
 
 func NewUserRepositoryMock() *UserRepositoryMock {
 	return &UserRepositoryMock{}
 }
 
-func (r *UserRepositoryMock) Save(user *proto_user.User) error {
+func (r *UserRepositoryMock) Save(user *proto_user.User, newEvents ...*events.Event) error {
+	r.savedEvents = newEvents
 	args := r.Mock.Called(user)
 	return args.Error(1)
 }
@@ -74,7 +78,8 @@ func (m *TokenGeneratorMock) GenerateHex(n uint) (string, error) {
 func handleMessage(t *testing.T, message proto.Message, handler nnservice.MessageHandler) []byte {
 	messageData, err := proto.Marshal(message)
 	assert.Nil(t, err)
-	result := handler.HandleMessage(messageData)
+	result, err := handler.HandleMessage(&nnservice.Header{}, messageData)
+	assert.Nil(t, err)
 	return result
 }
 
@@ -88,23 +93,40 @@ func NewValidUser() *proto_user.User {
 
 func TestUserIsRegistered(t *testing.T) {
 	userRepository := NewUserRepositoryMock()
-	handlers := service.NewUserServiceHandlers(userRepository)
+	redirectUriRepository := NewRedirectUriRepositoryMock()
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+	handlers.RedirectUris = redirectUriRepository
+	handlers.DefaultClientId = "frontend"
 
 	registerUser := &proto_user.RegisterUser{
 		User: NewValidUser(),
 	}
 	userRepository.On("Save", registerUser.GetUser()).Return(1, nil)
+	redirectUriRepository.On("FindByClientId", "frontend").Return([]string{"https://example.com/user"}, nil)
 	result := handleMessage(t, registerUser, handlers.RegisterUserMessageHandler())
 	var registerResponse proto_user.RegisterResponse
 	err := proto.Unmarshal(result, &registerResponse)
 	assert.Nil(t, err)
 	assert.True(t, registerResponse.GetValid())
-	assert.NotEmpty(t, registerResponse.GetRedirectUri())
+	assert.Equal(t, "https://example.com/user", registerResponse.GetRedirectUri())
 	assert.NotEmpty(t, registerResponse.GetLocale())
 }
 
+func TestUserRegisteredEventIsSavedWithUser(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+
+	registerUser := &proto_user.RegisterUser{
+		User: NewValidUser(),
+	}
+	userRepository.On("Save", registerUser.GetUser()).Return(1, nil)
+	handleMessage(t, registerUser, handlers.RegisterUserMessageHandler())
+	assert.Equal(t, 1, len(userRepository.savedEvents))
+	assert.Equal(t, events.TopicUserRegistered, userRepository.savedEvents[0].Topic)
+}
+
 func TestUserFieldDisplayNameIsValidated(t *testing.T) {
-	handlers := service.NewUserServiceHandlers(nil)
+	handlers := service.NewUserServiceHandlers(nil, nil)
 
 	registerUser := &proto_user.RegisterUser{
 		User: NewValidUser(),
@@ -119,7 +141,7 @@ func TestUserFieldDisplayNameIsValidated(t *testing.T) {
 }
 
 func TestUserFieldEmailIsValidated(t *testing.T) {
-	handlers := service.NewUserServiceHandlers(nil)
+	handlers := service.NewUserServiceHandlers(nil, nil)
 
 	registerUser := &proto_user.RegisterUser{
 		User: NewValidUser(),
@@ -134,7 +156,7 @@ func TestUserFieldEmailIsValidated(t *testing.T) {
 }
 
 func TestUserFieldPasswordIsValidated(t *testing.T) {
-	handlers := service.NewUserServiceHandlers(nil)
+	handlers := service.NewUserServiceHandlers(nil, nil)
 
 	registerUser := &proto_user.RegisterUser{
 		User: NewValidUser(),
@@ -149,7 +171,7 @@ func TestUserFieldPasswordIsValidated(t *testing.T) {
 }
 
 func TestUserAllFieldsAreValidatedAtOnce(t *testing.T) {
-	handlers := service.NewUserServiceHandlers(nil)
+	handlers := service.NewUserServiceHandlers(nil, nil)
 
 	registerUser := &proto_user.RegisterUser{
 		User: NewValidUser(),
@@ -166,8 +188,9 @@ func TestUserAllFieldsAreValidatedAtOnce(t *testing.T) {
 
 func TestTheUserIsAuthenticated(t *testing.T) {
 	userRepository := NewUserRepositoryMock()
+	sessionRepository := NewSessionRepositoryMock()
 	tokenGenerator := NewTokenGeneratorMock()
-	handlers := service.NewUserServiceHandlers(userRepository)
+	handlers := service.NewUserServiceHandlers(userRepository, sessionRepository)
 
 	user := NewValidUser()
 	authUser := &proto_user.AuthenticateUser{
@@ -176,17 +199,19 @@ func TestTheUserIsAuthenticated(t *testing.T) {
 	}
 	userRepository.On("FindByEmailAndPassword", user.GetEmail(), user.GetPassword()).Return(user, nil)
 	tokenGenerator.On("GenerateHex", uint(64)).Return("session", nil)
+	sessionRepository.On("Save", util.HashToken("session")).Return(nil)
 
 	result := handleMessage(t, authUser, handlers.AuthenticateUserMessageHandler(tokenGenerator))
 	var authResult proto_user.AuthenticateResult
 	err := proto.Unmarshal(result, &authResult)
 	assert.Nil(t, err)
 	assert.Equal(t, "session", authResult.GetSid())
+	sessionRepository.AssertExpectations(t)
 }
 
 func TestTheUnknownUserIsNotAuthenticated(t *testing.T) {
 	userRepository := NewUserRepositoryMock()
-	handlers := service.NewUserServiceHandlers(userRepository)
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
 
 	user := NewValidUser()
 	authUser := &proto_user.AuthenticateUser{
@@ -206,7 +231,7 @@ func TestTheUnknownUserIsNotAuthenticated(t *testing.T) {
 
 func TestUserWithWrongPasswordIsNotAuthenticated(t *testing.T) {
 	userRepository := NewUserRepositoryMock()
-	handlers := service.NewUserServiceHandlers(userRepository)
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
 
 	user := NewValidUser()
 	authUser := &proto_user.AuthenticateUser{
@@ -215,7 +240,7 @@ func TestUserWithWrongPasswordIsNotAuthenticated(t *testing.T) {
 	}
 	userRepository.On("FindByEmailAndPassword",
 		user.GetEmail(),
-		user.GetPassword()).Return(nil, errors.New("credentials_mismatch"))
+		user.GetPassword()).Return(nil, repository.ErrCredentialsMismatch)
 
 	result := handleMessage(t, authUser, handlers.AuthenticateUserMessageHandler(nil))
 	var authResult proto_user.AuthenticateResult
@@ -223,3 +248,39 @@ func TestUserWithWrongPasswordIsNotAuthenticated(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Empty(t, authResult.GetSid())
 }
+
+func TestAuthenticationFailsWhenUserCanNotBeRetrieved(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+
+	user := NewValidUser()
+	authUser := &proto_user.AuthenticateUser{
+		Email:    user.Email,
+		Password: user.Password,
+	}
+	userRepository.On("FindByEmailAndPassword",
+		user.GetEmail(),
+		user.GetPassword()).Return(nil, sql.ErrConnDone)
+
+	messageData, err := proto.Marshal(authUser)
+	assert.Nil(t, err)
+	_, err = handlers.AuthenticateUserMessageHandler(nil).HandleMessage(&nnservice.Header{}, messageData)
+	assert.NotNil(t, err)
+}
+
+func TestUserWithRegisteredEmailIsNotRegistered(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+
+	registerUser := &proto_user.RegisterUser{
+		User: NewValidUser(),
+	}
+	userRepository.On("Save", registerUser.GetUser()).Return(0, repository.ErrEmailTaken)
+	result := handleMessage(t, registerUser, handlers.RegisterUserMessageHandler())
+	var registerResponse proto_user.RegisterResponse
+	err := proto.Unmarshal(result, &registerResponse)
+	assert.Nil(t, err)
+	assert.False(t, registerResponse.GetValid())
+	assert.Equal(t, 1, len(registerResponse.GetErrors()))
+	assert.Equal(t, "email", registerResponse.GetErrors()[0].GetName())
+}
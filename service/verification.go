@@ -0,0 +1,236 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-api/go/proto_verification"
+	"github.com/opentarock/service-user-management/i18n"
+	"github.com/opentarock/service-user-management/mailer"
+	"github.com/opentarock/service-user-management/nnservice"
+	"github.com/opentarock/service-user-management/repository"
+	"github.com/opentarock/service-user-management/trace"
+	"github.com/opentarock/service-user-management/util"
+)
+
+const (
+	verificationTokenLength = 32
+	// DefaultVerificationTokenLifetime is how long verification links can be
+	// used by default.
+	DefaultVerificationTokenLifetime = 48 * time.Hour
+)
+
+// EmailVerifier emails verification links to users and checks whether users
+// verified their email address. All methods can be called on nil, which does
+// not send any emails and allows logins of all users.
+type EmailVerifier struct {
+	verifications  repository.EmailVerificationRepository
+	mailer         mailer.Mailer
+	tokenGenerator util.TokenGenerator
+	// VerifyUri is the page users open to verify their address. The token is
+	// added to it as the token query parameter.
+	VerifyUri string
+	// TokenLifetime is how long the sent tokens can be used.
+	TokenLifetime time.Duration
+	// Required denies logins of users who did not verify their address.
+	Required bool
+}
+
+func NewEmailVerifier(
+	verifications repository.EmailVerificationRepository,
+	mailer mailer.Mailer,
+	tokenGenerator util.TokenGenerator) *EmailVerifier {
+
+	return &EmailVerifier{
+		verifications:  verifications,
+		mailer:         mailer,
+		tokenGenerator: tokenGenerator,
+		TokenLifetime:  DefaultVerificationTokenLifetime,
+	}
+}
+
+// Send emails a new verification link to the address of the user. Links sent
+// earlier can still be used until they expire.
+func (v *EmailVerifier) Send(span *trace.Span, tr *i18n.Localizer, user *proto_user.User) error {
+	if v == nil {
+		return nil
+	}
+	token, err := v.tokenGenerator.GenerateHex(verificationTokenLength)
+	if err != nil {
+		return fmt.Errorf("Error generating verification token: %s", err)
+	}
+	link, err := linkWithToken(v.VerifyUri, token)
+	if err != nil {
+		return fmt.Errorf("Error creating verification link: %s", err)
+	}
+	now := time.Now()
+	verification := &repository.EmailVerification{
+		TokenHash: util.HashToken(token),
+		UserId:    user.GetId(),
+		Email:     user.GetEmail(),
+		CreatedOn: now,
+		ExpiresOn: now.Add(v.TokenLifetime),
+	}
+	done := traceRepository(span, "EmailVerification.Save")
+	err = v.verifications.Save(verification)
+	done(err)
+	if err != nil {
+		return fmt.Errorf("Error saving verification: %s", err)
+	}
+
+	message := &mailer.Message{
+		To:      user.GetEmail(),
+		Subject: tr.T("verification_email.subject"),
+		Body:    tr.T("verification_email.body", localizeDuration(tr, v.TokenLifetime), link, user.GetDisplayName()),
+	}
+	if err := sendMail(span, v.mailer, message); err != nil {
+		return fmt.Errorf("Error sending verification email: %s", err)
+	}
+	span.Logf("Verification email sent: user_id=%d", user.GetId())
+	verificationEmailsTotal.Inc()
+	return nil
+}
+
+// localizeDuration formats the duration in whole hours, or in minutes rounded
+// up if it is not a whole number of hours.
+func localizeDuration(tr *i18n.Localizer, d time.Duration) string {
+	if d >= time.Hour && d%time.Hour == 0 {
+		return tr.N("duration.hours", int(d/time.Hour))
+	}
+	minutes := int((d + time.Minute - 1) / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	return tr.N("duration.minutes", minutes)
+}
+
+// linkWithToken adds the token to the URI as the token query parameter.
+func linkWithToken(uri, token string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("token", token)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func sendMail(span *trace.Span, m mailer.Mailer, message *mailer.Message) error {
+	child := span.Child("mailer.Send", trace.SpanKindClient)
+	err := m.Send(message)
+	child.SetError(err)
+	child.Finish()
+	return err
+}
+
+// Verify verifies the address the token was sent to. It returns nil if the
+// token is unknown, expired or was sent to a previous address of the user.
+func (v *EmailVerifier) Verify(span *trace.Span, token string) (*repository.EmailVerification, error) {
+	if v == nil || token == "" {
+		return nil, nil
+	}
+	done := traceRepository(span, "EmailVerification.Verify")
+	verification, err := v.verifications.Verify(util.HashToken(token))
+	done(err)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error verifying email: %s", err)
+	}
+	return verification, nil
+}
+
+// IsVerified reports whether the user verified the email address.
+func (v *EmailVerifier) IsVerified(span *trace.Span, userId uint64) (bool, error) {
+	if v == nil {
+		return true, nil
+	}
+	done := traceRepository(span, "EmailVerification.IsVerified")
+	verified, err := v.verifications.IsVerified(userId)
+	done(err)
+	if err != nil {
+		return false, fmt.Errorf("Error retrieving verified status: %s", err)
+	}
+	return verified, nil
+}
+
+// AllowsLogin reports whether the authenticated user can log in, which is
+// always the case unless verified addresses are required.
+func (v *EmailVerifier) AllowsLogin(span *trace.Span, user *proto_user.User) (bool, error) {
+	if v == nil || !v.Required {
+		return true, nil
+	}
+	return v.IsVerified(span, user.GetId())
+}
+
+func (s *userServiceHandlers) VerifyEmailHandler() nnservice.MessageHandler {
+	return nnservice.WithMessageTypes(nnservice.ProtoHandler(newVerifyEmail, func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+		verifyEmail := request.(*proto_verification.VerifyEmail)
+		verification, err := s.Verifier.Verify(header.Span, verifyEmail.GetToken())
+		if err != nil {
+			return nil, err
+		}
+		response := &proto_verification.VerifyEmailResponse{
+			Verified: proto.Bool(verification != nil),
+		}
+		if verification != nil {
+			header.Span.Logf("Email verified: user_id=%d", verification.UserId)
+			response.UserId = proto.Uint64(verification.UserId)
+		} else {
+			header.Span.Logf("Verification token rejected")
+		}
+		return response, nil
+	}), newVerifyEmail(), newVerifyEmailResponse())
+}
+
+func newVerifyEmail() proto.Message {
+	return &proto_verification.VerifyEmail{}
+}
+
+// ResendVerificationHandler sends a new verification email if the address is
+// registered and not verified. The response is the same in every case so that
+// it can not be used to find out which addresses are registered.
+func (s *userServiceHandlers) ResendVerificationHandler() nnservice.MessageHandler {
+	return nnservice.WithMessageTypes(nnservice.ProtoHandler(newResendVerification, func(header *nnservice.Header, request proto.Message) (proto.Message, error) {
+		resend := request.(*proto_verification.ResendVerification)
+		response := &proto_verification.ResendVerificationResponse{}
+		if s.Verifier == nil {
+			return response, nil
+		}
+
+		done := traceRepository(header.Span, "User.FindByEmail")
+		user, err := s.userRepository.FindByEmail(resend.GetEmail())
+		done(err)
+		if err == sql.ErrNoRows {
+			header.Span.Logf("User not found: email=%s", resend.GetEmail())
+			return response, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("Error retrieving user: %s", err)
+		}
+		// Whether the address is verified is checked and the email is sent
+		// after responding, so that the response time is the same for every
+		// registered address.
+		tr := s.localizer(header, resend.GetLocale())
+		s.Jobs.Add(header.Span, "ResendVerification", func(span *trace.Span) error {
+			verified, err := s.Verifier.IsVerified(span, user.GetId())
+			if err != nil {
+				return err
+			} else if verified {
+				span.Logf("Email already verified: user_id=%d", user.GetId())
+				return nil
+			}
+			return s.Verifier.Send(span, tr, user)
+		})
+		return response, nil
+	}), newResendVerification(), newResendVerificationResponse())
+}
+
+func newResendVerification() proto.Message {
+	return &proto_verification.ResendVerification{}
+}
@@ -0,0 +1,260 @@
+package service_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/opentarock/service-api/go/proto_user"
+	"github.com/opentarock/service-api/go/proto_verification"
+	"github.com/opentarock/service-user-management/mailer"
+	"github.com/opentarock/service-user-management/repository"
+	"github.com/opentarock/service-user-management/service"
+	"github.com/opentarock/service-user-management/util"
+)
+
+type EmailVerificationRepositoryMock struct {
+	mock.Mock
+	saved []*repository.EmailVerification
+}
+
+func NewEmailVerificationRepositoryMock() *EmailVerificationRepositoryMock {
+	return &EmailVerificationRepositoryMock{}
+}
+
+func (r *EmailVerificationRepositoryMock) Save(verification *repository.EmailVerification) error {
+	r.saved = append(r.saved, verification)
+	args := r.Mock.Called(verification.UserId)
+	return args.Error(0)
+}
+
+func (r *EmailVerificationRepositoryMock) Verify(tokenHash string) (*repository.EmailVerification, error) {
+	args := r.Mock.Called(tokenHash)
+	verification, _ := args.Get(0).(*repository.EmailVerification)
+	return verification, args.Error(1)
+}
+
+func (r *EmailVerificationRepositoryMock) IsVerified(userId uint64) (bool, error) {
+	args := r.Mock.Called(userId)
+	return args.Bool(0), args.Error(1)
+}
+
+// newTestVerifier returns a verifier writing emails to a temporary directory,
+// which is removed by the returned function.
+func newTestVerifier(t *testing.T, verifications repository.EmailVerificationRepository) (
+	*service.EmailVerifier, func() ([]*mailer.Message, error), func()) {
+
+	dir, err := ioutil.TempDir("", "mail")
+	assert.Nil(t, err)
+	fileMailer := mailer.NewFileMailer(dir, "noreply@example.com")
+	tokenGenerator := NewTokenGeneratorMock()
+	tokenGenerator.On("GenerateHex", uint(32)).Return("token", nil)
+	verifier := service.NewEmailVerifier(verifications, fileMailer, tokenGenerator)
+	verifier.VerifyUri = "https://example.com/verify?source=email"
+	return verifier, fileMailer.Messages, func() { os.RemoveAll(dir) }
+}
+
+func TestVerificationEmailIsSentAtRegistration(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	verifications := NewEmailVerificationRepositoryMock()
+	verifier, sent, cleanup := newTestVerifier(t, verifications)
+	defer cleanup()
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+	handlers.Verifier = verifier
+	handlers.Jobs = service.NewJobQueue(1, 10)
+
+	registerUser := &proto_user.RegisterUser{
+		User: NewValidUser(),
+	}
+	userRepository.On("Save", registerUser.GetUser()).Return(1, nil)
+	verifications.On("Save", uint64(0)).Return(nil)
+	handleMessage(t, registerUser, handlers.RegisterUserMessageHandler())
+	assert.Nil(t, handlers.Jobs.Stop(time.Second))
+
+	if assert.Len(t, verifications.saved, 1) {
+		assert.Equal(t, util.HashToken("token"), verifications.saved[0].TokenHash)
+		assert.Equal(t, "mail@example.com", verifications.saved[0].Email)
+		assert.Equal(t, service.DefaultVerificationTokenLifetime,
+			verifications.saved[0].ExpiresOn.Sub(verifications.saved[0].CreatedOn))
+	}
+	messages, err := sent()
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "mail@example.com", messages[0].To)
+		assert.Equal(t, "Verify your email address", messages[0].Subject)
+		assert.True(t, strings.Contains(messages[0].Body, "https://example.com/verify?source=email&token=token\n"))
+		assert.True(t, strings.Contains(messages[0].Body, "expires in 48 hours"))
+	}
+}
+
+func TestUserIsRegisteredIfVerificationEmailFails(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	verifications := NewEmailVerificationRepositoryMock()
+	verifier, sent, cleanup := newTestVerifier(t, verifications)
+	defer cleanup()
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+	handlers.Verifier = verifier
+
+	registerUser := &proto_user.RegisterUser{
+		User: NewValidUser(),
+	}
+	userRepository.On("Save", registerUser.GetUser()).Return(1, nil)
+	verifications.On("Save", uint64(0)).Return(sql.ErrConnDone)
+	result := handleMessage(t, registerUser, handlers.RegisterUserMessageHandler())
+	var registerResponse proto_user.RegisterResponse
+	err := proto.Unmarshal(result, &registerResponse)
+	assert.Nil(t, err)
+	assert.True(t, registerResponse.GetValid())
+	messages, err := sent()
+	assert.Nil(t, err)
+	assert.Empty(t, messages, "email with unsaved token is not sent")
+}
+
+func TestEmailIsVerifiedWithToken(t *testing.T) {
+	verifications := NewEmailVerificationRepositoryMock()
+	verifier, _, cleanup := newTestVerifier(t, verifications)
+	defer cleanup()
+	handlers := service.NewUserServiceHandlers(nil, nil)
+	handlers.Verifier = verifier
+
+	verifications.On("Verify", util.HashToken("token")).Return(&repository.EmailVerification{UserId: 7}, nil)
+	verifications.On("Verify", util.HashToken("used")).Return(nil, sql.ErrNoRows)
+
+	var response proto_verification.VerifyEmailResponse
+	result := handleMessage(t, &proto_verification.VerifyEmail{Token: proto.String("token")}, handlers.VerifyEmailHandler())
+	err := proto.Unmarshal(result, &response)
+	assert.Nil(t, err)
+	assert.True(t, response.GetVerified())
+	assert.Equal(t, uint64(7), response.GetUserId())
+
+	result = handleMessage(t, &proto_verification.VerifyEmail{Token: proto.String("used")}, handlers.VerifyEmailHandler())
+	err = proto.Unmarshal(result, &response)
+	assert.Nil(t, err)
+	assert.False(t, response.GetVerified())
+	assert.Nil(t, response.UserId)
+}
+
+func TestVerificationIsResentOnlyToUnverifiedUsers(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	verifications := NewEmailVerificationRepositoryMock()
+	verifier, sent, cleanup := newTestVerifier(t, verifications)
+	defer cleanup()
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+	handlers.Verifier = verifier
+	handlers.Jobs = service.NewJobQueue(1, 10)
+	err := handlers.Messages.LoadDir("../locales")
+	assert.Nil(t, err)
+
+	unverified := NewValidUser()
+	unverified.Id = proto.Uint64(1)
+	verified := NewValidUser()
+	verified.Id = proto.Uint64(2)
+	verified.Email = proto.String("verified@example.com")
+	userRepository.On("FindByEmail", "unknown@example.com").Return(nil, sql.ErrNoRows)
+	userRepository.On("FindByEmail", "verified@example.com").Return(verified, nil)
+	userRepository.On("FindByEmail", "mail@example.com").Return(unverified, nil)
+	verifications.On("IsVerified", uint64(2)).Return(true, nil)
+	verifications.On("IsVerified", uint64(1)).Return(false, nil)
+	verifications.On("Save", uint64(1)).Return(nil)
+
+	for _, email := range []string{"unknown@example.com", "verified@example.com", "mail@example.com"} {
+		resend := &proto_verification.ResendVerification{
+			Email:  proto.String(email),
+			Locale: proto.String("de"),
+		}
+		result := handleMessage(t, resend, handlers.ResendVerificationHandler())
+		assert.Empty(t, result, email)
+	}
+	assert.Nil(t, handlers.Jobs.Stop(time.Second))
+	messages, err := sent()
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "mail@example.com", messages[0].To)
+		assert.Equal(t, "Bestätigen Sie Ihre E-Mail-Adresse", messages[0].Subject)
+		assert.True(t, strings.Contains(messages[0].Body, "48 Stunden gültig"))
+	}
+}
+
+func TestVerificationEmailShowsShortLifetimeInMinutes(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	verifications := NewEmailVerificationRepositoryMock()
+	verifier, sent, cleanup := newTestVerifier(t, verifications)
+	defer cleanup()
+	verifier.TokenLifetime = 30 * time.Minute
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+	handlers.Verifier = verifier
+
+	registerUser := &proto_user.RegisterUser{
+		User: NewValidUser(),
+	}
+	userRepository.On("Save", registerUser.GetUser()).Return(1, nil)
+	verifications.On("Save", uint64(0)).Return(nil)
+	handleMessage(t, registerUser, handlers.RegisterUserMessageHandler())
+
+	messages, err := sent()
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.True(t, strings.Contains(messages[0].Body, "expires in 30 minutes"))
+	}
+}
+
+func TestUnverifiedUserIsNotAuthenticatedWhenVerificationIsRequired(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	verifications := NewEmailVerificationRepositoryMock()
+	verifier, _, cleanup := newTestVerifier(t, verifications)
+	defer cleanup()
+	verifier.Required = true
+	handlers := service.NewUserServiceHandlers(userRepository, nil)
+	handlers.Verifier = verifier
+
+	user := NewValidUser()
+	user.Id = proto.Uint64(1)
+	authUser := &proto_user.AuthenticateUser{
+		Email:    user.Email,
+		Password: user.Password,
+	}
+	userRepository.On("FindByEmailAndPassword", user.GetEmail(), user.GetPassword()).Return(user, nil)
+	verifications.On("IsVerified", uint64(1)).Return(false, nil)
+
+	result := handleMessage(t, authUser, handlers.AuthenticateUserMessageHandler(nil))
+	var authResult proto_user.AuthenticateResult
+	err := proto.Unmarshal(result, &authResult)
+	assert.Nil(t, err)
+	assert.Empty(t, authResult.GetSid())
+}
+
+func TestPasswordGrantIsRejectedForUnverifiedUser(t *testing.T) {
+	userRepository := NewUserRepositoryMock()
+	clientRepository := &ClientRepositoryMock{}
+	verifications := NewEmailVerificationRepositoryMock()
+	verifier, _, cleanup := newTestVerifier(t, verifications)
+	defer cleanup()
+	verifier.Required = true
+	handlers := service.NewOauth2ServiceHandlers(userRepository, clientRepository, nil)
+	handlers.Verifier = verifier
+
+	user := NewValidUser()
+	user.Id = proto.Uint64(1)
+	clientRepository.On("FindById", "client").Return(newTestClient(), nil)
+	userRepository.On("FindByEmailAndPassword", user.GetEmail(), user.GetPassword()).Return(user, nil)
+	verifications.On("IsVerified", uint64(1)).Return(false, nil)
+
+	form := url.Values{
+		"grant_type": {"password"},
+		"username":   {user.GetEmail()},
+		"password":   {user.GetPassword()},
+	}
+	recorder, body := serveToken(handlers.TokenEndpoint(nil), tokenRequest(form, "client", "secret"))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "invalid_grant", body["error"])
+	assert.Equal(t, "Email address is not verified.", body["error_description"])
+}
@@ -0,0 +1,160 @@
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Exporter receives finished spans.
+type Exporter interface {
+	Export(span *Span)
+}
+
+var (
+	exporterMu sync.RWMutex
+	exporter   Exporter
+)
+
+// SetExporter sets the exporter of all the finished spans. Spans are not
+// exported if it is nil.
+func SetExporter(e Exporter) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+	exporter = e
+}
+
+func export(span *Span) {
+	exporterMu.RLock()
+	e := exporter
+	exporterMu.RUnlock()
+	if e != nil {
+		e.Export(span)
+	}
+}
+
+type otlpJsonExporter struct {
+	mu          sync.Mutex
+	w           io.Writer
+	serviceName string
+}
+
+// NewOTLPJSONExporter returns an exporter that writes every span as a line of
+// OTLP/JSON (an ExportTraceServiceRequest), the same format as written by
+// the file exporter of the OpenTelemetry collector.
+func NewOTLPJSONExporter(w io.Writer, serviceName string) Exporter {
+	return &otlpJsonExporter{
+		w:           w,
+		serviceName: serviceName,
+	}
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Status codes of OpenTelemetry spans.
+const (
+	otlpStatusOk    = 1
+	otlpStatusError = 2
+)
+
+func (e *otlpJsonExporter) Export(span *Span) {
+	attributes := span.Attributes()
+	attributes["request.id"] = span.RequestId
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	s := otlpSpan{
+		TraceId:           span.TraceId,
+		SpanId:            span.SpanId,
+		ParentSpanId:      span.ParentSpanId,
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Status:            otlpStatus{Code: otlpStatusOk},
+	}
+	for _, key := range keys {
+		s.Attributes = append(s.Attributes, stringAttribute(key, attributes[key]))
+	}
+	if span.Error != "" {
+		s.Status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+	}
+	request := otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{stringAttribute("service.name", e.serviceName)},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/opentarock/service-user-management/trace"},
+				Spans: []otlpSpan{s},
+			}},
+		}},
+	}
+	line, err := json.Marshal(request)
+	if err != nil {
+		log.Printf("Error encoding span: %s", err)
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(append(line, '\n'))
+	if err != nil {
+		log.Printf("Error exporting span: %s", err)
+	}
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
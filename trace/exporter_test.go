@@ -0,0 +1,87 @@
+package trace_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentarock/service-user-management/trace"
+)
+
+type exportedSpan struct {
+	TraceId      string `json:"traceId"`
+	SpanId       string `json:"spanId"`
+	ParentSpanId string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Attributes   []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+func decodeSpans(t *testing.T, output *bytes.Buffer) []exportedSpan {
+	spans := []exportedSpan{}
+	for _, line := range bytes.Split(bytes.TrimSpace(output.Bytes()), []byte("\n")) {
+		var request struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []exportedSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		assert.Nil(t, json.Unmarshal(line, &request))
+		spans = append(spans, request.ResourceSpans[0].ScopeSpans[0].Spans...)
+	}
+	return spans
+}
+
+func TestFinishedSpansAreExportedAsOTLPJSON(t *testing.T) {
+	output := &bytes.Buffer{}
+	trace.SetExporter(trace.NewOTLPJSONExporter(output, "test"))
+	defer trace.SetExporter(nil)
+
+	root := trace.NewSpan("", "request", "root")
+	child := root.Child("child", trace.SpanKindClient)
+	child.SetAttribute("key", "value")
+	child.SetError(errors.New("failed"))
+	child.Finish()
+	root.Finish()
+
+	spans := decodeSpans(t, output)
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "child", spans[0].Name)
+	assert.Equal(t, root.TraceId, spans[0].TraceId)
+	assert.Equal(t, root.SpanId, spans[0].ParentSpanId)
+	assert.Equal(t, "key", spans[0].Attributes[0].Key)
+	assert.Equal(t, "value", spans[0].Attributes[0].Value.StringValue)
+	assert.Equal(t, 2, spans[0].Status.Code)
+	assert.Equal(t, "failed", spans[0].Status.Message)
+	assert.Equal(t, "root", spans[1].Name)
+	assert.Empty(t, spans[1].ParentSpanId)
+	assert.Equal(t, 1, spans[1].Status.Code)
+}
+
+func TestInvalidTraceIdIsReplaced(t *testing.T) {
+	span := trace.NewSpan("invalid", "request", "root")
+	assert.Len(t, span.TraceId, 32)
+	assert.Len(t, span.SpanId, 16)
+}
+
+func TestNilSpanCanBeUsed(t *testing.T) {
+	var span *trace.Span
+	child := span.Child("child", trace.SpanKindInternal)
+	assert.Nil(t, child)
+	child.SetAttribute("key", "value")
+	child.SetError(errors.New("failed"))
+	child.Logf("message")
+	child.Finish()
+}
@@ -0,0 +1,145 @@
+package trace
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/opentarock/service-user-management/util"
+)
+
+const (
+	traceIdLength   = 16
+	spanIdLength    = 8
+	requestIdLength = 8
+)
+
+var validTraceId = regexp.MustCompile("^[0-9a-f]{32}$")
+
+type SpanKind int
+
+// Values are the same as the span kinds of OpenTelemetry.
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Span measures a part of handling of a request. All the spans of a request
+// share the request id, which is prepended to the lines logged with Logf.
+//
+// All the methods can be called on a nil span so code that is traced can also
+// be called without tracing.
+type Span struct {
+	TraceId      string
+	SpanId       string
+	ParentSpanId string
+	RequestId    string
+	Name         string
+	Kind         SpanKind
+	Start        time.Time
+	End          time.Time
+	// Error is the description of the error if the traced operation failed.
+	Error string
+
+	mu         sync.Mutex
+	attributes map[string]string
+}
+
+// NewSpan starts the root span of the request. New trace id is generated if
+// traceId is not a valid trace id and new request id if requestId is empty.
+func NewSpan(traceId, requestId, name string) *Span {
+	if !validTraceId.MatchString(traceId) {
+		traceId = randomId(traceIdLength)
+	}
+	if requestId == "" {
+		requestId = randomId(requestIdLength)
+	}
+	return &Span{
+		TraceId:   traceId,
+		SpanId:    randomId(spanIdLength),
+		RequestId: requestId,
+		Name:      name,
+		Kind:      SpanKindServer,
+		Start:     time.Now(),
+	}
+}
+
+// Child starts a span for a part of the operation traced by the span.
+func (s *Span) Child(name string, kind SpanKind) *Span {
+	if s == nil {
+		return nil
+	}
+	return &Span{
+		TraceId:      s.TraceId,
+		SpanId:       randomId(spanIdLength),
+		ParentSpanId: s.SpanId,
+		RequestId:    s.RequestId,
+		Name:         name,
+		Kind:         kind,
+		Start:        time.Now(),
+	}
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]string)
+	}
+	s.attributes[key] = value
+}
+
+// Attributes returns a copy of the span attributes.
+func (s *Span) Attributes() map[string]string {
+	attributes := make(map[string]string)
+	if s == nil {
+		return attributes
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, value := range s.attributes {
+		attributes[key] = value
+	}
+	return attributes
+}
+
+// SetError marks the span as failed if err is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Error = err.Error()
+}
+
+// Finish ends the span and exports it.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	export(s)
+}
+
+// Logf logs the message prefixed with the request id.
+func (s *Span) Logf(format string, args ...interface{}) {
+	if s == nil {
+		log.Printf(format, args...)
+		return
+	}
+	log.Printf("[%s] %s", s.RequestId, fmt.Sprintf(format, args...))
+}
+
+func randomId(n uint) string {
+	id, err := util.NewRandTokenGenerator().GenerateHex(n)
+	if err != nil {
+		// Reading random bytes does not fail on supported platforms.
+		panic(fmt.Sprintf("Error generating id: %s", err))
+	}
+	return id
+}
@@ -32,3 +32,10 @@ func Exec(statements map[string]*sql.Stmt, name string, args ...interface{}) (sq
 	}
 	panic(fmt.Sprintf("Exec statement not found: %s", name))
 }
+
+func Query(statements map[string]*sql.Stmt, name string, args ...interface{}) (*sql.Rows, error) {
+	if stmt, ok := statements[name]; ok {
+		return stmt.Query(args...)
+	}
+	panic(fmt.Sprintf("Query statement not found: %s", name))
+}
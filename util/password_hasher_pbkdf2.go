@@ -6,6 +6,9 @@ import (
 	"code.google.com/p/go.crypto/pbkdf2"
 )
 
+// PBKDF2KeyLength is the length of password hashes in bytes.
+const PBKDF2KeyLength = 64
+
 type pbkdf2PasswordHasher struct{}
 
 func NewPBKDF2PasswordHasher() *pbkdf2PasswordHasher {
@@ -13,5 +16,5 @@ func NewPBKDF2PasswordHasher() *pbkdf2PasswordHasher {
 }
 
 func (s pbkdf2PasswordHasher) Hash(password, salt string) []byte {
-	return pbkdf2.Key([]byte(password), []byte(salt), 4096, 64, sha256.New)
+	return pbkdf2.Key([]byte(password), []byte(salt), 4096, PBKDF2KeyLength, sha256.New)
 }
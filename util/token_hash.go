@@ -0,0 +1,14 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// HashToken returns the hex encoded SHA-256 hash of the token. Tokens sent to
+// users are stored only as hashes, so that they can not be used by anyone who
+// can read the database. Tokens are random so they do not need a salt.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}